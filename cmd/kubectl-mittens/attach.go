@@ -0,0 +1,414 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	watchtools "k8s.io/client-go/tools/watch"
+)
+
+const (
+	// detachKey detaches from the sidecar session without untapping, it is
+	// bound in the tmux configuration of the proxy images.
+	detachKey = "F12"
+)
+
+var (
+	// ErrServiceNotTapped occurs when attaching to a Service that is not tapped.
+	ErrServiceNotTapped = errors.New("the target Service is not tapped")
+	// ErrAttachNotTerminal occurs when attaching without a terminal.
+	ErrAttachNotTerminal = errors.New("attach requires an interactive terminal")
+	// ErrMittensPodTimeout occurs when the proxy Pod does not become ready in time, see --timeout.
+	ErrMittensPodTimeout = errors.New("the proxy Pod did not become ready in time")
+)
+
+// NewAttachCommand reconnects to the session of an already tapped Service.
+func NewAttachCommand(client kubernetes.Interface, config *rest.Config, viper *viper.Viper) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		targetSvcName := args[0]
+		namespace := targetNamespace(viper)
+		exists, err := hasNamespace(client, namespace)
+		if err != nil {
+			return fmt.Errorf("error fetching namespaces: %w", err)
+		}
+		if !exists {
+			return ErrNamespaceNotExist
+		}
+		printTarget(cmd.OutOrStdout(), viper, namespace)
+
+		targetService, err := client.CoreV1().Services(namespace).Get(context.TODO(), targetSvcName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if targetService.GetAnnotations()[annotationOriginalTargetPort] == "" {
+			return ErrServiceNotTapped
+		}
+		workload, err := workloadFromSelectors(client, namespace, targetService.Spec.Selector)
+		if err != nil {
+			return err
+		}
+		proxy, err := NewTap(client, ProxyOptions{
+			Namespace:    namespace,
+			Target:       targetSvcName,
+			Protocol:     tappedProtocol(targetService),
+			UI:           tappedUI(targetService),
+			workloadName: workload.Name(),
+		})
+		if err != nil {
+			return err
+		}
+
+		token, web := webUIToken(client, namespace, workload.Name())
+		if outFile, isTerminal := cmd.OutOrStdout().(*os.File); !web && (!isTerminal || outFile == nil) {
+			return ErrAttachNotTerminal
+		}
+		ctx := cmd.Context()
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		expiresAt, expiring := tapExpiry(targetService)
+		defer guardSession(ctx, cmd.OutOrStdout(), client, namespace, targetSvcName, viper.GetString("janitorImage"), expiring)()
+		ctx, cancel := untilExpiry(ctx, expiresAt)
+		defer cancel()
+		cmd.SetContext(ctx)
+		progress := newProgress(cmd, viper, namespace, targetSvcName)
+		pod, err := waitForMittensPod(cmd, progress, client, namespace, targetService, readinessTimeout(viper))
+		if err != nil {
+			if tapExpired(ctx) {
+				return untapExpired(cmd, client, config, viper, args)
+			}
+			return err
+		}
+		progress.report(phaseAttaching, fmt.Sprintf("Attaching to Pod %q", pod.Name))
+		if _, local := proxy.(*Local); local {
+			// only the local proxy stops, the sidecar keeps tunneling once it is restarted
+			announceExpiry(ctx, cmd.OutOrStdout(), expiresAt, nil)
+			err := serveLocal(cmd, client, config, pod, strings.Fields(viper.GetString("commandArgs")))
+			if tapExpired(ctx) {
+				return untapExpired(cmd, client, config, viper, args)
+			}
+			_, _ = fmt.Fprintln(cmd.OutOrStdout(), "")
+			printAttachHint(cmd.OutOrStdout(), namespace, targetSvcName)
+			return err
+		}
+		if web {
+			// the web UI keeps running without a client, only the forward is stopped
+			announceExpiry(ctx, cmd.OutOrStdout(), expiresAt, func(msg string) {
+				_, _ = fmt.Fprintln(cmd.OutOrStdout(), "Warning: "+msg)
+			})
+			err := serveWebUI(cmd, client, config, pod, token, viper.GetInt("webPort"), viper.GetBool("openBrowser"))
+			if tapExpired(ctx) {
+				return untapExpired(cmd, client, config, viper, args)
+			}
+			_, _ = fmt.Fprintln(cmd.OutOrStdout(), "")
+			printAttachHint(cmd.OutOrStdout(), namespace, targetSvcName)
+			return err
+		}
+		return attachOrUntap(cmd, progress, client, config, viper, args, pod, proxy, expiresAt)
+	}
+}
+
+// waitForMittensPod watches the Pods of the workload behind a Service until
+// the containers of a proxy Pod are ready, reporting the rollout to progress.
+// Pods that cannot start, e.g. for an image that cannot be pulled, and Pods
+// the workload controller fails to create, e.g. for an exceeded quota, fail
+// the wait right away. A zero timeout waits forever.
+func waitForMittensPod(cmd *cobra.Command, progress *progress, client kubernetes.Interface, namespace string, svc *v1.Service, timeout time.Duration) (v1.Pod, error) {
+	parent := cmd.Context()
+	if parent == nil {
+		parent = context.Background()
+	}
+	progress.start("Waiting for Pod containers to become ready...")
+	workload, err := workloadFromSelectors(client, namespace, svc.Spec.Selector)
+	if err != nil {
+		progress.fail("Error getting workload")
+		return v1.Pod{}, err
+	}
+	sel, err := metav1.LabelSelectorAsSelector(workload.Selector())
+	if err != nil {
+		progress.fail("Error getting workload")
+		return v1.Pod{}, fmt.Errorf("error parsing %s selector: %w", workload.Kind(), err)
+	}
+
+	desired := proxyReplicas(parent, client, svc, workload, sel)
+
+	ctx, cancelTimeout := context.WithCancel(parent)
+	if timeout > 0 {
+		ctx, cancelTimeout = context.WithTimeoutCause(parent, timeout, fmt.Errorf("%w: not ready after %s", ErrMittensPodTimeout, timeout))
+	}
+	defer cancelTimeout()
+	ctx, cancel := context.WithCancelCause(ctx)
+	failedCreate := make(chan struct{})
+	go func() {
+		defer close(failedCreate)
+		if err := watchFailedCreate(ctx, client, workload); err != nil {
+			cancel(err)
+		}
+	}()
+	defer func() {
+		cancel(nil)
+		<-failedCreate
+	}()
+	if expiresAt, expiring := tapExpiry(svc); expiring {
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			for {
+				progress.setSuffix(fmt.Sprintf(" (the tap expires in %s)", remaining(expiresAt, time.Now())))
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+
+	// the Pods of the workload, to report the rollout
+	pods := map[string]*v1.Pod{}
+	var failed *v1.Pod
+	ev, err := watchtools.UntilWithSync(ctx, podListWatch(client, namespace, sel.String()), &v1.Pod{}, nil, func(e watch.Event) (bool, error) {
+		pod, ok := e.Object.(*v1.Pod)
+		if !ok {
+			return false, nil
+		}
+		if e.Type == watch.Deleted {
+			delete(pods, pod.Name)
+		} else {
+			pods[pod.Name] = pod
+		}
+		progress.rollout(rolloutStatus(pods, workload, desired))
+		if e.Type == watch.Deleted || pod.DeletionTimestamp != nil || pod.GetAnnotations()[annotationIsTapped] != workload.Name() {
+			return false, nil
+		}
+		if podReady(*pod) {
+			return true, nil
+		}
+		if failure := podFailure(pod); failure != "" {
+			failed = pod
+			return false, fmt.Errorf("%w: Pod %q: %s", ErrMittensPodFailed, pod.Name, failure)
+		}
+		return false, nil
+	})
+	switch {
+	case err == nil:
+		progress.stop(phaseReady, "Pod ready!")
+		return *ev.Object.(*v1.Pod), nil
+	case parent.Err() != nil:
+		progress.fail("Cancelled")
+		return v1.Pod{}, parent.Err()
+	case ctx.Err() != nil:
+		// the timeout or a failure to create the Pods
+		err = context.Cause(ctx)
+	}
+	if errors.Is(err, ErrMittensPodTimeout) {
+		progress.fail(fmt.Sprintf("Pod not ready after %s. Cancelling.", timeout))
+	} else {
+		progress.fail("Pod cannot start")
+	}
+	if failed != nil {
+		printPodEvents(parent, cmd.OutOrStdout(), client, failed)
+	}
+	return v1.Pod{}, err
+}
+
+// rolloutStatus counts the ready tapped Pods of a workload and its Pods that
+// are terminating, desired is passed through, see proxyReplicas.
+func rolloutStatus(pods map[string]*v1.Pod, workload Workload, desired int) (ready, _, terminating int) {
+	for _, pod := range pods {
+		switch {
+		case pod.DeletionTimestamp != nil:
+			terminating++
+		case pod.GetAnnotations()[annotationIsTapped] == workload.Name() && podReady(*pod):
+			ready++
+		}
+	}
+	return ready, desired, terminating
+}
+
+// proxyReplicas returns how many proxy Pods the tap of a Service runs: the
+// replicas of the canary Deployment, the Pods an ephemeral proxy was
+// injected into, or the replicas of the patched workload. The count is only
+// reported, the replicas of the workload are assumed if it cannot be read.
+func proxyReplicas(ctx context.Context, client kubernetes.Interface, svc *v1.Service, workload Workload, sel labels.Selector) int {
+	switch tappedStrategy(svc) {
+	case strategyCanary:
+		dpl, err := client.AppsV1().Deployments(svc.Namespace).Get(ctx, standaloneName(canaryPrefix, svc.Name), metav1.GetOptions{})
+		if err == nil {
+			return int(replicasOrDefault(dpl.Spec.Replicas))
+		}
+	case strategyEphemeral:
+		req, err := labels.NewRequirement(labelEphemeral, selection.Equals, []string{"true"})
+		if err != nil {
+			break
+		}
+		pods, err := client.CoreV1().Pods(svc.Namespace).List(ctx, metav1.ListOptions{LabelSelector: sel.Add(*req).String()})
+		if err != nil {
+			break
+		}
+		injected := 0
+		for _, pod := range pods.Items {
+			if pod.DeletionTimestamp == nil && pod.GetAnnotations()[annotationIsTapped] == workload.Name() {
+				injected++
+			}
+		}
+		return injected
+	}
+	return int(workload.Replicas())
+}
+
+// podReady reports whether the proxy in a tapped Pod can be used. The Pod
+// conditions do not cover ephemeral containers, their status is checked instead.
+func podReady(pod v1.Pod) bool {
+	if _, ephemeral := pod.GetAnnotations()[annotationSidecar]; ephemeral {
+		return sidecarReady(pod)
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == v1.ContainersReady && cond.Status == v1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// attachOrUntap attaches to the session in the proxy Pod. When the session
+// ended or the tap expired at expiresAt the tap is removed, when the client
+// merely detached or lost its connection the tap is left in place so it can
+// be attached to again. When the proxy Pod is replaced, e.g. after an
+// eviction, the session is attached to again in its replacement.
+func attachOrUntap(cmd *cobra.Command, progress *progress, client kubernetes.Interface, config *rest.Config, viper *viper.Viper, args []string, pod v1.Pod, proxy Tap, expiresAt time.Time) error {
+	ctx := cmd.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	_, _ = fmt.Fprintf(cmd.OutOrStdout(), "Press %s (or Ctrl-b d) to detach and keep the tap in place.\n", detachKey)
+	// the expiry warning is shown in the session of the current Pod
+	var mu sync.Mutex
+	var notify func(msg string)
+	inSession := func(pod v1.Pod) {
+		if expiresAt.IsZero() {
+			return
+		}
+		n := showExpiryInSession(ctx, client, config, pod, expiresAt)
+		mu.Lock()
+		defer mu.Unlock()
+		notify = n
+	}
+	inSession(pod)
+	if !expiresAt.IsZero() {
+		announceExpiry(ctx, cmd.OutOrStdout(), expiresAt, func(msg string) {
+			mu.Lock()
+			defer mu.Unlock()
+			notify(msg)
+		})
+	}
+
+	for {
+		// Attach to the sidecar's tmux session, until it ends or the Pod is replaced
+		attachCtx, cancel := context.WithCancelCause(ctx)
+		watched := make(chan struct{})
+		go func() {
+			defer close(watched)
+			if err := watchProxyPod(attachCtx, client, pod); err != nil {
+				cancel(err)
+			}
+		}()
+		err := attachTerminal(attachCtx, client, config, pod, proxy.AttachCommand())
+		replaced := errors.Is(context.Cause(attachCtx), ErrProxyReplaced)
+		cancel(nil)
+		<-watched
+		if tapExpired(ctx) {
+			return untapExpired(cmd, client, config, viper, args)
+		}
+		// Quitting mitmproxy or detaching ends the exec cleanly, a replaced
+		// Pod breaks it, possibly before the watch tells why.
+		if err == nil || ctx.Err() != nil {
+			replaced = false
+		} else if !replaced {
+			var checkErr error
+			if replaced, checkErr = proxyReplaced(ctx, client, pod); checkErr != nil {
+				_, _ = fmt.Fprintln(cmd.OutOrStdout(), "")
+				printAttachHint(cmd.OutOrStdout(), pod.Namespace, args[0])
+				return checkErr
+			}
+		}
+		if !replaced {
+			return endSession(cmd, client, config, viper, args, pod, proxy, err)
+		}
+
+		_, _ = fmt.Fprintf(cmd.OutOrStdout(), "\r\nProxy Pod %q was replaced, reattaching to its replacement...\n", pod.Name)
+		targetService, svcErr := client.CoreV1().Services(pod.Namespace).Get(ctx, args[0], metav1.GetOptions{})
+		if svcErr != nil {
+			printAttachHint(cmd.OutOrStdout(), pod.Namespace, args[0])
+			return svcErr
+		}
+		next, err := waitForMittensPod(cmd, progress, client, pod.Namespace, targetService, readinessTimeout(viper))
+		if err != nil {
+			if tapExpired(ctx) {
+				return untapExpired(cmd, client, config, viper, args)
+			}
+			printAttachHint(cmd.OutOrStdout(), pod.Namespace, args[0])
+			return err
+		}
+		pod = next
+		progress.report(phaseAttaching, fmt.Sprintf("Attaching to Pod %q", pod.Name))
+		inSession(pod)
+	}
+}
+
+// endSession removes the tap once the user ended the session in the proxy
+// Pod. When the session outlives the client, because it was detached or the
+// connection dropped, the tap is left in place.
+func endSession(cmd *cobra.Command, client kubernetes.Interface, config *rest.Config, viper *viper.Viper, args []string, pod v1.Pod, proxy Tap, err error) error {
+	ctx := cmd.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if running, ok := sessionRunning(ctx, client, config, pod, proxy); running || !ok {
+		_, _ = fmt.Fprintln(cmd.OutOrStdout(), "")
+		printAttachHint(cmd.OutOrStdout(), pod.Namespace, args[0])
+		return err
+	}
+
+	// User has ended the session, clean up the tap
+	_, _ = fmt.Fprintln(cmd.OutOrStdout(), "")
+	_, _ = fmt.Fprintln(cmd.OutOrStdout(), "Cleaning up litter...")
+	if untapErr := NewUntapCommand(client, config, viper)(cmd, args); untapErr != nil {
+		return untapErr
+	}
+	return err
+}
+
+// printAttachHint tells the user how to get back to a tap that was left running.
+func printAttachHint(out io.Writer, namespace, svcName string) {
+	_, _ = fmt.Fprintf(out, "Service %q stays tapped. To reconnect run:\n  kubectl mittens attach %s -n %s\n", svcName, svcName, namespace)
+	_, _ = fmt.Fprintf(out, "To remove the tap run:\n  kubectl mittens untap %s -n %s\n", svcName, namespace)
+}
@@ -0,0 +1,164 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func Test_NewAttachCommand(t *testing.T) {
+	tests := []struct {
+		Name       string
+		ClientFunc func() *fake.Clientset
+		Namespace  string
+		Err        error
+	}{
+		{"not_tapped", fakeClientUntappedSimple, "default", ErrServiceNotTapped},
+		{"no_namespace_in_cluster", fakeClientUntappedWithoutNamespace, "none", ErrNamespaceNotExist},
+		{"missing_deployment", fakeClientTappedWithoutDeployment, "default", ErrServiceSelectorNoMatch},
+		// the test output is not a terminal, so attaching stops right before the exec
+		{"tapped", fakeClientTappedWithPod, "default", ErrAttachNotTerminal},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			testViper := viper.New()
+			testViper.Set("namespace", tc.Namespace)
+			cmd := &cobra.Command{}
+			cmd.SetOutput(ioutil.Discard)
+			err := NewAttachCommand(tc.ClientFunc(), &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+			require.True(errors.Is(err, tc.Err), "expected (%v), got (%v)", tc.Err, err)
+		})
+	}
+}
+
+func Test_TapDetach(t *testing.T) {
+	require := require.New(t)
+	fakeClient := fakeClientUntappedSimple()
+	testViper := viper.New()
+	testViper.Set("proxyPort", 80)
+	testViper.Set("namespace", "default")
+	testViper.Set("detach", true)
+	b := bytes.NewBufferString("")
+	cmd := &cobra.Command{}
+	cmd.SetOutput(b)
+	err := NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+	require.Nil(err)
+	require.Contains(b.String(), "kubectl mittens attach sample-service -n default")
+
+	// the tap stays in place
+	svc, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+	require.Nil(err)
+	require.NotEmpty(svc.GetAnnotations()[annotationOriginalTargetPort])
+}
+
+func Test_WaitForMittensPod(t *testing.T) {
+	tests := []struct {
+		Name       string
+		ClientFunc func() *fake.Clientset
+		Cancelled  bool
+		Err        error
+		Output     string
+	}{
+		{"ready", fakeClientTappedWithReadyPod, false, nil, ""},
+		{"no_pod", fakeClientTappedSimple, false, ErrMittensPodTimeout, ""},
+		{"cancelled", fakeClientTappedWithPod, true, context.Canceled, ""},
+		{"image_pull", fakeClientTappedWithFailedPod, false, ErrMittensPodFailed, "Failed  Failed to pull image"},
+		{"failed_create", fakeClientTappedWithFailedCreate, false, ErrMittensPodFailed, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.Cancelled {
+				cancel()
+			}
+			b := bytes.NewBufferString("")
+			cmd := &cobra.Command{}
+			cmd.SetOutput(b)
+			cmd.SetContext(ctx)
+			svc := simpleServiceTapped
+			pod, err := waitForMittensPod(cmd, newProgress(cmd, viper.New(), "default", svc.Name), tc.ClientFunc(), "default", &svc, 500*time.Millisecond)
+			require.Contains(b.String(), tc.Output)
+			if tc.Err != nil {
+				require.True(errors.Is(err, tc.Err), "expected (%v), got (%v)", tc.Err, err)
+				return
+			}
+			require.Nil(err)
+			require.Equal("sample-mittens-pod", pod.Name)
+		})
+	}
+}
+
+func fakeClientTappedWithFailedPod() *fake.Clientset {
+	client := fakeClientTappedWithPod()
+	pod, _ := client.CoreV1().Pods("default").Get(context.TODO(), "sample-mittens-pod", metav1.GetOptions{})
+	pod.Status.ContainerStatuses[1].Ready = false
+	pod.Status.ContainerStatuses[1].State.Waiting = &v1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "Back-off pulling image"}
+	_ = client.Tracker().Update(v1.SchemeGroupVersion.WithResource("pods"), pod, "default")
+	_ = client.Tracker().Add(&v1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Name: "sample-mittens-pod.1", Namespace: "default"},
+		InvolvedObject: v1.ObjectReference{Kind: "Pod", Name: "sample-mittens-pod", Namespace: "default"},
+		Type:           v1.EventTypeWarning,
+		Reason:         "Failed",
+		Message:        "Failed to pull image",
+	})
+	return client
+}
+
+// fakeClientTappedWithFailedCreate has a FailedCreate event on the ReplicaSet
+// of the tapped Deployment that repeats once the watch starts.
+func fakeClientTappedWithFailedCreate() *fake.Clientset {
+	client := fakeClientTappedSimple()
+	event := &v1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Name: "sample-deployment-5d4f8.1", Namespace: "default"},
+		InvolvedObject: v1.ObjectReference{Kind: kindReplicaSet, Name: "sample-deployment-5d4f8", Namespace: "default"},
+		Type:           v1.EventTypeWarning,
+		Reason:         "FailedCreate",
+		Message:        "exceeded quota",
+		Count:          1,
+	}
+	_ = client.Tracker().Add(event)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		repeated := event.DeepCopy()
+		repeated.Count = 2
+		_ = client.Tracker().Update(v1.SchemeGroupVersion.WithResource("events"), repeated, "default")
+	}()
+	return client
+}
+
+func fakeClientTappedWithReadyPod() *fake.Clientset {
+	client := fakeClientTappedWithPod()
+	pod, _ := client.CoreV1().Pods("default").Get(context.TODO(), "sample-mittens-pod", metav1.GetOptions{})
+	pod.Status.Conditions = []v1.PodCondition{
+		{Type: v1.ContainersReady, Status: v1.ConditionTrue},
+	}
+	_ = client.Tracker().Update(v1.SchemeGroupVersion.WithResource("pods"), pod, "default")
+	return client
+}
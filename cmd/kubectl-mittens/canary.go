@@ -0,0 +1,222 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	k8sappsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// strategyCanary runs the proxy in clones of a few Pods next to the
+	// untouched workload, so only a slice of the traffic is intercepted.
+	strategyCanary = "canary"
+
+	canaryPrefix = "mittens-canary-"
+	// canaryOrigPortName replaces the name of the tapped port of the cloned
+	// containers, the proxy takes over the original name.
+	canaryOrigPortName = "mittens-orig"
+	// labelCanary marks the canary Deployment and its Pods with the name of
+	// the tapped Service.
+	labelCanary = "mittens.io/canary"
+)
+
+var (
+	// ErrReplicasInvalid occurs when --replicas is neither a positive count nor a percentage.
+	ErrReplicasInvalid = errors.New("replicas must be a positive count or a percentage, e.g. 1 or 10%")
+	// ErrCanaryPortUnnamed occurs when the tapped port has no name in the pod
+	// template, which canary taps rely on to route to the proxy.
+	ErrCanaryPortUnnamed = errors.New("canary taps need the tapped port to be named in the pod template")
+)
+
+// canaryReplicas returns the number of canary Pods for a count, or a
+// percentage of the running Pods rounded up. At least one is returned.
+func canaryReplicas(replicas string, running int) (int32, error) {
+	if p, ok := strings.CutSuffix(replicas, "%"); ok {
+		percent, err := strconv.ParseFloat(p, 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return 0, fmt.Errorf("%w: %q", ErrReplicasInvalid, replicas)
+		}
+		return int32(max(1, math.Ceil(float64(running)*percent/100))), nil
+	}
+	n, err := strconv.ParseInt(replicas, 10, 32)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%w: %q", ErrReplicasInvalid, replicas)
+	}
+	return int32(n), nil
+}
+
+// canaryPortName returns the name of the container port a Service port
+// targets and its number. A numeric target port is looked up by number.
+func canaryPortName(workload Workload, sp v1.ServicePort) (string, int32, error) {
+	for _, c := range workload.PodTemplate().Spec.Containers {
+		for _, p := range c.Ports {
+			if sp.TargetPort.Type == intstr.String && p.Name == sp.TargetPort.StrVal {
+				return p.Name, p.ContainerPort, nil
+			}
+			if sp.TargetPort.Type == intstr.Int && p.ContainerPort == sp.TargetPort.IntVal {
+				if p.Name == "" {
+					return "", 0, fmt.Errorf("%w: port %d", ErrCanaryPortUnnamed, p.ContainerPort)
+				}
+				return p.Name, p.ContainerPort, nil
+			}
+		}
+	}
+	if sp.TargetPort.Type == intstr.String {
+		return "", 0, ErrWorkloadMissingPorts
+	}
+	return "", 0, fmt.Errorf("%w: port %d", ErrCanaryPortUnnamed, sp.TargetPort.IntVal)
+}
+
+// tapCanary creates a Deployment of replicas clones of the pod template of
+// workload with the proxy added. The clones carry the labels the Service
+// selects, and the proxy takes over the name of the tapped port, so the
+// Service sends to the proxy in the clones and to the app everywhere else.
+// It returns the name of the tapped port the Service must target.
+func tapCanary(client kubernetes.Interface, targetService *v1.Service, targetPort int32, workload Workload, replicas, image string, commandArgs []string, proxyOpts ProxyOptions) (string, error) {
+	namespace := proxyOpts.Namespace
+	var portName string
+	var containerPort int32
+	var found bool
+	for _, sp := range targetService.Spec.Ports {
+		if sp.Port != targetPort || servicePortProtocol(sp) != proxyOpts.Protocol.ServiceProtocol() {
+			continue
+		}
+		var err error
+		portName, containerPort, err = canaryPortName(workload, sp)
+		if err != nil {
+			return "", err
+		}
+		found = true
+	}
+	if !found {
+		return "", ErrServiceMissingPort
+	}
+
+	pods, err := client.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(targetService.Spec.Selector).String(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error listing Pods: %w", err)
+	}
+	var running int
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == v1.PodRunning {
+			running++
+		}
+	}
+	count, err := canaryReplicas(replicas, running)
+	if err != nil {
+		return "", err
+	}
+
+	proxyOpts.UpstreamPort = strconv.Itoa(int(containerPort))
+	proxyOpts.workloadName = workload.Name()
+	proxy, err := NewTap(client, proxyOpts)
+	if err != nil {
+		return "", err
+	}
+	if err := proxy.ReadyEnv(); err != nil {
+		return "", err
+	}
+
+	tmpl := workload.PodTemplate().DeepCopy()
+	for i := range tmpl.Spec.Containers {
+		for j := range tmpl.Spec.Containers[i].Ports {
+			if tmpl.Spec.Containers[i].Ports[j].Name == portName {
+				tmpl.Spec.Containers[i].Ports[j].Name = canaryOrigPortName
+			}
+		}
+	}
+	// volumes of StatefulSet claim templates only exist in the StatefulSet, the clones get scratch space
+	volumes := map[string]bool{}
+	for _, vol := range tmpl.Spec.Volumes {
+		volumes[vol.Name] = true
+	}
+	for _, c := range tmpl.Spec.Containers {
+		for _, m := range c.VolumeMounts {
+			if !volumes[m.Name] {
+				volumes[m.Name] = true
+				tmpl.Spec.Volumes = append(tmpl.Spec.Volumes, v1.Volume{
+					Name:         m.Name,
+					VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}},
+				})
+			}
+		}
+	}
+	sidecar := proxy.Sidecar(workload.Name())
+	sidecar.Image = image
+	if len(commandArgs) > 0 {
+		sidecar.Args = commandArgs
+	}
+	sidecar.Ports = append([]v1.ContainerPort{}, sidecar.Ports...)
+	sidecar.Ports[0].Name = portName
+	tmpl.Spec.Containers = append(tmpl.Spec.Containers, sidecar)
+
+	podLabels := map[string]string{}
+	for k, v := range tmpl.GetLabels() {
+		podLabels[k] = v
+	}
+	podLabels[labelCanary] = targetService.Name
+	tmpl.SetLabels(podLabels)
+	// the canary Pods are found and configured through the tapped workload, see mittensPod
+	anns := tmpl.GetAnnotations()
+	if anns == nil {
+		anns = map[string]string{}
+	}
+	anns[annotationIsTapped] = workload.Name()
+	tmpl.SetAnnotations(anns)
+
+	// the proxy config is named after the tapped workload, like the mount of the sidecar
+	proxy.PatchWorkload(tmpl, workload.Name())
+
+	canaryLabels := map[string]string{labelCanary: targetService.Name}
+	dpl := k8sappsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      standaloneName(canaryPrefix, targetService.Name),
+			Namespace: namespace,
+			Labels:    canaryLabels,
+		},
+		Spec: k8sappsv1.DeploymentSpec{
+			Replicas: &count,
+			Selector: &metav1.LabelSelector{MatchLabels: canaryLabels},
+			Template: *tmpl,
+		},
+	}
+	if _, err := client.AppsV1().Deployments(namespace).Create(context.TODO(), &dpl, metav1.CreateOptions{FieldManager: fieldManager}); err != nil {
+		return "", fmt.Errorf("error creating canary Deployment: %w", err)
+	}
+	return portName, nil
+}
+
+// untapCanary deletes the canary Deployment of a Service.
+func untapCanary(client kubernetes.Interface, namespace, svcName string) error {
+	err := client.AppsV1().Deployments(namespace).Delete(context.TODO(), standaloneName(canaryPrefix, svcName), metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error deleting canary Deployment: %w", err)
+	}
+	return nil
+}
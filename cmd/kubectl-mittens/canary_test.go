@@ -0,0 +1,179 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func Test_CanaryReplicas(t *testing.T) {
+	tests := []struct {
+		Replicas string
+		Running  int
+		Expected int32
+		Err      error
+	}{
+		{"1", 20, 1, nil},
+		{"3", 0, 3, nil},
+		{"10%", 20, 2, nil},
+		{"10%", 3, 1, nil},
+		{"50%", 5, 3, nil},
+		{"5%", 0, 1, nil},
+		{"0", 20, 0, ErrReplicasInvalid},
+		{"-1", 20, 0, ErrReplicasInvalid},
+		{"one", 20, 0, ErrReplicasInvalid},
+		{"0%", 20, 0, ErrReplicasInvalid},
+		{"150%", 20, 0, ErrReplicasInvalid},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Replicas+"_of_"+strconv.Itoa(tc.Running), func(t *testing.T) {
+			require := require.New(t)
+			n, err := canaryReplicas(tc.Replicas, tc.Running)
+			if tc.Err != nil {
+				require.True(errors.Is(err, tc.Err), "expected (%v), got (%v)", tc.Err, err)
+				return
+			}
+			require.Nil(err)
+			require.Equal(tc.Expected, n)
+		})
+	}
+}
+
+func Test_TapCanary(t *testing.T) {
+	tests := []struct {
+		Name       string
+		TargetPort intstr.IntOrString
+		PortName   string
+		Running    int
+		Replicas   string
+		Strategy   string
+		Expected   int32
+		Err        error
+	}{
+		{"named_target", intstr.FromString("http"), "http", 0, "1", "", 1, nil},
+		{"numeric_target", intstr.FromInt(8080), "http", 0, "1", "", 1, nil},
+		{"percentage", intstr.FromString("http"), "http", 4, "50%", "", 2, nil},
+		{"unnamed_port", intstr.FromInt(8080), "", 0, "1", "", 0, ErrCanaryPortUnnamed},
+		{"invalid_replicas", intstr.FromString("http"), "http", 0, "none", "", 0, ErrReplicasInvalid},
+		{"with_strategy", intstr.FromString("http"), "http", 0, "1", strategyEphemeral, 0, ErrStrategyNotSupported},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			fakeClient := fakeClientUntappedCanary(tc.TargetPort, tc.PortName, tc.Running)
+			origSvc, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+			require.Nil(err)
+			testViper := viper.New()
+			testViper.Set("proxyPort", 80)
+			testViper.Set("namespace", "default")
+			testViper.Set("replicas", tc.Replicas)
+			testViper.Set("strategy", tc.Strategy)
+			testViper.Set("proxyImage", defaultImageHTTP)
+			testViper.Set("commandArgs", defaultCommandArgs)
+			cmd := &cobra.Command{}
+			cmd.SetOutput(ioutil.Discard)
+			err = NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+			if tc.Err != nil {
+				require.True(errors.Is(err, tc.Err), "expected (%v), got (%v)", tc.Err, err)
+				_, err = fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "mittens-canary-sample-service", metav1.GetOptions{})
+				require.True(apierrors.IsNotFound(err), "nothing is left behind")
+				return
+			}
+			require.Nil(err)
+
+			// the production workload is left alone
+			dpl, err := fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "sample-deployment", metav1.GetOptions{})
+			require.Nil(err)
+			require.Len(dpl.Spec.Template.Spec.Containers, 1)
+
+			canary, err := fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "mittens-canary-sample-service", metav1.GetOptions{})
+			require.Nil(err)
+			require.Equal(tc.Expected, *canary.Spec.Replicas)
+			tmpl := canary.Spec.Template
+			require.Equal("myapp", tmpl.Labels["app"], "the canary must carry the Service selector labels")
+			require.Equal("sample-deployment", tmpl.Annotations[annotationIsTapped])
+			require.Len(tmpl.Spec.Containers, 2)
+			require.Equal(canaryOrigPortName, tmpl.Spec.Containers[0].Ports[0].Name)
+			sidecar := tmpl.Spec.Containers[1]
+			require.Equal(mittensContainerName, sidecar.Name)
+			require.Equal(tc.PortName, sidecar.Ports[0].Name)
+			require.Equal(int32(mittensProxyListenPort), sidecar.Ports[0].ContainerPort)
+			require.Equal(mittensConfigMapPrefix+"sample-deployment", sidecar.VolumeMounts[0].Name)
+			require.Equal(mittensConfigMapPrefix+"sample-deployment", tmpl.Spec.Volumes[0].ConfigMap.Name, "the volume must refer to the proxy config of the tapped workload")
+			cm, err := fakeClient.CoreV1().ConfigMaps("default").Get(context.TODO(), mittensConfigMapPrefix+"sample-deployment", metav1.GetOptions{})
+			require.Nil(err)
+			require.Contains(string(cm.BinaryData[mitmproxyConfigFile]), "reverse:http://127.0.0.1:8080")
+
+			svc, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+			require.Nil(err)
+			require.Equal(strategyCanary, tappedStrategy(svc))
+			require.Equal(origSvc.Spec.Selector, svc.Spec.Selector)
+			require.Equal(intstr.FromString(tc.PortName), svc.Spec.Ports[0].TargetPort)
+
+			// the canary is not picked up as the workload of the Service
+			w, err := workloadFromSelectors(fakeClient, "default", svc.Spec.Selector)
+			require.Nil(err)
+			require.Equal("sample-deployment", w.Name())
+
+			require.Nil(NewUntapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+			svc, err = fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+			require.Nil(err)
+			require.Equal(origSvc.Spec, svc.Spec)
+			require.Equal(origSvc.GetAnnotations(), svc.GetAnnotations())
+			_, err = fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "mittens-canary-sample-service", metav1.GetOptions{})
+			require.True(apierrors.IsNotFound(err))
+			_, err = fakeClient.CoreV1().ConfigMaps("default").Get(context.TODO(), mittensConfigMapPrefix+"sample-deployment", metav1.GetOptions{})
+			require.True(apierrors.IsNotFound(err))
+		})
+	}
+}
+
+// fakeClientUntappedCanary serves port 8080 of the simple Deployment, named
+// portName, through the Service targetPort, with running Pods of it.
+func fakeClientUntappedCanary(targetPort intstr.IntOrString, portName string, running int) *fake.Clientset {
+	namespace := simpleNamespace
+	deployment := simpleDeployment.DeepCopy()
+	deployment.Spec.Template.Labels = map[string]string{"app": "myapp"}
+	deployment.Spec.Template.Spec.Containers[0].Ports = []v1.ContainerPort{
+		{Name: portName, ContainerPort: 8080, Protocol: v1.ProtocolTCP},
+	}
+	service := simpleService.DeepCopy()
+	service.Spec.Ports[0].TargetPort = targetPort
+	client := fake.NewSimpleClientset(&namespace, deployment, service)
+	for i := range running {
+		_ = client.Tracker().Add(&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "sample-pod-" + strconv.Itoa(i),
+				Namespace: "default",
+				Labels:    map[string]string{"app": "myapp"},
+			},
+			Status: v1.PodStatus{Phase: v1.PodRunning},
+		})
+	}
+	return client
+}
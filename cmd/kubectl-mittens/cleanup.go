@@ -0,0 +1,264 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/AlecAivazis/survey/v2"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	k8sappsv1 "k8s.io/api/apps/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+var (
+	// ErrCleanupNotConfirmed occurs when cleanup cannot prompt for confirmation and --yes was not given.
+	ErrCleanupNotConfirmed = errors.New("cleanup requires confirmation, pass --yes to run non-interactively")
+	// ErrCleanupAborted occurs when the user declines the cleanup.
+	ErrCleanupAborted = errors.New("cleanup aborted")
+)
+
+// leftovers are the resources mittens left behind in the cluster.
+type leftovers struct {
+	Services   []v1.Service
+	Workloads  []Workload
+	ConfigMaps []v1.ConfigMap
+	// Pods carry ephemeral proxies, which cannot be removed but are stopped
+	Pods []v1.Pod
+	// ProxyDeployments belong to standalone and canary taps and janitors, ShadowServices to standalone taps
+	ProxyDeployments []k8sappsv1.Deployment
+	ShadowServices   []v1.Service
+	Leases           []coordinationv1.Lease
+}
+
+// empty reports whether there is nothing to clean up.
+func (l leftovers) empty() bool {
+	return len(l.Services) == 0 && len(l.Workloads) == 0 && len(l.ConfigMaps) == 0 && len(l.Pods) == 0 &&
+		len(l.ProxyDeployments) == 0 && len(l.ShadowServices) == 0 && len(l.Leases) == 0
+}
+
+// NewCleanupCommand reverts every tap in a namespace, or in all namespaces.
+func NewCleanupCommand(client kubernetes.Interface, config *rest.Config, viper *viper.Viper) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, _ []string) error {
+		namespace := targetNamespace(viper)
+		ctx := cmd.Context()
+		if ctx == nil {
+			ctx = context.Background()
+		}
+
+		var l leftovers
+		var err error
+		allNamespaces := viper.GetBool("allNamespaces")
+		if allNamespaces {
+			l, err = findLeftovers(ctx, client, "")
+			if apierrors.IsForbidden(err) {
+				// tenants of a shared cluster may only list their own namespace
+				_, _ = fmt.Fprintf(cmd.ErrOrStderr(), "Warning: listing all namespaces is forbidden, cleaning up Namespace %q\n", namespace)
+				allNamespaces = false
+			}
+		}
+		if !allNamespaces {
+			exists, nsErr := hasNamespace(client, namespace)
+			if nsErr != nil {
+				return fmt.Errorf("error fetching namespaces: %w", nsErr)
+			}
+			if !exists {
+				return ErrNamespaceNotExist
+			}
+			l, err = findLeftovers(ctx, client, namespace)
+		}
+		if err != nil {
+			return err
+		}
+		out := cmd.OutOrStdout()
+		if l.empty() {
+			_, _ = fmt.Fprintln(out, "Nothing to clean up")
+			return nil
+		}
+		scope := namespace
+		if allNamespaces {
+			scope = ""
+		}
+		printTarget(out, viper, scope)
+		printLeftovers(out, l)
+
+		if !viper.GetBool("yes") {
+			if _, isTerminal := out.(*os.File); !isTerminal {
+				return ErrCleanupNotConfirmed
+			}
+			var confirmed bool
+			if err := survey.AskOne(&survey.Confirm{Message: "Revert all of the above?"}, &confirmed); err != nil {
+				return fmt.Errorf("confirmation cancelled: %w", err)
+			}
+			if !confirmed {
+				return ErrCleanupAborted
+			}
+		}
+
+		// Keep going on errors so one broken resource does not block the rest.
+		var errs []error
+		// snapshots are among the ConfigMaps, which are deleted last
+		snaps := snapshotsIn(l.ConfigMaps)
+		for _, svc := range l.Services {
+			var svcSnap *serviceSnapshot
+			if s, ok := snaps[types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}]; ok {
+				svcSnap = &s.Service
+			}
+			if err := untapSvc(client.CoreV1().Services(svc.Namespace), svc.Name, svcSnap); err != nil {
+				errs = append(errs, fmt.Errorf("error untapping Service %s/%s: %w", svc.Namespace, svc.Name, err))
+				continue
+			}
+			_, _ = fmt.Fprintf(out, "Untapped Service %s/%s\n", svc.Namespace, svc.Name)
+		}
+		for _, w := range l.Workloads {
+			if err := untapWorkload(client, w, workloadSnapshotIn(snaps, w)); err != nil {
+				errs = append(errs, fmt.Errorf("error untapping %s %s/%s: %w", w.Kind(), w.Namespace(), w.Name(), err))
+				continue
+			}
+			_, _ = fmt.Fprintf(out, "Removed sidecar from %s %s/%s\n", w.Kind(), w.Namespace(), w.Name())
+		}
+		for _, pod := range l.Pods {
+			if err := untapEphemeralPod(ctx, client, config, pod); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			_, _ = fmt.Fprintf(out, "Stopped ephemeral proxy in Pod %s/%s\n", pod.Namespace, pod.Name)
+		}
+		for _, dpl := range l.ProxyDeployments {
+			if err := client.AppsV1().Deployments(dpl.Namespace).Delete(ctx, dpl.Name, metav1.DeleteOptions{}); err != nil {
+				errs = append(errs, fmt.Errorf("error deleting Deployment %s/%s: %w", dpl.Namespace, dpl.Name, err))
+				continue
+			}
+			_, _ = fmt.Fprintf(out, "Deleted Deployment %s/%s\n", dpl.Namespace, dpl.Name)
+		}
+		for _, svc := range l.ShadowServices {
+			if err := client.CoreV1().Services(svc.Namespace).Delete(ctx, svc.Name, metav1.DeleteOptions{}); err != nil {
+				errs = append(errs, fmt.Errorf("error deleting Service %s/%s: %w", svc.Namespace, svc.Name, err))
+				continue
+			}
+			_, _ = fmt.Fprintf(out, "Deleted Service %s/%s\n", svc.Namespace, svc.Name)
+		}
+		for _, lease := range l.Leases {
+			if err := client.CoordinationV1().Leases(lease.Namespace).Delete(ctx, lease.Name, metav1.DeleteOptions{}); err != nil {
+				errs = append(errs, fmt.Errorf("error deleting Lease %s/%s: %w", lease.Namespace, lease.Name, err))
+				continue
+			}
+			_, _ = fmt.Fprintf(out, "Deleted Lease %s/%s\n", lease.Namespace, lease.Name)
+		}
+		for _, cm := range l.ConfigMaps {
+			if err := client.CoreV1().ConfigMaps(cm.Namespace).Delete(context.TODO(), cm.Name, metav1.DeleteOptions{}); err != nil {
+				errs = append(errs, fmt.Errorf("error deleting ConfigMap %s/%s: %w", cm.Namespace, cm.Name, err))
+				continue
+			}
+			_, _ = fmt.Fprintf(out, "Deleted ConfigMap %s/%s\n", cm.Namespace, cm.Name)
+		}
+		return errors.Join(errs...)
+	}
+}
+
+// findLeftovers lists tapped Services, tapped workloads, Pods with ephemeral proxies,
+// standalone and canary proxies, janitors with their Leases and mittens ConfigMaps
+// in a namespace, or in all namespaces if namespace is empty.
+func findLeftovers(ctx context.Context, client kubernetes.Interface, namespace string) (leftovers, error) {
+	var l leftovers
+	svcs, err := client.CoreV1().Services(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return l, fmt.Errorf("error listing Services: %w", err)
+	}
+	for _, svc := range svcs.Items {
+		if _, ok := svc.GetAnnotations()[annotationOriginalTargetPort]; ok {
+			l.Services = append(l.Services, svc)
+		}
+		if _, ok := svc.GetLabels()[labelStandalone]; ok {
+			l.ShadowServices = append(l.ShadowServices, svc)
+		}
+	}
+	for _, label := range []string{labelStandalone, labelCanary, labelJanitor} {
+		dpls, err := client.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{LabelSelector: label})
+		if err != nil {
+			return l, fmt.Errorf("error listing Deployments: %w", err)
+		}
+		l.ProxyDeployments = append(l.ProxyDeployments, dpls.Items...)
+	}
+	leases, err := client.CoordinationV1().Leases(namespace).List(ctx, metav1.ListOptions{LabelSelector: labelJanitor})
+	if err != nil {
+		return l, fmt.Errorf("error listing Leases: %w", err)
+	}
+	l.Leases = leases.Items
+	l.Workloads, err = tappedWorkloads(client, namespace)
+	if err != nil {
+		return l, fmt.Errorf("error listing workloads: %w", err)
+	}
+	l.Pods, err = ephemeralTappedPods(ctx, client, namespace)
+	if err != nil {
+		return l, err
+	}
+	cms, err := client.CoreV1().ConfigMaps(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return l, fmt.Errorf("error listing ConfigMaps: %w", err)
+	}
+	for _, cm := range cms.Items {
+		_, annotated := cm.GetAnnotations()[annotationConfigMap]
+		if annotated || strings.HasPrefix(cm.Name, mittensConfigMapPrefix) {
+			l.ConfigMaps = append(l.ConfigMaps, cm)
+		}
+	}
+	return l, nil
+}
+
+// printLeftovers writes a summary table of the resources cleanup will revert.
+func printLeftovers(out io.Writer, l leftovers) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "KIND\tNAMESPACE\tNAME\tACTION")
+	for _, svc := range l.Services {
+		action := "restore target port"
+		if expiresAt, ok := tapExpiry(&svc); ok && time.Now().After(expiresAt) {
+			action += " (expired)"
+		}
+		_, _ = fmt.Fprintf(w, "Service\t%s\t%s\t%s\n", svc.Namespace, svc.Name, action)
+	}
+	for _, wl := range l.Workloads {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\tremove sidecar\n", wl.Kind(), wl.Namespace(), wl.Name())
+	}
+	for _, dpl := range l.ProxyDeployments {
+		_, _ = fmt.Fprintf(w, "Deployment\t%s\t%s\tdelete\n", dpl.Namespace, dpl.Name)
+	}
+	for _, svc := range l.ShadowServices {
+		_, _ = fmt.Fprintf(w, "Service\t%s\t%s\tdelete\n", svc.Namespace, svc.Name)
+	}
+	for _, pod := range l.Pods {
+		_, _ = fmt.Fprintf(w, "Pod\t%s\t%s\tstop ephemeral proxy %s\n", pod.Namespace, pod.Name, sidecarName(pod))
+	}
+	for _, lease := range l.Leases {
+		_, _ = fmt.Fprintf(w, "Lease\t%s\t%s\tdelete\n", lease.Namespace, lease.Name)
+	}
+	for _, cm := range l.ConfigMaps {
+		_, _ = fmt.Fprintf(w, "ConfigMap\t%s\t%s\tdelete\n", cm.Namespace, cm.Name)
+	}
+	_ = w.Flush()
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	k8sappsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func Test_NewCleanupCommand(t *testing.T) {
+	tests := []struct {
+		Name          string
+		ClientFunc    func() *fake.Clientset
+		Namespace     string
+		AllNamespaces bool
+		Yes           bool
+		Remaining     []string
+		Err           error
+	}{
+		{"simple", fakeClientTappedSimple, "default", false, true, nil, nil},
+		{"nothing_tapped", fakeClientUntappedSimple, "default", false, true, nil, nil},
+		{"orphaned_configmap", fakeClientUntappedWithConfigMap, "default", false, true, nil, nil},
+		{"namespace_only", fakeClientTappedTwoNamespaces, "default", false, true, []string{"other"}, nil},
+		{"all_namespaces", fakeClientTappedTwoNamespaces, "default", true, true, nil, nil},
+		{"not_confirmed", fakeClientTappedSimple, "default", false, false, []string{"default"}, ErrCleanupNotConfirmed},
+		{"no_namespace_in_cluster", fakeClientUntappedWithoutNamespace, "none", false, true, nil, ErrNamespaceNotExist},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			fakeClient := tc.ClientFunc()
+			testViper := viper.New()
+			testViper.Set("namespace", tc.Namespace)
+			testViper.Set("allNamespaces", tc.AllNamespaces)
+			testViper.Set("yes", tc.Yes)
+			b := bytes.NewBufferString("")
+			cmd := &cobra.Command{}
+			cmd.SetOutput(b)
+			err := NewCleanupCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{})
+			if tc.Err != nil {
+				require.NotNil(err)
+				require.True(errors.Is(err, tc.Err))
+				if tc.Err == ErrNamespaceNotExist {
+					return
+				}
+			} else {
+				require.Nil(err)
+			}
+
+			l, err := findLeftovers(context.TODO(), fakeClient, "")
+			require.Nil(err)
+			var remaining []string
+			for _, svc := range l.Services {
+				remaining = append(remaining, svc.Namespace)
+			}
+			require.Equal(tc.Remaining, remaining, "unexpected tapped Services")
+			require.Len(l.Workloads, len(tc.Remaining), "unexpected tapped workloads")
+			require.Len(l.ConfigMaps, len(tc.Remaining), "unexpected ConfigMaps")
+			if len(tc.Remaining) == 0 {
+				svc, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+				require.Nil(err)
+				require.Equal(8080, svc.Spec.Ports[0].TargetPort.IntValue())
+			}
+		})
+	}
+}
+
+func Test_FindLeftovers(t *testing.T) {
+	require := require.New(t)
+	l, err := findLeftovers(context.TODO(), fakeClientTappedTwoNamespaces(), "")
+	require.Nil(err)
+	require.Len(l.Services, 2)
+	require.Len(l.Workloads, 2)
+	require.Len(l.ConfigMaps, 2)
+	b := bytes.NewBufferString("")
+	printLeftovers(b, l)
+	require.Contains(b.String(), "Deployment  other")
+	require.Contains(b.String(), "ConfigMap   default")
+}
+
+func fakeClientTappedTwoNamespaces() *fake.Clientset {
+	namespace := simpleNamespace
+	deployment := simpleDeploymentTapped
+	service := simpleServiceTapped
+	configMap := simpleConfigMapTapped
+	otherNamespace := v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "other",
+		},
+	}
+	otherDeployment := k8sappsv1.Deployment{}
+	simpleDeploymentTapped.DeepCopyInto(&otherDeployment)
+	otherDeployment.Namespace = "other"
+	otherDeployment.Spec.Template.Annotations = map[string]string{annotationIsTapped: "true"}
+	otherDeployment.Spec.Template.Spec.Containers = otherDeployment.Spec.Template.Spec.Containers[:1]
+	otherService := v1.Service{}
+	simpleServiceTapped.DeepCopyInto(&otherService)
+	otherService.Namespace = "other"
+	otherConfigMap := v1.ConfigMap{}
+	simpleConfigMapTapped.DeepCopyInto(&otherConfigMap)
+	otherConfigMap.Namespace = "other"
+	return fake.NewSimpleClientset(
+		&namespace,
+		&deployment,
+		&service,
+		&configMap,
+		&otherNamespace,
+		&otherDeployment,
+		&otherService,
+		&otherConfigMap,
+	)
+}
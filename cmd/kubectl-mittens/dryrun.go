@@ -0,0 +1,448 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	dryRunNone   = "none"
+	dryRunClient = "client"
+	dryRunServer = "server"
+
+	outputDiff = "diff"
+)
+
+var (
+	// ErrDryRunNotSupported occurs when an unknown dry-run mode is requested.
+	ErrDryRunNotSupported = errors.New("dry-run mode not supported, use one of [ none, client, server ]")
+	// ErrDryRunOutputNotSupported occurs when an unknown dry-run output format is requested.
+	ErrDryRunOutputNotSupported = errors.New("dry-run output format not supported, use one of [ diff, yaml ]")
+	// ErrOutputWithoutDryRun occurs when a --dry-run output format is given to a tap that is not a dry run.
+	ErrOutputWithoutDryRun = errors.New("--output diff and yaml are only supported with --dry-run, use --output json for progress events")
+)
+
+// dryRunChange is an object a tap would create, change or delete.
+type dryRunChange struct {
+	// Live and Tapped are the object before and after the tap, nil if it does not exist.
+	Live, Tapped map[string]interface{}
+}
+
+// NewDryRunTapCommand renders the objects a tap would create or change
+// without persisting anything. In client mode the tap runs against an
+// in-memory copy of the namespace, in server mode every write is sent with
+// the dryRun option, so admission and validation run on the API server.
+func NewDryRunTapCommand(client kubernetes.Interface, config *rest.Config, viper *viper.Viper) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		mode := viper.GetString("dryRun")
+		output := viper.GetString("output")
+		if output == "" {
+			output = outputDiff
+		}
+		if output != outputDiff && output != outputYAML {
+			return ErrDryRunOutputNotSupported
+		}
+		if viper.GetString("strategy") == strategyEphemeral {
+			return fmt.Errorf("%w: ephemeral containers are added to running Pods and cannot be dry run", ErrStrategyNotSupported)
+		}
+		namespace := targetNamespace(viper)
+		ctx := cmd.Context()
+		if ctx == nil {
+			ctx = context.Background()
+		}
+
+		var changes []dryRunChange
+		var err error
+		switch mode {
+		case dryRunClient:
+			changes, err = clientDryRun(ctx, client, config, viper, args, namespace)
+		case dryRunServer:
+			changes, err = serverDryRun(ctx, config, viper, args)
+		default:
+			return fmt.Errorf("%w: %q", ErrDryRunNotSupported, mode)
+		}
+		if err != nil {
+			return err
+		}
+		return printDryRun(cmd.OutOrStdout(), changes, output)
+	}
+}
+
+// dryRunTap runs the tap command against tapClient as a detached tap,
+// discarding its output.
+func dryRunTap(ctx context.Context, tapClient kubernetes.Interface, config *rest.Config, viper *viper.Viper, args []string) error {
+	mode, output, detach, preflight, yes := viper.GetString("dryRun"), viper.GetString("output"), viper.GetBool("detach"), viper.GetBool("preflight"), viper.GetBool("yes")
+	viper.Set("dryRun", dryRunNone)
+	viper.Set("output", "")
+	viper.Set("detach", true)
+	// the review requests would be recorded as changes
+	viper.Set("preflight", false)
+	// nothing is changed, so protected Services need no confirmation, refused ones are still refused
+	viper.Set("yes", true)
+	defer func() {
+		viper.Set("dryRun", mode)
+		viper.Set("output", output)
+		viper.Set("detach", detach)
+		viper.Set("preflight", preflight)
+		viper.Set("yes", yes)
+	}()
+	inner := &cobra.Command{}
+	inner.SetOutput(io.Discard)
+	inner.SetContext(ctx)
+	return NewTapCommand(tapClient, config, viper)(inner, args)
+}
+
+// dryRunKey identifies an object in the in-memory copy of a namespace.
+type dryRunKey struct {
+	Resource  schema.GroupVersionResource
+	Namespace string
+	Name      string
+}
+
+// clientDryRun taps against a fake clientset seeded with the objects of the
+// namespace the tap reads, and returns the objects that were written to.
+func clientDryRun(ctx context.Context, client kubernetes.Interface, config *rest.Config, viper *viper.Viper, args []string, namespace string) ([]dryRunChange, error) {
+	dryClient := fake.NewSimpleClientset()
+	live := map[dryRunKey]runtime.Object{}
+	seed := func(list runtime.Object, err error) error {
+		if err != nil {
+			return err
+		}
+		items, err := meta.ExtractList(list)
+		if err != nil {
+			return err
+		}
+		for _, obj := range items {
+			key, err := dryRunKeyOf(obj)
+			if err != nil {
+				return err
+			}
+			if err := dryClient.Tracker().Add(obj); err != nil {
+				return err
+			}
+			live[key] = obj
+		}
+		return nil
+	}
+	opts := metav1.ListOptions{}
+	if err := dryClient.Tracker().Add(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}); err != nil {
+		return nil, err
+	}
+	for _, err := range []error{
+		seed(client.CoreV1().Services(namespace).List(ctx, opts)),
+		seed(client.CoreV1().ConfigMaps(namespace).List(ctx, opts)),
+		seed(client.CoreV1().Pods(namespace).List(ctx, opts)),
+		seed(client.AppsV1().Deployments(namespace).List(ctx, opts)),
+		seed(client.AppsV1().StatefulSets(namespace).List(ctx, opts)),
+		seed(client.AppsV1().DaemonSets(namespace).List(ctx, opts)),
+		seed(client.AppsV1().ReplicaSets(namespace).List(ctx, opts)),
+		seed(client.CoordinationV1().Leases(namespace).List(ctx, opts)),
+	} {
+		if err != nil {
+			return nil, fmt.Errorf("error reading namespace %q: %w", namespace, err)
+		}
+	}
+
+	if err := dryRunTap(ctx, dryClient, config, viper, args); err != nil {
+		return nil, err
+	}
+
+	var order []dryRunKey
+	seen := map[dryRunKey]bool{}
+	for _, action := range dryClient.Actions() {
+		var name string
+		switch a := action.(type) {
+		case k8stesting.CreateAction:
+			obj, err := meta.Accessor(a.GetObject())
+			if err != nil {
+				return nil, err
+			}
+			name = obj.GetName()
+		case k8stesting.PatchAction:
+			name = a.GetName()
+		case k8stesting.DeleteAction:
+			name = a.GetName()
+		default:
+			continue
+		}
+		if action.GetSubresource() != "" {
+			continue
+		}
+		key := dryRunKey{Resource: action.GetResource(), Namespace: action.GetNamespace(), Name: name}
+		if !seen[key] {
+			seen[key] = true
+			order = append(order, key)
+		}
+	}
+	changes := make([]dryRunChange, 0, len(order))
+	for _, key := range order {
+		var change dryRunChange
+		var err error
+		if obj, ok := live[key]; ok {
+			if change.Live, err = objectMap(obj); err != nil {
+				return nil, err
+			}
+		}
+		tapped, err := dryClient.Tracker().Get(key.Resource, key.Namespace, key.Name)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+		if err == nil {
+			if change.Tapped, err = objectMap(tapped); err != nil {
+				return nil, err
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// dryRunKeyOf returns the key of a typed object.
+func dryRunKeyOf(obj runtime.Object) (dryRunKey, error) {
+	gvks, _, err := scheme.Scheme.ObjectKinds(obj)
+	if err != nil {
+		return dryRunKey{}, err
+	}
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return dryRunKey{}, err
+	}
+	resource, _ := meta.UnsafeGuessKindToResource(gvks[0])
+	return dryRunKey{Resource: resource, Namespace: accessor.GetNamespace(), Name: accessor.GetName()}, nil
+}
+
+// objectMap converts a typed object to its generic form, including its kind.
+func objectMap(obj runtime.Object) (map[string]interface{}, error) {
+	gvks, _, err := scheme.Scheme.ObjectKinds(obj)
+	if err != nil {
+		return nil, err
+	}
+	obj = obj.DeepCopyObject()
+	obj.GetObjectKind().SetGroupVersionKind(gvks[0])
+	return runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+}
+
+// serverDryRun taps with every write sent as a dry run, and returns the
+// objects as the API server would have persisted them. Each write is checked
+// against the unchanged cluster, so only the last write to an object counts.
+func serverDryRun(ctx context.Context, config *rest.Config, viper *viper.Viper, args []string) ([]dryRunChange, error) {
+	rec := &dryRunRecorder{}
+	cfg := rest.CopyConfig(config)
+	// the recorded responses are decoded as JSON
+	cfg.ContentType = runtime.ContentTypeJSON
+	cfg.AcceptContentTypes = runtime.ContentTypeJSON
+	cfg.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return &dryRunTransport{next: rt, rec: rec}
+	})
+	dryClient, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := dryRunTap(ctx, dryClient, cfg, viper, args); err != nil {
+		return nil, err
+	}
+
+	changes := make([]dryRunChange, 0, len(rec.order))
+	for _, path := range rec.order {
+		change := dryRunChange{Tapped: rec.tapped[path]}
+		body, err := dryClient.CoreV1().RESTClient().Get().AbsPath(path).DoRaw(ctx)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(body, &change.Live); err != nil {
+				return nil, err
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// dryRunRecorder collects the objects returned for dry-run writes, keyed by
+// the path of the object.
+type dryRunRecorder struct {
+	mu     sync.Mutex
+	order  []string
+	tapped map[string]map[string]interface{}
+}
+
+// record stores the response to a write to path. Creates are posted to the
+// collection, their object path is completed with the name of the object.
+func (r *dryRunRecorder) record(method, path string, body []byte) error {
+	var obj map[string]interface{}
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return err
+	}
+	if method == http.MethodPost {
+		name := unstructuredName(obj)
+		if name == "" {
+			return nil
+		}
+		path += "/" + name
+	}
+	if method == http.MethodDelete {
+		obj = nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tapped == nil {
+		r.tapped = map[string]map[string]interface{}{}
+	}
+	if _, ok := r.tapped[path]; !ok {
+		r.order = append(r.order, path)
+	}
+	r.tapped[path] = obj
+	return nil
+}
+
+// unstructuredName returns the name in the metadata of a generic object.
+func unstructuredName(obj map[string]interface{}) string {
+	md, _ := obj["metadata"].(map[string]interface{})
+	name, _ := md["name"].(string)
+	return name
+}
+
+// dryRunTransport sends every write as a dry run and records the objects the
+// API server returns for them.
+type dryRunTransport struct {
+	next http.RoundTripper
+	rec  *dryRunRecorder
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *dryRunTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return t.next.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	q := req.URL.Query()
+	q.Set("dryRun", metav1.DryRunAll)
+	req.URL.RawQuery = q.Encode()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode >= http.StatusMultipleChoices {
+		return resp, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err := t.rec.record(req.Method, req.URL.Path, body); err != nil {
+		return nil, fmt.Errorf("error recording dry run of %s %s: %w", req.Method, req.URL.Path, err)
+	}
+	return resp, nil
+}
+
+// printDryRun writes the tapped objects as YAML documents, or as a unified
+// diff against the live objects.
+func printDryRun(out io.Writer, changes []dryRunChange, output string) error {
+	if len(changes) == 0 {
+		_, _ = fmt.Fprintln(out, "No changes")
+		return nil
+	}
+	for _, c := range changes {
+		live, err := dryRunYAML(c.Live)
+		if err != nil {
+			return err
+		}
+		tapped, err := dryRunYAML(c.Tapped)
+		if err != nil {
+			return err
+		}
+		if output == outputYAML {
+			if c.Tapped == nil {
+				_, _ = fmt.Fprintf(out, "---\n# deleted: %s\n", dryRunName(c))
+				continue
+			}
+			_, _ = fmt.Fprintf(out, "---\n%s", tapped)
+			continue
+		}
+		// created and deleted objects are shown like created and deleted files
+		from, to := "live/"+dryRunName(c), "tapped/"+dryRunName(c)
+		if c.Live == nil {
+			from = "/dev/null"
+		}
+		if c.Tapped == nil {
+			to = "/dev/null"
+		}
+		diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        difflib.SplitLines(live),
+			B:        difflib.SplitLines(tapped),
+			FromFile: from,
+			ToFile:   to,
+			Context:  3,
+		})
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprint(out, diff)
+	}
+	return nil
+}
+
+// dryRunName names the object of a change as kind/namespace/name.
+func dryRunName(c dryRunChange) string {
+	obj := c.Tapped
+	if obj == nil {
+		obj = c.Live
+	}
+	md, _ := obj["metadata"].(map[string]interface{})
+	kind, _ := obj["kind"].(string)
+	namespace, _ := md["namespace"].(string)
+	name, _ := md["name"].(string)
+	return kind + "/" + namespace + "/" + name
+}
+
+// dryRunYAML renders an object without the fields maintained by the API
+// server, which would only add noise to the diff.
+func dryRunYAML(obj map[string]interface{}) (string, error) {
+	if obj == nil {
+		return "", nil
+	}
+	obj = runtime.DeepCopyJSON(obj)
+	delete(obj, "status")
+	if md, ok := obj["metadata"].(map[string]interface{}); ok {
+		for _, k := range []string{"managedFields", "resourceVersion", "uid", "generation", "creationTimestamp", "selfLink"} {
+			delete(md, k)
+		}
+	}
+	b, err := yaml.Marshal(obj)
+	return string(b), err
+}
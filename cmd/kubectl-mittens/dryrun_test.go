@@ -0,0 +1,118 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+func Test_DryRunTap(t *testing.T) {
+	tests := []struct {
+		Name     string
+		DryRun   string
+		Output   string
+		Strategy string
+		Err      error
+		Contains []string
+	}{
+		{"diff", dryRunClient, "", "", nil, []string{
+			"--- live/Service/default/sample-service\n+++ tapped/Service/default/sample-service",
+			"+    targetPort: 7777",
+			"+    mittens.io/original-port: \"8080\"",
+			"+++ tapped/Deployment/default/sample-deployment",
+			"+        name: mittens\n",
+			"--- /dev/null\n+++ tapped/ConfigMap/default/mittens-target-sample-deployment",
+		}},
+		{"yaml", dryRunClient, outputYAML, "", nil, []string{
+			"---\napiVersion: v1\nkind: Service",
+			"kind: Deployment",
+			"name: " + snapshotPrefix + "sample-service",
+		}},
+		{"standalone", dryRunClient, outputDiff, strategyStandalone, nil, []string{
+			"+++ tapped/Deployment/default/" + standaloneProxyPrefix + "sample-service",
+			"+++ tapped/Service/default/" + standaloneShadowPrefix + "sample-service",
+		}},
+		{"unknown_mode", "always", "", "", ErrDryRunNotSupported, nil},
+		{"unknown_output", dryRunClient, "json", "", ErrDryRunOutputNotSupported, nil},
+		{"output_without_dry_run", "", outputYAML, "", ErrOutputWithoutDryRun, nil},
+		{"ephemeral", dryRunServer, "", strategyEphemeral, ErrStrategyNotSupported, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			fakeClient := fakeClientUntappedSimple()
+			testViper := viper.New()
+			testViper.Set("proxyPort", 80)
+			testViper.Set("namespace", "default")
+			testViper.Set("proxyImage", defaultImageHTTP)
+			testViper.Set("commandArgs", defaultCommandArgs)
+			testViper.Set("dryRun", tc.DryRun)
+			testViper.Set("output", tc.Output)
+			testViper.Set("strategy", tc.Strategy)
+			b := bytes.NewBufferString("")
+			cmd := &cobra.Command{}
+			cmd.SetOutput(b)
+			err := NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+			if tc.Err != nil {
+				require.True(errors.Is(err, tc.Err), "got %v", err)
+				return
+			}
+			require.Nil(err)
+			for _, s := range tc.Contains {
+				require.Contains(b.String(), s)
+			}
+			for _, action := range fakeClient.Actions() {
+				require.Contains([]string{"get", "list"}, action.GetVerb(), "a dry run must not write to the cluster")
+			}
+			require.Equal(tc.DryRun, testViper.GetString("dryRun"))
+		})
+	}
+}
+
+func Test_DryRunTransport(t *testing.T) {
+	require := require.New(t)
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.Method+" "+r.URL.RawQuery)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"kind":"ConfigMap","apiVersion":"v1","metadata":{"name":"cm","namespace":"default"}}`)
+	}))
+	defer srv.Close()
+
+	rec := &dryRunRecorder{}
+	client := &http.Client{Transport: &dryRunTransport{next: http.DefaultTransport, rec: rec}}
+	resp, err := client.Post(srv.URL+"/api/v1/namespaces/default/configmaps", "application/json", bytes.NewBufferString("{}"))
+	require.Nil(err)
+	body, err := io.ReadAll(resp.Body)
+	require.Nil(err)
+	require.Contains(string(body), `"name":"cm"`, "the response is passed on")
+	resp, err = client.Get(srv.URL + "/api/v1/namespaces/default/configmaps/cm")
+	require.Nil(err)
+	_ = resp.Body.Close()
+
+	require.Equal([]string{"POST dryRun=" + metav1.DryRunAll, "GET "}, queries)
+	require.Equal([]string{"/api/v1/namespaces/default/configmaps/cm"}, rec.order)
+	require.Equal("ConfigMap", rec.tapped[rec.order[0]]["kind"])
+}
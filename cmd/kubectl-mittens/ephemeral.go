@@ -0,0 +1,357 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	watchtools "k8s.io/client-go/tools/watch"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// strategyTemplate adds the proxy to the pod template, rolling the workload.
+	strategyTemplate = "template"
+	// strategyEphemeral injects the proxy into the running Pods as an ephemeral container.
+	strategyEphemeral = "ephemeral"
+
+	// labelEphemeral marks the Pods running an ephemeral proxy. The tapped
+	// Service only selects them, so Pods created later are not sent traffic
+	// for a proxy they do not run.
+	labelEphemeral = "mittens.io/ephemeral-proxy"
+)
+
+var (
+	// ErrStrategyNotSupported occurs when an unknown tap strategy is requested.
+	ErrStrategyNotSupported = errors.New("strategy not supported, use one of [ template, ephemeral, standalone ]")
+	// ErrEphemeralUnavailable occurs when the proxy cannot be injected as an
+	// ephemeral container, the tap falls back to patching the pod template.
+	ErrEphemeralUnavailable = errors.New("ephemeral containers are not available")
+
+	// ephemeralStopCommand stops the entrypoint of an ephemeral proxy. Ephemeral
+	// containers cannot be removed from a Pod, so they are stopped on untap.
+	ephemeralStopCommand = []string{"sh", "-c", `kill -TERM "$(cat /tmp/mittens.pid)"`}
+)
+
+// tapEphemeral injects sidecar as an ephemeral container into every running
+// Pod the Service selectors match and waits up to timeout for it to start.
+// Errors wrapping ErrEphemeralUnavailable mean the pod template can be
+// patched instead, they only occur before any Pod was changed.
+func tapEphemeral(ctx context.Context, client kubernetes.Interface, workload Workload, selectors map[string]string, sidecar v1.Container, timeout time.Duration) error {
+	namespace := workload.Namespace()
+	podsClient := client.CoreV1().Pods(namespace)
+	pods, err := podsClient.List(ctx, metav1.ListOptions{LabelSelector: labels.SelectorFromSet(selectors).String()})
+	if err != nil {
+		return fmt.Errorf("error listing Pods: %w", err)
+	}
+	var running []v1.Pod
+	for _, pod := range pods.Items {
+		switch {
+		case pod.DeletionTimestamp != nil, pod.Status.Phase == v1.PodSucceeded, pod.Status.Phase == v1.PodFailed:
+			// never serves traffic again
+		case pod.Status.Phase == v1.PodRunning:
+			running = append(running, pod)
+		default:
+			// it would start without the proxy
+			return fmt.Errorf("%w: Pod %q is %s", ErrEphemeralUnavailable, pod.Name, strings.ToLower(string(pod.Status.Phase)))
+		}
+	}
+	if len(running) == 0 {
+		return fmt.Errorf("%w: %s %q has no running Pods", ErrEphemeralUnavailable, workload.Kind(), workload.Name())
+	}
+
+	ec, err := ephemeralSidecar(ctx, client, namespace, sidecar)
+	if err != nil {
+		return err
+	}
+	var injected []string
+	for _, pod := range running {
+		var name string
+		retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			p, err := podsClient.Get(ctx, pod.Name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			orig, err := json.Marshal(p)
+			if err != nil {
+				return err
+			}
+			name = ephemeralSidecarName(*p)
+			c := ec
+			c.Name = name
+			p.Spec.EphemeralContainers = append(p.Spec.EphemeralContainers, c)
+			mod, err := json.Marshal(p)
+			if err != nil {
+				return err
+			}
+			// the same patch kubectl debug sends, keeping the existing ephemeral containers in order
+			patch, err := strategicpatch.CreateTwoWayMergePatch(orig, mod, v1.Pod{})
+			if err != nil {
+				return err
+			}
+			_, err = podsClient.Patch(ctx, p.Name, types.StrategicMergePatchType, patch, patchOptions, "ephemeralcontainers")
+			return err
+		})
+		// once a Pod was injected, the tap is reverted instead
+		if len(injected) == 0 && (apierrors.IsNotFound(retryErr) || apierrors.IsMethodNotSupported(retryErr) || apierrors.IsForbidden(retryErr)) {
+			return fmt.Errorf("%w: %w", ErrEphemeralUnavailable, retryErr)
+		}
+		if retryErr != nil {
+			return fmt.Errorf("error adding ephemeral container to Pod %q: %w", pod.Name, retryErr)
+		}
+		// the annotations let mittensPod find the Pod and the container in it,
+		// the label lets the Service select it
+		patch, err := metadataMergePatch(map[string]interface{}{
+			annotationIsTapped: workload.Name(),
+			annotationSidecar:  name,
+		}, map[string]interface{}{labelEphemeral: "true"})
+		if err != nil {
+			return err
+		}
+		if _, retryErr = podsClient.Patch(ctx, pod.Name, types.MergePatchType, patch, patchOptions); retryErr != nil {
+			return fmt.Errorf("error annotating Pod %q: %w", pod.Name, retryErr)
+		}
+		injected = append(injected, pod.Name)
+	}
+	return waitForEphemeralSidecars(ctx, client, namespace, injected, timeout)
+}
+
+// ephemeralSidecar converts a sidecar into an ephemeral container. Ephemeral
+// containers cannot declare ports, probes or resources, nor mount volumes the
+// Pod does not have, so the proxy config is passed in the environment instead.
+func ephemeralSidecar(ctx context.Context, client kubernetes.Interface, namespace string, sidecar v1.Container) (v1.EphemeralContainer, error) {
+	for _, m := range sidecar.VolumeMounts {
+		if !strings.HasPrefix(m.Name, mittensConfigMapPrefix) {
+			continue
+		}
+		cm, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, m.Name, metav1.GetOptions{})
+		if err != nil {
+			return v1.EphemeralContainer{}, fmt.Errorf("error reading the proxy config: %w", err)
+		}
+		if len(cm.BinaryData) > 1 {
+			return v1.EphemeralContainer{}, fmt.Errorf("%w: descriptor files need a ConfigMap volume", ErrEphemeralUnavailable)
+		}
+		sidecar.Env = append(sidecar.Env, v1.EnvVar{
+			Name:  "MITTENS_CONFIG",
+			Value: string(cm.BinaryData[mitmproxyConfigFile]),
+		})
+	}
+	return v1.EphemeralContainer{
+		EphemeralContainerCommon: v1.EphemeralContainerCommon{
+			Name:            sidecar.Name,
+			Image:           sidecar.Image,
+			Args:            sidecar.Args,
+			Env:             sidecar.Env,
+			ImagePullPolicy: sidecar.ImagePullPolicy,
+		},
+	}, nil
+}
+
+// ephemeralSidecarName returns a container name for the proxy that is not
+// taken in pod, as ephemeral containers of earlier taps stay in the Pod spec.
+func ephemeralSidecarName(pod v1.Pod) string {
+	taken := map[string]bool{}
+	for _, c := range pod.Spec.Containers {
+		taken[c.Name] = true
+	}
+	for _, c := range pod.Spec.EphemeralContainers {
+		taken[c.Name] = true
+	}
+	name := mittensContainerName
+	for i := 1; taken[name]; i++ {
+		name = mittensContainerName + "-" + strconv.Itoa(i)
+	}
+	return name
+}
+
+// waitForEphemeralSidecars watches the named Pods until their ephemeral
+// proxies are running so the Service is not pointed at a closed port. A proxy
+// that cannot start fails the wait right away, a zero timeout waits forever.
+func waitForEphemeralSidecars(ctx context.Context, client kubernetes.Interface, namespace string, podNames []string, timeout time.Duration) error {
+	pending := map[string]bool{}
+	for _, name := range podNames {
+		pending[name] = true
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, timeout, fmt.Errorf("%w: the ephemeral containers did not start within %s", ErrMittensPodTimeout, timeout))
+		defer cancel()
+	}
+	_, err := watchtools.UntilWithSync(ctx, podListWatch(client, namespace, ""), &v1.Pod{}, nil, func(e watch.Event) (bool, error) {
+		pod, ok := e.Object.(*v1.Pod)
+		if !ok || !pending[pod.Name] {
+			return false, nil
+		}
+		if e.Type == watch.Deleted {
+			return false, fmt.Errorf("Pod %q was deleted while the proxy was starting", pod.Name)
+		}
+		if sidecarReady(*pod) {
+			delete(pending, pod.Name)
+			return len(pending) == 0, nil
+		}
+		if failure := podFailure(pod); failure != "" {
+			return false, fmt.Errorf("%w: Pod %q: %s", ErrMittensPodFailed, pod.Name, failure)
+		}
+		return false, nil
+	})
+	if err != nil && ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return err
+}
+
+// untapEphemeral stops the ephemeral proxies in the Pods of a workload and
+// removes the annotations marking them as tapped.
+func untapEphemeral(ctx context.Context, client kubernetes.Interface, config *rest.Config, namespace, workloadName string) error {
+	pods, err := ephemeralTappedPods(ctx, client, namespace)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, pod := range pods {
+		if pod.GetAnnotations()[annotationIsTapped] != workloadName {
+			continue
+		}
+		if err := untapEphemeralPod(ctx, client, config, pod); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ephemeralTappedPods lists the Pods carrying an ephemeral proxy in a
+// namespace, or in all namespaces if namespace is empty.
+func ephemeralTappedPods(ctx context.Context, client kubernetes.Interface, namespace string) ([]v1.Pod, error) {
+	pods, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing Pods: %w", err)
+	}
+	var tapped []v1.Pod
+	for _, pod := range pods.Items {
+		if pod.GetAnnotations()[annotationSidecar] != "" {
+			tapped = append(tapped, pod)
+		}
+	}
+	return tapped, nil
+}
+
+// untapEphemeralPod stops the ephemeral proxy of a Pod and removes the
+// annotations marking it as tapped.
+func untapEphemeralPod(ctx context.Context, client kubernetes.Interface, config *rest.Config, pod v1.Pod) error {
+	if err := stopEphemeralSidecar(ctx, client, config, pod); err != nil {
+		return err
+	}
+	patch, err := metadataMergePatch(map[string]interface{}{
+		annotationIsTapped: nil,
+		annotationSidecar:  nil,
+	}, map[string]interface{}{labelEphemeral: nil})
+	if err != nil {
+		return err
+	}
+	_, err = client.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.MergePatchType, patch, patchOptions)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error removing annotations from Pod %q: %w", pod.Name, err)
+	}
+	return nil
+}
+
+// ephemeralSelector returns the selector of a Service tapped with ephemeral
+// proxies, which only matches the Pods running one.
+func ephemeralSelector(selector map[string]string) map[string]string {
+	s := map[string]string{labelEphemeral: "true"}
+	for k, v := range selector {
+		s[k] = v
+	}
+	return s
+}
+
+// stopEphemeralSidecar stops the ephemeral proxy of a Pod if it is still running.
+func stopEphemeralSidecar(ctx context.Context, client kubernetes.Interface, config *rest.Config, pod v1.Pod) error {
+	if !sidecarReady(pod) {
+		return nil
+	}
+	err := execInSidecar(ctx, client, config, pod, ephemeralStopCommand, remotecommand.StreamOptions{
+		Stdout: io.Discard,
+		Stderr: io.Discard,
+	})
+	if err != nil {
+		return fmt.Errorf("error stopping the ephemeral container in Pod %q: %w", pod.Name, err)
+	}
+	return nil
+}
+
+// sidecarName returns the name of the proxy container in a tapped Pod.
+func sidecarName(pod v1.Pod) string {
+	if name := pod.GetAnnotations()[annotationSidecar]; name != "" {
+		return name
+	}
+	return mittensContainerName
+}
+
+// sidecarEnv returns the environment of the proxy container in a tapped Pod.
+func sidecarEnv(pod v1.Pod) ([]v1.EnvVar, bool) {
+	name := sidecarName(pod)
+	for _, c := range pod.Spec.Containers {
+		if c.Name == name {
+			return c.Env, true
+		}
+	}
+	for _, c := range pod.Spec.EphemeralContainers {
+		if c.Name == name {
+			return c.Env, true
+		}
+	}
+	return nil, false
+}
+
+// sidecarImage returns the image of the proxy container in a tapped Pod.
+func sidecarImage(pod v1.Pod) string {
+	name := sidecarName(pod)
+	for _, c := range pod.Spec.Containers {
+		if c.Name == name {
+			return c.Image
+		}
+	}
+	for _, c := range pod.Spec.EphemeralContainers {
+		if c.Name == name {
+			return c.Image
+		}
+	}
+	return ""
+}
+
+// tappedStrategy returns the strategy a Service was tapped with.
+func tappedStrategy(svc *v1.Service) string {
+	if s := svc.GetAnnotations()[annotationStrategy]; s != "" {
+		return s
+	}
+	return strategyTemplate
+}
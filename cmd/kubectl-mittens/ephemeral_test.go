@@ -0,0 +1,285 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func Test_TapEphemeral(t *testing.T) {
+	tests := []struct {
+		Name      string
+		Client    func() *fake.Clientset
+		Strategy  string
+		Sidecar   string
+		Ephemeral bool
+		Err       error
+	}{
+		{"running_pod", fakeClientUntappedWithRunningPod, strategyEphemeral, mittensContainerName, true, nil},
+		{"earlier_tap", fakeClientUntappedWithEarlierEphemeralTap, strategyEphemeral, mittensContainerName + "-1", true, nil},
+		{"fallback_no_pods", fakeClientUntappedSimple, strategyEphemeral, "", false, nil},
+		{"fallback_pending_pod", fakeClientUntappedWithPendingPod, strategyEphemeral, "", false, nil},
+		{"fallback_forbidden", fakeClientEphemeralForbidden, strategyEphemeral, "", false, nil},
+		{"unknown_strategy", fakeClientUntappedWithRunningPod, "sideways", "", false, ErrStrategyNotSupported},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			fakeClient := tc.Client()
+			testViper := viper.New()
+			testViper.Set("proxyPort", 80)
+			testViper.Set("namespace", "default")
+			testViper.Set("strategy", tc.Strategy)
+			testViper.Set("proxyImage", defaultImageHTTP)
+			testViper.Set("commandArgs", defaultCommandArgs)
+			cmd := &cobra.Command{}
+			cmd.SetOutput(ioutil.Discard)
+			err := NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+			if tc.Err != nil {
+				require.True(errors.Is(err, tc.Err), "expected (%v), got (%v)", tc.Err, err)
+				return
+			}
+			require.Nil(err)
+
+			dpl, err := fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "sample-deployment", metav1.GetOptions{})
+			require.Nil(err)
+			svc, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+			require.Nil(err)
+			require.Equal(int32(mittensProxyListenPort), svc.Spec.Ports[0].TargetPort.IntVal)
+			if !tc.Ephemeral {
+				// the pod template was patched instead
+				require.Len(dpl.Spec.Template.Spec.Containers, 2)
+				require.Equal(strategyTemplate, tappedStrategy(svc))
+				return
+			}
+			require.Len(dpl.Spec.Template.Spec.Containers, 1, "the pod template must not change")
+			require.Equal(strategyEphemeral, tappedStrategy(svc))
+			require.Equal(map[string]string{"app": "myapp", labelEphemeral: "true"}, svc.Spec.Selector, "only Pods running the proxy are selected")
+
+			pod, err := fakeClient.CoreV1().Pods("default").Get(context.TODO(), "sample-pod", metav1.GetOptions{})
+			require.Nil(err)
+			require.Equal("sample-deployment", pod.GetAnnotations()[annotationIsTapped])
+			require.Equal("true", pod.GetLabels()[labelEphemeral])
+			require.Equal(tc.Sidecar, sidecarName(*pod))
+			ec := pod.Spec.EphemeralContainers[len(pod.Spec.EphemeralContainers)-1]
+			require.Equal(tc.Sidecar, ec.Name)
+			require.Equal(defaultImageHTTP, ec.Image)
+			require.Empty(ec.Ports)
+			require.Nil(ec.ReadinessProbe)
+			require.Empty(ec.VolumeMounts)
+			env, ok := sidecarEnv(*pod)
+			require.True(ok)
+			require.Equal("MITTENS_CONFIG", env[0].Name)
+			require.Contains(env[0].Value, "reverse:http://127.0.0.1:8080")
+
+			// the proxy exited, untap restores the Service and the Pod annotations
+			pod.Status.EphemeralContainerStatuses = nil
+			_, err = fakeClient.CoreV1().Pods("default").UpdateStatus(context.TODO(), pod, metav1.UpdateOptions{})
+			require.Nil(err)
+			require.Nil(NewUntapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+			svc, err = fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+			require.Nil(err)
+			require.Equal(int32(8080), svc.Spec.Ports[0].TargetPort.IntVal)
+			require.Equal(simpleService.Spec.Selector, svc.Spec.Selector)
+			require.NotContains(svc.GetAnnotations(), annotationStrategy)
+			pod, err = fakeClient.CoreV1().Pods("default").Get(context.TODO(), "sample-pod", metav1.GetOptions{})
+			require.Nil(err)
+			require.NotContains(pod.GetAnnotations(), annotationIsTapped)
+			require.NotContains(pod.GetAnnotations(), annotationSidecar)
+			require.NotContains(pod.GetLabels(), labelEphemeral)
+		})
+	}
+}
+
+func Test_TapEphemeralPodCreatedLater(t *testing.T) {
+	require := require.New(t)
+	fakeClient := fakeClientUntappedWithRunningPod()
+	testViper := viper.New()
+	testViper.Set("proxyPort", 80)
+	testViper.Set("namespace", "default")
+	testViper.Set("strategy", strategyEphemeral)
+	testViper.Set("proxyImage", defaultImageHTTP)
+	testViper.Set("commandArgs", defaultCommandArgs)
+	cmd := &cobra.Command{}
+	cmd.SetOutput(ioutil.Discard)
+	require.Nil(NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+
+	// e.g. a scale up or a replaced Pod, started without the proxy
+	later := runningPod(mittensContainerName)
+	later.Name = "sample-pod-later"
+	later.Status.EphemeralContainerStatuses = nil
+	_, err := fakeClient.CoreV1().Pods("default").Create(context.TODO(), later, metav1.CreateOptions{})
+	require.Nil(err)
+
+	svc, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+	require.Nil(err)
+	require.Equal(int32(mittensProxyListenPort), svc.Spec.Ports[0].TargetPort.IntVal)
+	selector := labels.SelectorFromSet(svc.Spec.Selector)
+	pod, err := fakeClient.CoreV1().Pods("default").Get(context.TODO(), "sample-pod", metav1.GetOptions{})
+	require.Nil(err)
+	require.True(selector.Matches(labels.Set(pod.Labels)), "the tapped Pod must receive the traffic")
+	require.False(selector.Matches(labels.Set(later.Labels)), "a Pod without the proxy must not be sent traffic for port %d", mittensProxyListenPort)
+}
+
+func Test_TapEphemeralPartialFailure(t *testing.T) {
+	require := require.New(t)
+	fakeClient := fakeClientEphemeralForbiddenAfterFirst()
+	testViper := viper.New()
+	testViper.Set("proxyPort", 80)
+	testViper.Set("namespace", "default")
+	testViper.Set("strategy", strategyEphemeral)
+	testViper.Set("proxyImage", defaultImageHTTP)
+	testViper.Set("commandArgs", defaultCommandArgs)
+	cmd := &cobra.Command{}
+	cmd.SetOutput(ioutil.Discard)
+	err := NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+	require.NotNil(err, "a Pod was injected, the tap must not fall back to the pod template")
+	require.False(errors.Is(err, ErrEphemeralUnavailable))
+
+	dpl, err := fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "sample-deployment", metav1.GetOptions{})
+	require.Nil(err)
+	require.Len(dpl.Spec.Template.Spec.Containers, 1)
+	svc, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+	require.Nil(err)
+	require.Equal(int32(8080), svc.Spec.Ports[0].TargetPort.IntVal)
+	pods, err := fakeClient.CoreV1().Pods("default").List(context.TODO(), metav1.ListOptions{})
+	require.Nil(err)
+	for _, pod := range pods.Items {
+		require.NotContains(pod.GetAnnotations(), annotationIsTapped, "the injected Pod %q was not reverted", pod.Name)
+		require.NotContains(pod.GetLabels(), labelEphemeral)
+	}
+}
+
+func Test_EphemeralSidecarName(t *testing.T) {
+	tests := []struct {
+		Name      string
+		Ephemeral []string
+		Expected  string
+	}{
+		{"first", nil, "mittens"},
+		{"second", []string{"mittens"}, "mittens-1"},
+		{"third", []string{"debugger", "mittens", "mittens-1"}, "mittens-2"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			var pod v1.Pod
+			for _, name := range tc.Ephemeral {
+				pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, v1.EphemeralContainer{
+					EphemeralContainerCommon: v1.EphemeralContainerCommon{Name: name},
+				})
+			}
+			require.Equal(t, tc.Expected, ephemeralSidecarName(pod))
+		})
+	}
+}
+
+// runningPod is a Pod of the simple Deployment. The kubelet is simulated by
+// reporting the ephemeral container named sidecar as running.
+func runningPod(sidecar string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "sample-pod",
+			Namespace: "default",
+			Labels: map[string]string{
+				"app": "myapp",
+			},
+		},
+		Spec: *simpleDeployment.Spec.Template.Spec.DeepCopy(),
+		Status: v1.PodStatus{
+			Phase: v1.PodRunning,
+			EphemeralContainerStatuses: []v1.ContainerStatus{
+				{
+					Name:  sidecar,
+					State: v1.ContainerState{Running: &v1.ContainerStateRunning{}},
+				},
+			},
+		},
+	}
+}
+
+func fakeClientUntappedWithRunningPod() *fake.Clientset {
+	client := fakeClientUntappedSimple()
+	_ = client.Tracker().Add(runningPod(mittensContainerName))
+	return client
+}
+
+func fakeClientUntappedWithEarlierEphemeralTap() *fake.Clientset {
+	client := fakeClientUntappedSimple()
+	pod := runningPod(mittensContainerName + "-1")
+	pod.Spec.EphemeralContainers = []v1.EphemeralContainer{
+		{EphemeralContainerCommon: v1.EphemeralContainerCommon{Name: mittensContainerName}},
+	}
+	_ = client.Tracker().Add(pod)
+	return client
+}
+
+func fakeClientUntappedWithPendingPod() *fake.Clientset {
+	client := fakeClientUntappedWithRunningPod()
+	pod := runningPod(mittensContainerName)
+	pod.Name = "sample-pod-pending"
+	pod.Status = v1.PodStatus{Phase: v1.PodPending}
+	_ = client.Tracker().Add(pod)
+	return client
+}
+
+// fakeClientEphemeralForbiddenAfterFirst allows the ephemeral container in
+// the first of two Pods only. The kubelet does not report the proxy of the
+// first as running, so reverting it needs no exec.
+func fakeClientEphemeralForbiddenAfterFirst() *fake.Clientset {
+	client := fakeClientUntappedSimple()
+	for _, name := range []string{"sample-pod-a", "sample-pod-b"} {
+		pod := runningPod("other")
+		pod.Name = name
+		_ = client.Tracker().Add(pod)
+	}
+	patched := 0
+	client.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "ephemeralcontainers" {
+			return false, nil, nil
+		}
+		patched++
+		if patched == 1 {
+			return false, nil, nil
+		}
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "pods/ephemeralcontainers"}, "sample-pod-b", errors.New("denied"))
+	})
+	return client
+}
+
+func fakeClientEphemeralForbidden() *fake.Clientset {
+	client := fakeClientUntappedWithRunningPod()
+	client.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "ephemeralcontainers" {
+			return false, nil, nil
+		}
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "pods/ephemeralcontainers"}, "sample-pod", errors.New("denied"))
+	})
+	return client
+}
@@ -0,0 +1,153 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/term"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+// execInSidecar runs command in the proxy container of a Pod, streaming
+// according to opts. It prefers WebSockets and falls back to SPDY for API
+// servers that do not support them yet.
+func execInSidecar(ctx context.Context, client kubernetes.Interface, config *rest.Config, pod v1.Pod, command []string, opts remotecommand.StreamOptions) error {
+	req := client.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(pod.Namespace).
+		Name(pod.Name).
+		SubResource("exec").
+		VersionedParams(&v1.PodExecOptions{
+			Container: sidecarName(pod),
+			Command:   command,
+			Stdin:     opts.Stdin != nil,
+			Stdout:    opts.Stdout != nil,
+			Stderr:    opts.Stderr != nil,
+			TTY:       opts.Tty,
+		}, scheme.ParameterCodec)
+
+	spdyExec, err := remotecommand.NewSPDYExecutor(config, "POST", req.URL())
+	if err != nil {
+		return err
+	}
+	wsExec, err := remotecommand.NewWebSocketExecutor(config, "GET", req.URL().String())
+	if err != nil {
+		return err
+	}
+	executor, err := remotecommand.NewFallbackExecutor(wsExec, spdyExec, func(err error) bool {
+		return httpstream.IsUpgradeFailure(err) || httpstream.IsHTTPSProxyError(err)
+	})
+	if err != nil {
+		return err
+	}
+	return executor.StreamWithContext(ctx, opts)
+}
+
+// attachTerminal runs command in the proxy container with the local terminal
+// attached in raw mode, forwarding resize events for the duration of the session.
+func attachTerminal(ctx context.Context, client kubernetes.Interface, config *rest.Config, pod v1.Pod, command []string) error {
+	inFd := int(os.Stdin.Fd())
+	outFd := int(os.Stdout.Fd())
+	if !term.IsTerminal(inFd) || !term.IsTerminal(outFd) {
+		return ErrAttachNotTerminal
+	}
+	state, err := term.MakeRaw(inFd)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = term.Restore(inFd, state)
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sizeQueue := newTerminalSizeQueue(ctx, outFd)
+	// a TTY merges stderr into stdout
+	return execInSidecar(ctx, client, config, pod, command, remotecommand.StreamOptions{
+		Stdin:             os.Stdin,
+		Stdout:            os.Stdout,
+		Tty:               true,
+		TerminalSizeQueue: sizeQueue,
+	})
+}
+
+// sessionRunning reports whether the interactive session in the proxy
+// container is still running. ok is false when this could not be determined,
+// e.g. because the connection to the cluster was lost.
+func sessionRunning(ctx context.Context, client kubernetes.Interface, config *rest.Config, pod v1.Pod, proxy Tap) (running, ok bool) {
+	err := execInSidecar(ctx, client, config, pod, proxy.SessionCommand(), remotecommand.StreamOptions{
+		Stdout: io.Discard,
+		Stderr: io.Discard,
+	})
+	if err == nil {
+		return true, true
+	}
+	var exitErr utilexec.ExitError
+	if errors.As(err, &exitErr) && exitErr.Exited() {
+		return false, true
+	}
+	return false, false
+}
+
+// terminalSizeQueue reports the size of the local terminal whenever it changes.
+type terminalSizeQueue struct {
+	fd      int
+	resized chan struct{}
+	ctx     context.Context
+	last    *remotecommand.TerminalSize
+}
+
+func newTerminalSizeQueue(ctx context.Context, fd int) *terminalSizeQueue {
+	q := &terminalSizeQueue{
+		fd:      fd,
+		resized: make(chan struct{}, 1),
+		ctx:     ctx,
+	}
+	// report the initial size right away
+	q.resized <- struct{}{}
+	go notifyResize(ctx, q.resized)
+	return q
+}
+
+// Next blocks until the terminal size changes and returns the new size, or
+// nil once the session is over.
+func (q *terminalSizeQueue) Next() *remotecommand.TerminalSize {
+	for {
+		select {
+		case <-q.ctx.Done():
+			return nil
+		case <-q.resized:
+		}
+		width, height, err := term.GetSize(q.fd)
+		if err != nil {
+			continue
+		}
+		size := &remotecommand.TerminalSize{Width: uint16(width), Height: uint16(height)} //nolint: gosec
+		changed := q.last == nil || *q.last != *size
+		q.last = size
+		if changed {
+			return size
+		}
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_TerminalSizeQueue(t *testing.T) {
+	require := require.New(t)
+	f, err := os.CreateTemp(t.TempDir(), "not-a-terminal")
+	require.Nil(err)
+	defer f.Close()
+
+	// sizes of a file cannot be read, Next keeps waiting until the session ends
+	ctx, cancel := context.WithCancel(context.Background())
+	q := newTerminalSizeQueue(ctx, int(f.Fd()))
+	done := make(chan struct{})
+	go func() {
+		require.Nil(q.Next())
+		close(done)
+	}()
+	time.AfterFunc(50*time.Millisecond, cancel)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Next did not return after the context was cancelled")
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// expiryWarning is how long before a tap expires the user is warned.
+const expiryWarning = time.Minute
+
+var (
+	// ErrInvalidDuration occurs when --duration is negative.
+	ErrInvalidDuration = errors.New("the tap duration must not be negative")
+	// ErrTapExpired is the cause of a session context cancelled because its tap expired.
+	ErrTapExpired = errors.New("the tap expired")
+)
+
+// tapExpiry returns when the tap of a Service expires, ok is false for taps
+// made without --duration.
+func tapExpiry(svc *v1.Service) (expiresAt time.Time, ok bool) {
+	s, ok := svc.GetAnnotations()[annotationExpiresAt]
+	if !ok {
+		return time.Time{}, false
+	}
+	expiresAt, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return expiresAt, true
+}
+
+// untilExpiry returns a context for the session of a tap that is cancelled
+// with ErrTapExpired once the tap expires, see tapExpired.
+func untilExpiry(ctx context.Context, expiresAt time.Time) (context.Context, context.CancelFunc) {
+	if expiresAt.IsZero() {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadlineCause(ctx, expiresAt, ErrTapExpired)
+}
+
+// tapExpired reports whether a session context was cancelled because its tap expired.
+func tapExpired(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), ErrTapExpired)
+}
+
+// untapExpired removes a tap whose time ran out during the session.
+func untapExpired(cmd *cobra.Command, client kubernetes.Interface, config *rest.Config, viper *viper.Viper, args []string) error {
+	_, _ = fmt.Fprintln(cmd.OutOrStdout(), "")
+	_, _ = fmt.Fprintln(cmd.OutOrStdout(), "The tap expired. Cleaning up litter...")
+	return NewUntapCommand(client, config, viper)(cmd, args)
+}
+
+// remaining formats the time left until a tap expires.
+func remaining(expiresAt, now time.Time) string {
+	left := expiresAt.Sub(now).Round(time.Second)
+	if left < 0 {
+		left = 0
+	}
+	return left.String()
+}
+
+// announceExpiry prints when the tap expires and calls warn once it is about
+// to, unless ctx is done first.
+func announceExpiry(ctx context.Context, out io.Writer, expiresAt time.Time, warn func(msg string)) {
+	if expiresAt.IsZero() {
+		return
+	}
+	_, _ = fmt.Fprintf(out, "The tap expires at %s, in %s.\n", expiresAt.Local().Format(time.Kitchen), remaining(expiresAt, time.Now()))
+	if warn == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Until(expiresAt.Add(-expiryWarning))):
+			warn(fmt.Sprintf("mittens: the tap expires in %s", remaining(expiresAt, time.Now())))
+		}
+	}()
+}
+
+// showExpiryInSession shows a countdown to the expiry of the tap in the
+// status line of the tmux session in the proxy container, and returns a
+// func displaying a message there.
+func showExpiryInSession(ctx context.Context, client kubernetes.Interface, config *rest.Config, pod v1.Pod, expiresAt time.Time) (notify func(msg string)) {
+	tmux := func(args ...string) {
+		_ = execInSidecar(ctx, client, config, pod, append([]string{"tmux"}, args...), remotecommand.StreamOptions{
+			Stdout: io.Discard,
+			Stderr: io.Discard,
+		})
+	}
+	// the status line is strftime expanded before the shell runs, hence %%
+	countdown := "#(t=$((" + strconv.FormatInt(expiresAt.Unix(), 10) + "-$(date +%%s))); [ $t -gt 0 ] || t=0; echo $((t/60))m$((t%%60))s)"
+	tmux("set-option", "status-interval", "1", ";", "set-option", "status-right", " "+detachKey+": detach | expires in "+countdown+" ")
+	return func(msg string) {
+		tmux("display-message", "-d", "10000", msg)
+	}
+}
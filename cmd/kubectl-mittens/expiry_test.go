@@ -0,0 +1,138 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+func Test_TapDuration(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Duration time.Duration
+		Err      error
+	}{
+		{"none", 0, nil},
+		{"fifteen_minutes", 15 * time.Minute, nil},
+		{"negative", -time.Minute, ErrInvalidDuration},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			fakeClient := fakeClientUntappedSimple()
+			testViper := viper.New()
+			testViper.Set("proxyPort", 80)
+			testViper.Set("namespace", "default")
+			testViper.Set("proxyImage", defaultImageHTTP)
+			testViper.Set("commandArgs", defaultCommandArgs)
+			testViper.Set("duration", tc.Duration)
+			cmd := &cobra.Command{}
+			cmd.SetOutput(ioutil.Discard)
+			before := time.Now().Truncate(time.Second)
+			err := NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+			if tc.Err != nil {
+				require.True(errors.Is(err, tc.Err), "got %v", err)
+				return
+			}
+			require.Nil(err)
+
+			svc, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+			require.Nil(err)
+			expiresAt, ok := tapExpiry(svc)
+			require.Equal(tc.Duration > 0, ok)
+			_, err = fakeClient.AppsV1().Deployments("default").Get(context.TODO(), janitorPrefix+"sample-service", metav1.GetOptions{})
+			if tc.Duration > 0 {
+				require.False(expiresAt.Before(before.Add(tc.Duration)))
+				require.Nil(err, "the janitor removes an expiring tap while nobody is attached")
+				taps, err := listTaps(fakeClient, "default")
+				require.Nil(err)
+				require.True(expiresAt.Equal(taps[0].ExpiresAt.Time))
+			} else {
+				require.True(apierrors.IsNotFound(err))
+			}
+
+			require.Nil(NewUntapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+			svc, err = fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+			require.Nil(err)
+			require.NotContains(svc.GetAnnotations(), annotationExpiresAt)
+			_, err = fakeClient.AppsV1().Deployments("default").Get(context.TODO(), janitorPrefix+"sample-service", metav1.GetOptions{})
+			require.True(apierrors.IsNotFound(err))
+		})
+	}
+}
+
+func Test_JanitorTapExpired(t *testing.T) {
+	require := require.New(t)
+	fakeClient := fakeClientUntappedSimple()
+	testViper := viper.New()
+	testViper.Set("proxyPort", 80)
+	testViper.Set("namespace", "default")
+	testViper.Set("proxyImage", defaultImageHTTP)
+	testViper.Set("commandArgs", defaultCommandArgs)
+	testViper.Set("duration", time.Minute)
+	testViper.Set("detach", true)
+	b := bytes.NewBufferString("")
+	cmd := &cobra.Command{}
+	cmd.SetOutput(b)
+	require.Nil(NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+	require.Contains(b.String(), "The tap expires at")
+
+	// no Lease is held by a detached tap, only the expiry counts
+	var obs leaseObserver
+	start := time.Now()
+	done, err := janitorStep(context.TODO(), ioutil.Discard, fakeClient, "default", "sample-service", &obs, start)
+	require.Nil(err)
+	require.False(done)
+	done, err = janitorStep(context.TODO(), ioutil.Discard, fakeClient, "default", "sample-service", &obs, start.Add(2*time.Minute))
+	require.Nil(err)
+	require.True(done)
+	svc, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+	require.Nil(err)
+	require.Equal(simpleService.Spec.Ports, svc.Spec.Ports)
+	require.NotContains(svc.GetAnnotations(), annotationExpiresAt)
+}
+
+func Test_GuardExpiringSession(t *testing.T) {
+	require := require.New(t)
+	fakeClient := fakeClientTappedSimple()
+	stop := guardSession(context.TODO(), ioutil.Discard, fakeClient, "default", "sample-service", "", true)
+	stop()
+	_, err := fakeClient.CoordinationV1().Leases("default").Get(context.TODO(), leasePrefix+"sample-service", metav1.GetOptions{})
+	require.True(apierrors.IsNotFound(err))
+	_, err = fakeClient.AppsV1().Deployments("default").Get(context.TODO(), janitorPrefix+"sample-service", metav1.GetOptions{})
+	require.Nil(err, "the janitor of an expiring tap outlives the session")
+}
+
+func Test_UntilExpiry(t *testing.T) {
+	ctx, cancel := untilExpiry(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	<-ctx.Done()
+	require.True(t, tapExpired(ctx))
+
+	ctx, cancel = untilExpiry(context.Background(), time.Time{})
+	cancel()
+	require.False(t, tapExpired(ctx), "a cancelled session did not expire")
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// grpcAddonPath is the location of the protobuf decoding addon in the gRPC image.
+	grpcAddonPath = "/usr/local/share/mittens/mittens_grpc.py"
+	// grpcDescriptorDir is where the ConfigMap holding the descriptors is mounted.
+	grpcDescriptorDir = "/home/mitmproxy/config"
+
+	// maxProtoFilesSize keeps the ConfigMap below the 1MiB object size limit,
+	// leaving room for the mitmproxy config and object metadata.
+	maxProtoFilesSize = 1000 * 1024
+)
+
+var (
+	ErrProtoFileExtension = errors.New("proto files must be .proto sources or FileDescriptorSets (.pb, .desc, .protoset, .binpb)")
+	ErrProtoFileDuplicate = errors.New("proto files must have unique file names")
+	ErrProtoFilesTooLarge = errors.New("proto files exceed the ConfigMap size limit")
+
+	protoFileExtensions = map[string]bool{
+		".proto":    true,
+		".pb":       true,
+		".desc":     true,
+		".protoset": true,
+		".binpb":    true,
+	}
+)
+
+// NewGrpc initializes a new gRPC Tap. It is a mitmproxy Tap whose sidecar
+// image ships an addon that decodes protobuf messages using the descriptors
+// provided by the user, or server reflection when none are provided.
+func NewGrpc(c kubernetes.Interface, p ProxyOptions) Tap {
+	p.Mode = "reverse"
+	return &Grpc{
+		Mitmproxy: Mitmproxy{
+			Protos:    []Protocol{protocolGRPC},
+			Client:    c,
+			ProxyOpts: p,
+		},
+	}
+}
+
+// Grpc is a mitmproxy Tap for gRPC Services.
+type Grpc struct {
+	Mitmproxy
+}
+
+// String is called to conveniently print the type of Tap to stdout.
+func (g *Grpc) String() string {
+	return "grpc"
+}
+
+// grpcConfig returns the mitmproxy configuration that loads the gRPC addon.
+// Server reflection is only used when no descriptors are provided.
+func grpcConfig(proxyOpts ProxyOptions) []byte {
+	return []byte("\nscripts:\n  - " + grpcAddonPath +
+		"\nmittens_grpc_descriptors: " + grpcDescriptorDir +
+		"\nmittens_grpc_upstream: " + proxyOpts.upstream() +
+		"\nmittens_grpc_reflection: " + strconv.FormatBool(len(proxyOpts.ProtoFiles) == 0) +
+		"\n")
+}
+
+// readProtoFiles reads .proto sources and FileDescriptorSets so they can be
+// shipped to the sidecar in its ConfigMap.
+func readProtoFiles(paths []string) (map[string][]byte, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	files := make(map[string][]byte, len(paths))
+	var size int
+	for _, p := range paths {
+		name := filepath.Base(p)
+		if !protoFileExtensions[filepath.Ext(name)] {
+			return nil, fmt.Errorf("%w: %q", ErrProtoFileExtension, p)
+		}
+		if errs := validation.IsConfigMapKey(name); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid proto file name %q: %v", name, errs)
+		}
+		if _, ok := files[name]; ok {
+			return nil, fmt.Errorf("%w: %q", ErrProtoFileDuplicate, name)
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("error reading proto file: %w", err)
+		}
+		size += len(data)
+		if size > maxProtoFilesSize {
+			return nil, ErrProtoFilesTooLarge
+		}
+		files[name] = data
+	}
+	return files, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+func Test_ReadProtoFiles(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, size int) string {
+		p := filepath.Join(dir, name)
+		require.Nil(t, os.WriteFile(p, make([]byte, size), 0o600))
+		return p
+	}
+	proto := write("api.proto", 10)
+	protoset := write("api.protoset", 10)
+	other := filepath.Join(dir, "other")
+	require.Nil(t, os.Mkdir(other, 0o700))
+	duplicate := filepath.Join(other, "api.proto")
+	require.Nil(t, os.WriteFile(duplicate, []byte("syntax"), 0o600))
+	yaml := write("config.yaml", 10)
+	large := write("large.pb", maxProtoFilesSize+1)
+
+	tests := []struct {
+		Name  string
+		Paths []string
+		Len   int
+		Err   error
+	}{
+		{"none", nil, 0, nil},
+		{"proto_and_descriptor_set", []string{proto, protoset}, 2, nil},
+		{"wrong_extension", []string{yaml}, 0, ErrProtoFileExtension},
+		{"duplicate_name", []string{proto, duplicate}, 0, ErrProtoFileDuplicate},
+		{"too_large", []string{large}, 0, ErrProtoFilesTooLarge},
+		{"missing", []string{filepath.Join(dir, "missing.proto")}, 0, os.ErrNotExist},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			files, err := readProtoFiles(tc.Paths)
+			if tc.Err != nil {
+				require.True(errors.Is(err, tc.Err), "got %v", err)
+				return
+			}
+			require.Nil(err)
+			require.Len(files, tc.Len)
+		})
+	}
+}
+
+func Test_TapGrpc(t *testing.T) {
+	protoset := filepath.Join(t.TempDir(), "api.protoset")
+	require.Nil(t, os.WriteFile(protoset, []byte("descriptor"), 0o600))
+
+	tests := []struct {
+		Name       string
+		ProtoFiles []string
+		Reflection string
+	}{
+		{"descriptors", []string{protoset}, "mittens_grpc_reflection: false"},
+		{"reflection", nil, "mittens_grpc_reflection: true"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			fakeClient := fakeClientUntappedSimple()
+			testViper := viper.New()
+			testViper.Set("proxyPort", 80)
+			testViper.Set("namespace", "default")
+			testViper.Set("protocol", "grpc")
+			testViper.Set("proxyImage", defaultImageHTTP)
+			testViper.Set("commandArgs", defaultCommandArgs)
+			testViper.Set("protoFiles", tc.ProtoFiles)
+			cmd := &cobra.Command{}
+			cmd.SetOutput(ioutil.Discard)
+			err := NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+			require.Nil(err)
+
+			dpl, err := fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "sample-deployment", metav1.GetOptions{})
+			require.Nil(err)
+			require.Equal(defaultImageGRPC, dpl.Spec.Template.Spec.Containers[1].Image)
+			require.Equal([]string{defaultCommandArgs}, dpl.Spec.Template.Spec.Containers[1].Args)
+
+			cm, err := fakeClient.CoreV1().ConfigMaps("default").Get(context.TODO(), mittensConfigMapPrefix+"sample-deployment", metav1.GetOptions{})
+			require.Nil(err)
+			config := string(cm.BinaryData[mitmproxyConfigFile])
+			require.Contains(config, "mode:\n  - reverse:http://127.0.0.1:8080\n")
+			require.Contains(config, grpcAddonPath)
+			require.Contains(config, "mittens_grpc_upstream: 127.0.0.1:8080")
+			require.Contains(config, tc.Reflection)
+			if len(tc.ProtoFiles) > 0 {
+				require.Equal([]byte("descriptor"), cm.BinaryData["api.protoset"])
+			}
+
+			err = NewUntapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+			require.Nil(err)
+			_, err = fakeClient.CoreV1().ConfigMaps("default").Get(context.TODO(), mittensConfigMapPrefix+"sample-deployment", metav1.GetOptions{})
+			require.NotNil(err, "ConfigMap was not removed")
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/AlecAivazis/survey/v2"
+	"github.com/spf13/viper"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// guardConfirm requires the name of the Service to be typed, or --yes.
+	guardConfirm = "confirm"
+	// guardRefuse refuses the tap, even with --yes.
+	guardRefuse = "refuse"
+)
+
+var (
+	// ErrGuardPolicyInvalid occurs when a rule of the protect policy cannot be parsed.
+	ErrGuardPolicyInvalid = errors.New("invalid protect rule in the mittens config")
+	// ErrGuardRefused occurs when the protect policy refuses to tap a Service.
+	ErrGuardRefused = errors.New("the Service is protected from taps by the mittens config")
+	// ErrGuardNotConfirmed occurs when a protected Service is tapped without a terminal to confirm and --yes was not given.
+	ErrGuardNotConfirmed = errors.New("the Service is protected and the tap requires confirmation, pass --yes to run non-interactively")
+	// ErrGuardAborted occurs when the typed confirmation does not match the name of the Service.
+	ErrGuardAborted = errors.New("tap aborted, the confirmation did not match the Service name")
+)
+
+// guardRule protects the Services matching all of its fields from taps, an
+// empty field matches everything. Context and Namespace are globs, Selector
+// is a label selector on the Service.
+type guardRule struct {
+	Context   string `mapstructure:"context"`
+	Namespace string `mapstructure:"namespace"`
+	Selector  string `mapstructure:"selector"`
+	// Action is one of [ confirm, refuse ], confirm if empty
+	Action string `mapstructure:"action"`
+}
+
+// matches reports whether a rule covers a Service in a kubeconfig context.
+func (r guardRule) matches(kubeContext string, svc *v1.Service) (bool, error) {
+	for _, glob := range []struct{ pattern, name string }{
+		{r.Context, kubeContext},
+		{r.Namespace, svc.Namespace},
+	} {
+		if glob.pattern == "" {
+			continue
+		}
+		ok, err := path.Match(glob.pattern, glob.name)
+		if err != nil {
+			return false, fmt.Errorf("%w: %q: %w", ErrGuardPolicyInvalid, glob.pattern, err)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	if r.Selector == "" {
+		return true, nil
+	}
+	sel, err := labels.Parse(r.Selector)
+	if err != nil {
+		return false, fmt.Errorf("%w: %q: %w", ErrGuardPolicyInvalid, r.Selector, err)
+	}
+	return sel.Matches(labels.Set(svc.GetLabels())), nil
+}
+
+// configPaths are the directories the mittens config.yaml is read from.
+func configPaths() []string {
+	var paths []string
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		paths = append(paths, filepath.Join(dir, "mittens"))
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".config", "mittens"))
+	}
+	return paths
+}
+
+// readConfig loads the protect rules of the mittens config into v. The
+// config is read on its own, so it cannot set flags such as --yes that would
+// bypass the rules. A missing config is not an error.
+func readConfig(v *viper.Viper) error {
+	config := viper.New()
+	for _, p := range configPaths() {
+		config.AddConfigPath(p)
+	}
+	config.SetConfigName("config")
+	config.SetConfigType("yaml")
+	var notFound viper.ConfigFileNotFoundError
+	if err := config.ReadInConfig(); err != nil {
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return fmt.Errorf("error reading the mittens config: %w", err)
+	}
+	if config.IsSet("protect") {
+		v.Set("protect", config.Get("protect"))
+	}
+	return nil
+}
+
+// guardTap enforces the protect rules of the mittens config before a Service
+// is tapped. The strictest matching rule applies: refused taps fail, taps
+// requiring confirmation prompt for the name of the Service unless --yes is given.
+func guardTap(out io.Writer, viper *viper.Viper, svc *v1.Service) error {
+	var rules []guardRule
+	if err := viper.UnmarshalKey("protect", &rules); err != nil {
+		return fmt.Errorf("%w: %w", ErrGuardPolicyInvalid, err)
+	}
+	kubeContext := viper.GetString("kubeContext")
+	var confirm bool
+	for _, r := range rules {
+		if r.Action != "" && r.Action != guardConfirm && r.Action != guardRefuse {
+			return fmt.Errorf("%w: unknown action %q, use one of [ confirm, refuse ]", ErrGuardPolicyInvalid, r.Action)
+		}
+		ok, err := r.matches(kubeContext, svc)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if r.Action == guardRefuse {
+			return fmt.Errorf("%w: Service %s/%s in context %q", ErrGuardRefused, svc.Namespace, svc.Name, kubeContext)
+		}
+		confirm = true
+	}
+	if !confirm || viper.GetBool("yes") {
+		return nil
+	}
+	if _, isTerminal := out.(*os.File); !isTerminal {
+		return ErrGuardNotConfirmed
+	}
+	_, _ = fmt.Fprintf(out, "Service %s/%s in context %q is protected, tapping it restarts its workload and reroutes live traffic.\n", svc.Namespace, svc.Name, kubeContext)
+	var typed string
+	if err := survey.AskOne(&survey.Input{Message: "Type the name of the Service to tap it:"}, &typed); err != nil {
+		return fmt.Errorf("confirmation cancelled: %w", err)
+	}
+	if typed != svc.Name {
+		return ErrGuardAborted
+	}
+	return nil
+}
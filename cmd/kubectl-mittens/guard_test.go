@@ -0,0 +1,122 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/rest"
+)
+
+func Test_GuardTap(t *testing.T) {
+	tests := []struct {
+		Name  string
+		Rules []map[string]string
+		Yes   bool
+		Err   error
+	}{
+		{"no_rules", nil, false, nil},
+		{"other_context", []map[string]string{{"context": "prod-*"}}, false, nil},
+		{"confirm", []map[string]string{{"context": "kind-*"}}, false, ErrGuardNotConfirmed},
+		{"confirm_yes", []map[string]string{{"context": "kind-*", "action": guardConfirm}}, true, nil},
+		{"refuse_yes", []map[string]string{{"namespace": "default", "action": guardRefuse}}, true, ErrGuardRefused},
+		{"strictest_wins", []map[string]string{{"context": "kind-dev"}, {"selector": "tier=critical", "action": guardRefuse}}, true, ErrGuardRefused},
+		{"selector_mismatch", []map[string]string{{"selector": "tier=frontend", "action": guardRefuse}}, false, nil},
+		{"unknown_action", []map[string]string{{"action": "ask"}}, false, ErrGuardPolicyInvalid},
+		{"invalid_glob", []map[string]string{{"context": "["}}, false, ErrGuardPolicyInvalid},
+		{"invalid_selector", []map[string]string{{"selector": "tier in"}}, false, ErrGuardPolicyInvalid},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			testViper := viper.New()
+			testViper.Set("kubeContext", "kind-dev")
+			testViper.Set("protect", tc.Rules)
+			testViper.Set("yes", tc.Yes)
+			svc := simpleService
+			svc.Labels = map[string]string{"tier": "critical"}
+			err := guardTap(ioutil.Discard, testViper, &svc)
+			require.True(t, errors.Is(err, tc.Err), "expected %v, got %v", tc.Err, err)
+		})
+	}
+}
+
+func Test_GuardTapFromConfig(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	require.Nil(os.MkdirAll(filepath.Join(dir, "mittens"), 0o755))
+	config := []byte(`protect:
+- context: kind-*
+  namespace: default
+  action: refuse
+`)
+	require.Nil(os.WriteFile(filepath.Join(dir, "mittens", "config.yaml"), config, 0o600))
+
+	fakeClient := fakeClientUntappedSimple()
+	testViper := viper.New()
+	require.Nil(readConfig(testViper))
+	testViper.Set("kubeContext", "kind-dev")
+	testViper.Set("proxyPort", 80)
+	testViper.Set("proxyImage", defaultImageHTTP)
+	testViper.Set("commandArgs", defaultCommandArgs)
+	cmd := &cobra.Command{}
+	cmd.SetOutput(ioutil.Discard)
+	err := NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+	require.True(errors.Is(err, ErrGuardRefused), "expected %v, got %v", ErrGuardRefused, err)
+	for _, action := range fakeClient.Actions() {
+		require.Contains([]string{"get", "list"}, action.GetVerb(), "nothing is changed in a protected context")
+	}
+
+	// a dry run changes nothing, yet a refused Service is not even dry run
+	testViper.Set("dryRun", dryRunClient)
+	b := bytes.NewBufferString("")
+	cmd.SetOutput(b)
+	err = NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+	require.True(errors.Is(err, ErrGuardRefused), "expected %v, got %v", ErrGuardRefused, err)
+}
+
+func Test_ReadConfigOnlyProtect(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	require.Nil(os.MkdirAll(filepath.Join(dir, "mittens"), 0o755))
+	config := []byte(`yes: true
+preflight: false
+protect:
+- namespace: default
+`)
+	require.Nil(os.WriteFile(filepath.Join(dir, "mittens", "config.yaml"), config, 0o600))
+
+	testViper := viper.New()
+	require.Nil(readConfig(testViper))
+	require.False(testViper.IsSet("yes"), "the config must not set flags")
+	require.False(testViper.IsSet("preflight"))
+	svc := simpleService
+	err := guardTap(ioutil.Discard, testViper, &svc)
+	require.True(errors.Is(err, ErrGuardNotConfirmed), "yes in the config must not skip the confirmation, got %v", err)
+}
+
+func Test_ReadConfigMissing(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	require.Nil(t, readConfig(viper.New()))
+}
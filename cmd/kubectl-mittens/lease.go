@@ -0,0 +1,366 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	k8sappsv1 "k8s.io/api/apps/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	leasePrefix   = "mittens-lease-"
+	janitorPrefix = "mittens-janitor-"
+	// labelJanitor marks the session Lease and the janitor of a tapped Service.
+	labelJanitor = "mittens.io/janitor"
+
+	defaultImageJanitor = defaultImageRaw
+
+	leaseDurationSeconds = 30
+	leaseRenewInterval   = 10 * time.Second
+	janitorInterval      = 5 * time.Second
+)
+
+// guardSession holds a Lease for a tapped Service while the client is attached
+// to it, and starts a janitor in the namespace that reverts the Service once
+// the Lease is no longer renewed, e.g. because the client was killed. The
+// returned stop func releases both, leaving the tap itself in place, but the
+// janitor of an expiring tap is kept to remove it in time. Errors only leave
+// the tap unguarded, they are printed as warnings.
+func guardSession(ctx context.Context, out io.Writer, client kubernetes.Interface, namespace, svcName, image string, expiring bool) (stop func()) {
+	if image == "" {
+		image = defaultImageJanitor
+	}
+	release := func() {
+		if expiring {
+			_ = deleteLease(client, namespace, svcName)
+			return
+		}
+		_ = releaseSession(client, namespace, svcName)
+	}
+	if err := acquireLease(ctx, client, namespace, svcName); err != nil {
+		_, _ = fmt.Fprintf(out, "Warning: the tap is not reverted if mittens is killed, error creating Lease: %v\n", err)
+		return release
+	}
+	if err := startJanitor(ctx, client, namespace, svcName, image); err != nil {
+		_, _ = fmt.Fprintf(out, "Warning: the tap is not reverted if mittens is killed, error starting janitor: %v\n", err)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(leaseRenewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// a missed renewal is retried, the janitor only acts after several
+				_ = renewLease(ctx, client, namespace, svcName)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		release()
+	}
+}
+
+// acquireLease creates the session Lease of a Service, taking over a Lease
+// left behind by an earlier session.
+func acquireLease(ctx context.Context, client kubernetes.Interface, namespace, svcName string) error {
+	holder, err := os.Hostname()
+	if err != nil {
+		holder = "mittens"
+	}
+	holder += "_" + strconv.Itoa(os.Getpid())
+	duration := int32(leaseDurationSeconds)
+	now := metav1.NowMicro()
+	lease := coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   standaloneName(leasePrefix, svcName),
+			Labels: map[string]string{labelJanitor: svcName},
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &duration,
+			AcquireTime:          &now,
+			RenewTime:            &now,
+		},
+	}
+	leases := client.CoordinationV1().Leases(namespace)
+	_, err = leases.Create(ctx, &lease, metav1.CreateOptions{FieldManager: fieldManager})
+	if apierrors.IsAlreadyExists(err) {
+		_, err = leases.Update(ctx, &lease, metav1.UpdateOptions{FieldManager: fieldManager})
+	}
+	return err
+}
+
+// renewLease moves the renew time of the session Lease of a Service to now.
+func renewLease(ctx context.Context, client kubernetes.Interface, namespace, svcName string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{"renewTime": metav1.NowMicro()},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.CoordinationV1().Leases(namespace).Patch(ctx, standaloneName(leasePrefix, svcName), types.MergePatchType, patch, patchOptions)
+	return err
+}
+
+// releaseSession deletes the janitor and the session Lease of a Service, if any.
+func releaseSession(client kubernetes.Interface, namespace, svcName string) error {
+	// the janitor goes first, so it cannot act on a Lease being released
+	err := client.AppsV1().Deployments(namespace).Delete(context.TODO(), standaloneName(janitorPrefix, svcName), metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error deleting janitor: %w", err)
+	}
+	return deleteLease(client, namespace, svcName)
+}
+
+// deleteLease deletes the session Lease of a Service, if any.
+func deleteLease(client kubernetes.Interface, namespace, svcName string) error {
+	err := client.CoordinationV1().Leases(namespace).Delete(context.TODO(), standaloneName(leasePrefix, svcName), metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error deleting Lease: %w", err)
+	}
+	return nil
+}
+
+// startJanitor creates the janitor Deployment of a Service, and the
+// ServiceAccount, Role and RoleBinding it runs with. The RBAC resources are
+// owned by the Deployment, so they are garbage collected with it.
+func startJanitor(ctx context.Context, client kubernetes.Interface, namespace, svcName, image string) error {
+	name := standaloneName(janitorPrefix, svcName)
+	labels := map[string]string{labelJanitor: svcName}
+	replicas := int32(1)
+	noEscalation := false
+	enabled := true
+	dpl := k8sappsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+		Spec: k8sappsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: v1.PodSpec{
+					ServiceAccountName: name,
+					Containers: []v1.Container{
+						{
+							Name:    "janitor",
+							Image:   image,
+							Command: []string{"kubectl-mittens"},
+							Args:    []string{"janitor", svcName, "--namespace", namespace},
+							Resources: v1.ResourceRequirements{
+								Requests: v1.ResourceList{
+									v1.ResourceCPU:    resource.MustParse("10m"),
+									v1.ResourceMemory: resource.MustParse("32Mi"),
+								},
+							},
+							SecurityContext: &v1.SecurityContext{
+								AllowPrivilegeEscalation: &noEscalation,
+								RunAsNonRoot:             &enabled,
+								ReadOnlyRootFilesystem:   &enabled,
+								Capabilities:             &v1.Capabilities{Drop: []v1.Capability{"ALL"}},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	deployments := client.AppsV1().Deployments(namespace)
+	created, err := deployments.Create(ctx, &dpl, metav1.CreateOptions{FieldManager: fieldManager})
+	if apierrors.IsAlreadyExists(err) {
+		// a janitor of an earlier session is still watching the Lease
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	owner := []metav1.OwnerReference{*metav1.NewControllerRef(created, k8sappsv1.SchemeGroupVersion.WithKind(kindDeployment))}
+	meta := metav1.ObjectMeta{Name: name, Labels: labels, OwnerReferences: owner}
+
+	sa := v1.ServiceAccount{ObjectMeta: meta}
+	if _, err := client.CoreV1().ServiceAccounts(namespace).Create(ctx, &sa, metav1.CreateOptions{FieldManager: fieldManager}); err != nil {
+		_ = deployments.Delete(ctx, name, metav1.DeleteOptions{})
+		return err
+	}
+	role := rbacv1.Role{
+		ObjectMeta: meta,
+		Rules:      janitorRules(svcName),
+	}
+	if _, err := client.RbacV1().Roles(namespace).Create(ctx, &role, metav1.CreateOptions{FieldManager: fieldManager}); err != nil {
+		_ = deployments.Delete(ctx, name, metav1.DeleteOptions{})
+		return err
+	}
+	binding := rbacv1.RoleBinding{
+		ObjectMeta: meta,
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: name},
+		Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: name, Namespace: namespace}},
+	}
+	if _, err := client.RbacV1().RoleBindings(namespace).Create(ctx, &binding, metav1.CreateOptions{FieldManager: fieldManager}); err != nil {
+		_ = deployments.Delete(ctx, name, metav1.DeleteOptions{})
+		return err
+	}
+	return nil
+}
+
+// janitorRules allow the janitor of a Service to revert it and remove
+// itself, and nothing else.
+func janitorRules(svcName string) []rbacv1.PolicyRule {
+	return []rbacv1.PolicyRule{
+		{
+			APIGroups:     []string{""},
+			Resources:     []string{"services"},
+			ResourceNames: []string{svcName},
+			Verbs:         []string{"get", "patch"},
+		},
+		{
+			APIGroups:     []string{""},
+			Resources:     []string{"configmaps"},
+			ResourceNames: []string{standaloneName(snapshotPrefix, svcName)},
+			Verbs:         []string{"get"},
+		},
+		{
+			APIGroups:     []string{coordinationv1.GroupName},
+			Resources:     []string{"leases"},
+			ResourceNames: []string{standaloneName(leasePrefix, svcName)},
+			Verbs:         []string{"get", "delete"},
+		},
+		{
+			APIGroups:     []string{k8sappsv1.GroupName},
+			Resources:     []string{"deployments"},
+			ResourceNames: []string{standaloneName(janitorPrefix, svcName)},
+			Verbs:         []string{"delete"},
+		},
+	}
+}
+
+// leaseObserver tracks when a Lease was last seen renewed. Expiry is judged
+// by the local clock, so clock skew between the client and the cluster does
+// not matter.
+type leaseObserver struct {
+	renewTime time.Time
+	observed  time.Time
+}
+
+// expired reports whether the Lease has not been renewed for its duration.
+func (o *leaseObserver) expired(lease *coordinationv1.Lease, now time.Time) bool {
+	var renewTime time.Time
+	if lease.Spec.RenewTime != nil {
+		renewTime = lease.Spec.RenewTime.Time
+	}
+	if o.observed.IsZero() || !renewTime.Equal(o.renewTime) {
+		o.renewTime = renewTime
+		o.observed = now
+		return false
+	}
+	duration := time.Duration(leaseDurationSeconds) * time.Second
+	if lease.Spec.LeaseDurationSeconds != nil {
+		duration = time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	}
+	return now.Sub(o.observed) > duration
+}
+
+// NewJanitorCommand watches the session Lease of a tapped Service and
+// reverts the Service once the Lease or the tap expires, then deletes the
+// Lease and its own Deployment. It runs in the cluster, see guardSession.
+func NewJanitorCommand(client kubernetes.Interface, viper *viper.Viper) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		svcName := args[0]
+		namespace := targetNamespace(viper)
+		ctx := cmd.Context()
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		var obs leaseObserver
+		ticker := time.NewTicker(janitorInterval)
+		defer ticker.Stop()
+		for {
+			done, err := janitorStep(ctx, cmd.OutOrStdout(), client, namespace, svcName, &obs, time.Now())
+			if err != nil {
+				_, _ = fmt.Fprintf(cmd.ErrOrStderr(), "janitor: %v\n", err)
+			}
+			if done {
+				return nil
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+			}
+		}
+	}
+}
+
+// janitorStep checks the tap and its session Lease once and reverts the
+// Service if either expired. It reports whether the janitor is done.
+func janitorStep(ctx context.Context, out io.Writer, client kubernetes.Interface, namespace, svcName string, obs *leaseObserver, now time.Time) (bool, error) {
+	svc, err := client.CoreV1().Services(namespace).Get(ctx, svcName, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+	if expiresAt, ok := tapExpiry(svc); ok && !now.Before(expiresAt) {
+		_, _ = fmt.Fprintf(out, "The tap expired at %s, reverting Service %q\n", expiresAt.Format(time.RFC3339), svcName)
+	} else {
+		lease, err := client.CoordinationV1().Leases(namespace).Get(ctx, standaloneName(leasePrefix, svcName), metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			// released, or not created yet, the client removes the janitor
+			*obs = leaseObserver{}
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if !obs.expired(lease, now) {
+			return false, nil
+		}
+		_, _ = fmt.Fprintf(out, "Lease %q expired, reverting Service %q\n", lease.Name, svcName)
+	}
+	snap, err := loadSnapshot(client.CoreV1().ConfigMaps(namespace), svcName)
+	if err != nil {
+		return false, err
+	}
+	var svcSnap *serviceSnapshot
+	if snap != nil {
+		svcSnap = &snap.Service
+	}
+	if err := untapSvc(client.CoreV1().Services(namespace), svcName, svcSnap); err != nil {
+		return false, err
+	}
+	// the proxy is left idle, cleanup or untap remove it
+	if err := releaseSession(client, namespace, svcName); err != nil {
+		return true, err
+	}
+	return true, nil
+}
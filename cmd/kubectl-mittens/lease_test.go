@@ -0,0 +1,124 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+func Test_GuardSession(t *testing.T) {
+	require := require.New(t)
+	fakeClient := fakeClientUntappedSimple()
+	stop := guardSession(context.TODO(), ioutil.Discard, fakeClient, "default", "sample-service", "", false)
+
+	lease, err := fakeClient.CoordinationV1().Leases("default").Get(context.TODO(), leasePrefix+"sample-service", metav1.GetOptions{})
+	require.Nil(err)
+	require.NotEmpty(*lease.Spec.HolderIdentity)
+	require.Equal(int32(leaseDurationSeconds), *lease.Spec.LeaseDurationSeconds)
+
+	name := janitorPrefix + "sample-service"
+	dpl, err := fakeClient.AppsV1().Deployments("default").Get(context.TODO(), name, metav1.GetOptions{})
+	require.Nil(err)
+	janitor := dpl.Spec.Template.Spec.Containers[0]
+	require.Equal(defaultImageJanitor, janitor.Image)
+	require.Equal([]string{"janitor", "sample-service", "--namespace", "default"}, janitor.Args)
+	require.Equal(name, dpl.Spec.Template.Spec.ServiceAccountName)
+
+	sa, err := fakeClient.CoreV1().ServiceAccounts("default").Get(context.TODO(), name, metav1.GetOptions{})
+	require.Nil(err)
+	require.Equal(dpl.Name, sa.OwnerReferences[0].Name, "RBAC is garbage collected with the janitor")
+	role, err := fakeClient.RbacV1().Roles("default").Get(context.TODO(), name, metav1.GetOptions{})
+	require.Nil(err)
+	for _, rule := range role.Rules {
+		require.Len(rule.ResourceNames, 1, "the janitor may only touch its own tap")
+	}
+	_, err = fakeClient.RbacV1().RoleBindings("default").Get(context.TODO(), name, metav1.GetOptions{})
+	require.Nil(err)
+
+	stop()
+	_, err = fakeClient.CoordinationV1().Leases("default").Get(context.TODO(), leasePrefix+"sample-service", metav1.GetOptions{})
+	require.True(apierrors.IsNotFound(err))
+	_, err = fakeClient.AppsV1().Deployments("default").Get(context.TODO(), name, metav1.GetOptions{})
+	require.True(apierrors.IsNotFound(err))
+}
+
+func Test_JanitorStep(t *testing.T) {
+	require := require.New(t)
+	fakeClient := fakeClientUntappedSimple()
+	testViper := viper.New()
+	testViper.Set("proxyPort", 80)
+	testViper.Set("namespace", "default")
+	testViper.Set("proxyImage", defaultImageHTTP)
+	testViper.Set("commandArgs", defaultCommandArgs)
+	cmd := &cobra.Command{}
+	cmd.SetOutput(ioutil.Discard)
+	require.Nil(NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+	require.Nil(acquireLease(context.TODO(), fakeClient, "default", "sample-service"))
+	require.Nil(startJanitor(context.TODO(), fakeClient, "default", "sample-service", defaultImageJanitor))
+
+	var obs leaseObserver
+	step := func(now time.Time) bool {
+		done, err := janitorStep(context.TODO(), ioutil.Discard, fakeClient, "default", "sample-service", &obs, now)
+		require.Nil(err)
+		return done
+	}
+	start := time.Now()
+	require.False(step(start))
+	require.False(step(start.Add(20 * time.Second)))
+	// a renewal restarts the clock, however far the client clock is off
+	lease, err := fakeClient.CoordinationV1().Leases("default").Get(context.TODO(), leasePrefix+"sample-service", metav1.GetOptions{})
+	require.Nil(err)
+	renewed := metav1.NewMicroTime(lease.Spec.RenewTime.Add(-time.Hour))
+	lease.Spec.RenewTime = &renewed
+	_, err = fakeClient.CoordinationV1().Leases("default").Update(context.TODO(), lease, metav1.UpdateOptions{})
+	require.Nil(err)
+	require.False(step(start.Add(40 * time.Second)))
+	require.False(step(start.Add(60 * time.Second)))
+
+	svc, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+	require.Nil(err)
+	require.NotEqual(simpleService.Spec.Ports, svc.Spec.Ports, "the Service stays tapped while the Lease is renewed")
+
+	require.True(step(start.Add(80 * time.Second)))
+	svc, err = fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+	require.Nil(err)
+	require.Equal(simpleService.Spec.Ports, svc.Spec.Ports)
+	_, err = fakeClient.CoordinationV1().Leases("default").Get(context.TODO(), leasePrefix+"sample-service", metav1.GetOptions{})
+	require.True(apierrors.IsNotFound(err))
+	_, err = fakeClient.AppsV1().Deployments("default").Get(context.TODO(), janitorPrefix+"sample-service", metav1.GetOptions{})
+	require.True(apierrors.IsNotFound(err))
+
+	// the leftover proxy is removed by untap as usual, the released session included
+	require.Nil(NewUntapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+}
+
+func Test_JanitorWithoutLease(t *testing.T) {
+	fakeClient := fakeClientTappedSimple()
+	var obs leaseObserver
+	for _, d := range []time.Duration{0, time.Minute, time.Hour} {
+		done, err := janitorStep(context.TODO(), ioutil.Discard, fakeClient, "default", "sample-service", &obs, time.Now().Add(d))
+		require.Nil(t, err)
+		require.False(t, done, "a released Lease is never expired")
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+// ErrOutputFormatNotSupported occurs when an unknown output format is requested.
+var ErrOutputFormatNotSupported = errors.New("output format not supported, use one of [ table, json, yaml ]")
+
+// TapInfo describes an active tap.
+type TapInfo struct {
+	Namespace          string   `json:"namespace"`
+	Service            string   `json:"service"`
+	Protocol           Protocol `json:"protocol"`
+	Strategy           string   `json:"strategy"`
+	OriginalTargetPort string   `json:"originalTargetPort"`
+	WorkloadKind       string   `json:"workloadKind,omitempty"`
+	Workload           string   `json:"workload,omitempty"`
+	Pod                string   `json:"pod,omitempty"`
+	Ready              bool     `json:"ready"`
+	Image              string   `json:"image,omitempty"`
+	// Created is when the Service was tapped
+	Created   *metav1.Time `json:"created,omitempty"`
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+}
+
+// NewListCommand prints the active taps in a namespace, or in all namespaces.
+func NewListCommand(client kubernetes.Interface, viper *viper.Viper) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, _ []string) error {
+		output := viper.GetString("output")
+		if output == "" {
+			output = outputTable
+		}
+		if output != outputTable && output != outputJSON && output != outputYAML {
+			return ErrOutputFormatNotSupported
+		}
+		namespace := targetNamespace(viper)
+
+		var taps []TapInfo
+		var err error
+		if viper.GetBool("allNamespaces") {
+			taps, err = listTaps(client, "")
+			if apierrors.IsForbidden(err) {
+				// tenants of a shared cluster may only list their own namespace
+				_, _ = fmt.Fprintf(cmd.ErrOrStderr(), "Warning: listing all namespaces is forbidden, listing Namespace %q\n", namespace)
+				taps, err = listTaps(client, namespace)
+			}
+		} else {
+			taps, err = listTaps(client, namespace)
+		}
+		if err != nil {
+			return err
+		}
+		return printTaps(cmd.OutOrStdout(), taps, output, time.Now())
+	}
+}
+
+// listTaps collects the active taps in a namespace, or in all namespaces if
+// namespace is empty.
+func listTaps(client kubernetes.Interface, namespace string) ([]TapInfo, error) {
+	svcs, err := client.CoreV1().Services(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing Services: %w", err)
+	}
+	taps := []TapInfo{}
+	for i := range svcs.Items {
+		svc := &svcs.Items[i]
+		origPort, ok := svc.GetAnnotations()[annotationOriginalTargetPort]
+		if !ok {
+			continue
+		}
+		info := TapInfo{
+			Namespace:          svc.Namespace,
+			Service:            svc.Name,
+			Protocol:           tappedProtocol(svc),
+			Strategy:           tappedStrategy(svc),
+			OriginalTargetPort: origPort,
+		}
+		if expiresAt, ok := tapExpiry(svc); ok {
+			t := metav1.NewTime(expiresAt)
+			info.ExpiresAt = &t
+		}
+		if tappedAt, ok := tapTime(svc); ok {
+			t := metav1.NewTime(tappedAt)
+			info.Created = &t
+		}
+		// A tap whose workload is gone is still listed so it can be cleaned up.
+		workload, err := workloadFromSelectors(client, svc.Namespace, svc.Spec.Selector)
+		if err == nil {
+			info.WorkloadKind = workload.Kind()
+			info.Workload = workload.Name()
+			for _, c := range workload.PodTemplate().Spec.Containers {
+				if c.Name == mittensContainerName {
+					info.Image = c.Image
+				}
+			}
+			if pod, err := mittensPod(client.CoreV1().Pods(svc.Namespace), workload.Name()); err == nil {
+				info.Pod = pod.Name
+				info.Ready = sidecarReady(pod)
+				// the proxy of an ephemeral tap is not in the pod template
+				if image := sidecarImage(pod); image != "" {
+					info.Image = image
+				}
+				// taps made before the tap time was recorded
+				if info.Created == nil {
+					created := pod.CreationTimestamp
+					info.Created = &created
+				}
+			}
+		}
+		taps = append(taps, info)
+	}
+	sort.Slice(taps, func(i, j int) bool {
+		if taps[i].Namespace != taps[j].Namespace {
+			return taps[i].Namespace < taps[j].Namespace
+		}
+		return taps[i].Service < taps[j].Service
+	})
+	return taps, nil
+}
+
+// tapTime returns when a Service was tapped, if it was recorded.
+func tapTime(svc *v1.Service) (time.Time, bool) {
+	s, ok := svc.GetAnnotations()[annotationTappedAt]
+	if !ok {
+		return time.Time{}, false
+	}
+	tappedAt, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return tappedAt, true
+}
+
+// sidecarReady reports whether the proxy container of a Pod is ready. An
+// ephemeral proxy has no readiness probe, it is ready once it runs.
+func sidecarReady(pod v1.Pod) bool {
+	name := sidecarName(pod)
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.Name == name {
+			return cs.Ready
+		}
+	}
+	for _, cs := range pod.Status.EphemeralContainerStatuses {
+		if cs.Name == name {
+			return cs.State.Running != nil
+		}
+	}
+	return false
+}
+
+// printTaps writes taps in the requested output format.
+func printTaps(out io.Writer, taps []TapInfo, output string, now time.Time) error {
+	switch output {
+	case outputJSON:
+		b, err := json.MarshalIndent(taps, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(out, string(b))
+		return err
+	case outputYAML:
+		b, err := yaml.Marshal(taps)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(b)
+		return err
+	}
+	if len(taps) == 0 {
+		_, _ = fmt.Fprintln(out, "No active taps found")
+		return nil
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "NAMESPACE\tSERVICE\tPROTOCOL\tORIGINAL PORT\tWORKLOAD\tREADY\tIMAGE\tAGE\tEXPIRES")
+	for _, t := range taps {
+		workload := "<none>"
+		if t.Workload != "" {
+			workload = t.WorkloadKind + "/" + t.Workload
+		}
+		image := "<none>"
+		if t.Image != "" {
+			image = t.Image
+		}
+		age := "<unknown>"
+		if t.Created != nil {
+			age = duration.HumanDuration(now.Sub(t.Created.Time))
+		}
+		expires := "<never>"
+		if t.ExpiresAt != nil {
+			expires = "in " + duration.HumanDuration(t.ExpiresAt.Sub(now))
+			if !now.Before(t.ExpiresAt.Time) {
+				expires = "expired"
+			}
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%t\t%s\t%s\t%s\n",
+			t.Namespace, t.Service, t.Protocol, t.OriginalTargetPort, workload, t.Ready, image, age, expires)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,171 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/yaml"
+)
+
+func Test_NewListCommand(t *testing.T) {
+	tests := []struct {
+		Name          string
+		ClientFunc    func() *fake.Clientset
+		AllNamespaces bool
+		Output        string
+		Contains      []string
+		Err           error
+	}{
+		{"table", fakeClientTappedWithPod, false, "", []string{"SERVICE", "sample-service", "Deployment/sample-deployment", "8080", "true", "5m"}, nil},
+		{"untapped", fakeClientUntappedSimple, false, "table", []string{"No active taps found"}, nil},
+		{"all_namespaces", fakeClientTappedTwoNamespaces, true, "table", []string{"default", "other"}, nil},
+		{"all_namespaces_forbidden", fakeClientTenant, true, "table", []string{"Warning: listing all namespaces is forbidden", "default"}, nil},
+		{"json", fakeClientTappedWithPod, false, "json", []string{`"service": "sample-service"`, `"ready": true`}, nil},
+		{"yaml", fakeClientTappedWithPod, false, "yaml", []string{"service: sample-service", "originalTargetPort: \"8080\""}, nil},
+		{"unsupported_output", fakeClientTappedSimple, false, "xml", nil, ErrOutputFormatNotSupported},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			testViper := viper.New()
+			testViper.Set("namespace", "default")
+			testViper.Set("allNamespaces", tc.AllNamespaces)
+			testViper.Set("output", tc.Output)
+			b := bytes.NewBufferString("")
+			cmd := &cobra.Command{}
+			cmd.SetOutput(b)
+			err := NewListCommand(tc.ClientFunc(), testViper)(cmd, []string{})
+			if tc.Err != nil {
+				require.True(errors.Is(err, tc.Err))
+				return
+			}
+			require.Nil(err)
+			for _, s := range tc.Contains {
+				require.Contains(b.String(), s)
+			}
+		})
+	}
+}
+
+func Test_ListTaps(t *testing.T) {
+	require := require.New(t)
+	taps, err := listTaps(fakeClientTappedWithPod(), "default")
+	require.Nil(err)
+	require.Len(taps, 1)
+	require.Equal("sample-mittens-pod", taps[0].Pod)
+	require.Equal("ghcr.io/lappihuan/mittens-mitmproxy:latest", taps[0].Image)
+	require.Equal(protocolHTTP, taps[0].Protocol)
+
+	// JSON and YAML must round trip so the output can be scripted against.
+	var b bytes.Buffer
+	require.Nil(printTaps(&b, taps, outputJSON, time.Now()))
+	var fromJSON []TapInfo
+	require.Nil(json.Unmarshal(b.Bytes(), &fromJSON))
+	require.Equal(taps[0].Service, fromJSON[0].Service)
+	b.Reset()
+	require.Nil(printTaps(&b, taps, outputYAML, time.Now()))
+	var fromYAML []TapInfo
+	require.Nil(yaml.Unmarshal(b.Bytes(), &fromYAML))
+	require.Equal(taps[0].Workload, fromYAML[0].Workload)
+
+	// Taps without a workload are still listed.
+	taps, err = listTaps(fakeClientTappedWithoutDeployment(), "default")
+	require.Nil(err)
+	require.Len(taps, 1)
+	require.Empty(taps[0].Workload)
+}
+
+func Test_ListTapsEphemeral(t *testing.T) {
+	require := require.New(t)
+	tappedAt := time.Now().Add(-2 * time.Hour).UTC().Truncate(time.Second)
+	svc := simpleServiceTapped
+	svc.Annotations = map[string]string{
+		annotationOriginalTargetPort: "8080",
+		annotationStrategy:           strategyEphemeral,
+		annotationTappedAt:           tappedAt.Format(time.RFC3339),
+	}
+	namespace := simpleNamespace
+	deployment := simpleDeployment
+	pod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "sample-pod",
+			Namespace:         "default",
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-24 * time.Hour)),
+			Labels:            map[string]string{"app": "myapp"},
+			Annotations: map[string]string{
+				annotationIsTapped: "sample-deployment",
+				annotationSidecar:  mittensContainerName + "-1",
+			},
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{Name: "someapp", Image: "someapp:1"}},
+			EphemeralContainers: []v1.EphemeralContainer{
+				{EphemeralContainerCommon: v1.EphemeralContainerCommon{Name: mittensContainerName + "-1", Image: "mitmproxy:custom"}},
+			},
+		},
+	}
+	taps, err := listTaps(fake.NewSimpleClientset(&namespace, &deployment, &svc, &pod), "default")
+	require.Nil(err)
+	require.Len(taps, 1)
+	require.Equal("mitmproxy:custom", taps[0].Image, "the image of the ephemeral proxy, not the pod template")
+	require.True(tappedAt.Equal(taps[0].Created.Time), "the age of the tap, not of the Pod")
+
+	var b bytes.Buffer
+	require.Nil(printTaps(&b, taps, outputTable, tappedAt.Add(2*time.Hour)))
+	require.Contains(b.String(), "mitmproxy:custom")
+	require.Contains(b.String(), "120m")
+}
+
+func fakeClientTappedWithPod() *fake.Clientset {
+	client := fakeClientTappedSimple()
+	pod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "sample-mittens-pod",
+			Namespace:         "default",
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-5 * time.Minute)),
+			Labels:            map[string]string{"app": "myapp"},
+			Annotations: map[string]string{
+				annotationIsTapped: "sample-deployment",
+			},
+		},
+		Status: v1.PodStatus{
+			ContainerStatuses: []v1.ContainerStatus{
+				{Name: "someapp", Ready: true},
+				{Name: mittensContainerName, Ready: true},
+			},
+		},
+	}
+	_ = client.Tracker().Add(&pod)
+	return client
+}
+
+func fakeClientTappedWithoutDeployment() *fake.Clientset {
+	namespace := simpleNamespace
+	service := simpleServiceTapped
+	return fake.NewSimpleClientset(
+		&namespace,
+		&service,
+	)
+}
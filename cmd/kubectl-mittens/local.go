@@ -0,0 +1,294 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// mittensTunnelPort is where the local mode sidecar accepts tunnels.
+	mittensTunnelPort     = 7778
+	mittensTunnelPortName = "mittens-tunnel"
+
+	// localTunnelPoolSize is the number of idle tunnels kept open to the
+	// sidecar, it bounds how many new connections can be paired at once.
+	localTunnelPoolSize = 8
+	// localTunnelReady is written by the sidecar once a tunnel is paired.
+	localTunnelReady byte = 1
+	// localTunnelBackoff is how long to wait before redialing a failed tunnel.
+	localTunnelBackoff = time.Second
+)
+
+// ErrLocalCommandNotFound occurs when the local mitmproxy is not installed.
+var ErrLocalCommandNotFound = errors.New("the local proxy command was not found, install mitmproxy or set --command-args")
+
+// NewLocal initializes a new local Tap. Its sidecar only tunnels inbound
+// connections to a mitmproxy running on the machine of the user.
+func NewLocal(c kubernetes.Interface, p ProxyOptions) Tap {
+	return &Local{
+		Raw: Raw{
+			Protos:    []Protocol{protocolHTTP},
+			Client:    c,
+			ProxyOpts: p,
+		},
+	}
+}
+
+// Local runs mitmproxy on the machine of the user, so local addons, config
+// and flows can be used. The sidecar hands every inbound connection to an
+// idle tunnel the client holds open through a port-forward, and mitmproxy
+// reaches the tapped container through a second port-forward.
+type Local struct {
+	Raw
+}
+
+// Sidecar provides a relay sidecar in tunnel mode. The upstream is recorded
+// in its environment so the client can reach the tapped container on attach.
+func (l *Local) Sidecar(_ string) v1.Container {
+	c := NewRawSidecarContainer(protocolTCP)
+	c.Ports = append(c.Ports, v1.ContainerPort{
+		Name:          mittensTunnelPortName,
+		ContainerPort: mittensTunnelPort,
+		Protocol:      v1.ProtocolTCP,
+	})
+	scheme := "http"
+	if l.ProxyOpts.UpstreamHTTPS {
+		scheme = "https"
+	}
+	c.Env = []v1.EnvVar{
+		{
+			Name:  "MITTENS_PROTOCOL",
+			Value: "tunnel",
+		},
+		{
+			Name:  "MITTENS_TUNNEL_LISTEN",
+			Value: ":" + strconv.Itoa(mittensTunnelPort),
+		},
+		{
+			Name:  "MITTENS_UPSTREAM",
+			Value: l.ProxyOpts.upstream(),
+		},
+		{
+			Name:  "MITTENS_UPSTREAM_SCHEME",
+			Value: scheme,
+		},
+	}
+	return c
+}
+
+// String is called to conveniently print the type of Tap to stdout.
+func (l *Local) String() string {
+	return "local mitmproxy"
+}
+
+// localUpstream returns the scheme and port of the tapped container from
+// the environment of the sidecar.
+func localUpstream(pod v1.Pod) (scheme string, port int, err error) {
+	env, ok := sidecarEnv(pod)
+	if !ok {
+		return "", 0, ErrMittensPodNoMatch
+	}
+	var upstream string
+	for _, e := range env {
+		switch e.Name {
+		case "MITTENS_UPSTREAM":
+			upstream = e.Value
+		case "MITTENS_UPSTREAM_SCHEME":
+			scheme = e.Value
+		}
+	}
+	_, p, err := net.SplitHostPort(upstream)
+	if err != nil {
+		return "", 0, fmt.Errorf("error reading the upstream of the sidecar: %w", err)
+	}
+	port, err = strconv.Atoi(p)
+	if err != nil {
+		return "", 0, fmt.Errorf("error reading the upstream of the sidecar: %w", err)
+	}
+	if scheme == "" {
+		scheme = "http"
+	}
+	return scheme, port, nil
+}
+
+// serveLocal runs the local proxy command, feeding it the connections of
+// the tapped Service through the sidecar. It blocks until the command exits.
+func serveLocal(cmd *cobra.Command, client kubernetes.Interface, config *rest.Config, pod v1.Pod, localCommand []string) error {
+	if len(localCommand) == 0 {
+		localCommand = strings.Fields(defaultCommandArgs)
+	}
+	if _, err := exec.LookPath(localCommand[0]); err != nil {
+		return fmt.Errorf("%w: %q", ErrLocalCommandNotFound, localCommand[0])
+	}
+	scheme, upstreamPort, err := localUpstream(pod)
+	if err != nil {
+		return err
+	}
+
+	ctx := cmd.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	readyCh := make(chan struct{})
+	ports := []string{
+		fmt.Sprintf("0:%d", mittensTunnelPort),
+		fmt.Sprintf("0:%d", upstreamPort),
+	}
+	fw, err := newPortForwarder(client, config, pod, ports, stopCh, readyCh, cmd.ErrOrStderr())
+	if err != nil {
+		return err
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- fw.ForwardPorts()
+	}()
+	select {
+	case <-readyCh:
+	case err := <-errCh:
+		return fmt.Errorf("error forwarding to the sidecar: %w", err)
+	}
+	forwarded, err := fw.GetPorts()
+	if err != nil {
+		return err
+	}
+	listenPort, err := freeLocalPort()
+	if err != nil {
+		return err
+	}
+
+	tunnelAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(forwarded[0].Local)))
+	proxyAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(listenPort))
+	runTunnels(ctx, tunnelAddr, proxyAddr, localTunnelPoolSize)
+
+	args := append([]string{}, localCommand[1:]...)
+	args = append(args,
+		"--mode", fmt.Sprintf("reverse:%s://127.0.0.1:%d", scheme, forwarded[1].Local),
+		"--listen-host", "127.0.0.1",
+		"--listen-port", strconv.Itoa(listenPort),
+		"--set", "keep_host_header=true",
+		"--set", "ssl_insecure=true",
+	)
+	proxyCmd := exec.CommandContext(ctx, localCommand[0], args...)
+	proxyCmd.Stdin = os.Stdin
+	proxyCmd.Stdout = os.Stdout
+	proxyCmd.Stderr = os.Stderr
+	_, _ = fmt.Fprintf(cmd.OutOrStdout(), "Starting %s locally, traffic is tunneled through Pod %q\n", localCommand[0], pod.Name)
+	err = proxyCmd.Run()
+	if ctx.Err() != nil {
+		// interrupted, the proxy was stopped on purpose
+		return nil
+	}
+	return err
+}
+
+// freeLocalPort returns a free port on the loopback interface.
+func freeLocalPort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+// runTunnels keeps size idle tunnels open to the sidecar at tunnelAddr until
+// ctx is done, piping every paired tunnel to the proxy at proxyAddr.
+func runTunnels(ctx context.Context, tunnelAddr, proxyAddr string, size int) {
+	for range size {
+		go tunnelWorker(ctx, tunnelAddr, proxyAddr)
+	}
+}
+
+// tunnelWorker holds one idle tunnel open and replaces it as soon as it is paired.
+func tunnelWorker(ctx context.Context, tunnelAddr, proxyAddr string) {
+	for ctx.Err() == nil {
+		tunnel, err := net.Dial("tcp", tunnelAddr)
+		if err != nil {
+			sleepCtx(ctx, localTunnelBackoff)
+			continue
+		}
+		release := context.AfterFunc(ctx, func() {
+			tunnel.Close()
+		})
+		ready := make([]byte, 1)
+		if _, err := io.ReadFull(tunnel, ready); err != nil || ready[0] != localTunnelReady {
+			// the sidecar is not up yet or the forward dropped
+			release()
+			tunnel.Close()
+			sleepCtx(ctx, localTunnelBackoff)
+			continue
+		}
+		go func() {
+			defer release()
+			proxy, err := net.Dial("tcp", proxyAddr)
+			if err != nil {
+				tunnel.Close()
+				return
+			}
+			pipeConns(tunnel, proxy)
+		}()
+	}
+}
+
+// pipeConns copies between a and b until both directions are done.
+func pipeConns(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	cp := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		// propagate the half-close so request/response protocols finish cleanly
+		if tc, ok := dst.(*net.TCPConn); ok {
+			_ = tc.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
+
+// sleepCtx sleeps for d or until ctx is done.
+func sleepCtx(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+func Test_TapLocal(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Protocol string
+		Err      error
+	}{
+		{"http", "http", nil},
+		{"tcp", "tcp", ErrUINotSupported},
+		{"grpc", "grpc", ErrUINotSupported},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			fakeClient := fakeClientUntappedSimple()
+			testViper := viper.New()
+			testViper.Set("proxyPort", 80)
+			testViper.Set("namespace", "default")
+			testViper.Set("protocol", tc.Protocol)
+			testViper.Set("ui", uiLocal)
+			testViper.Set("proxyImage", defaultImageHTTP)
+			testViper.Set("commandArgs", defaultCommandArgs)
+			cmd := &cobra.Command{}
+			cmd.SetOutput(ioutil.Discard)
+			err := NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+			if tc.Err != nil {
+				require.True(errors.Is(err, tc.Err), "expected (%v), got (%v)", tc.Err, err)
+				return
+			}
+			require.Nil(err)
+
+			dpl, err := fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "sample-deployment", metav1.GetOptions{})
+			require.Nil(err)
+			var sidecar v1.Container
+			for _, c := range dpl.Spec.Template.Spec.Containers {
+				if c.Name == mittensContainerName {
+					sidecar = c
+				}
+			}
+			require.Equal(defaultImageRaw, sidecar.Image)
+			require.Empty(sidecar.Args, "the local command must not be passed to the sidecar")
+			require.Contains(sidecar.Env, v1.EnvVar{Name: "MITTENS_PROTOCOL", Value: "tunnel"})
+			require.Len(sidecar.Ports, 2)
+			require.Equal(int32(mittensTunnelPort), sidecar.Ports[1].ContainerPort)
+			require.Empty(dpl.Spec.Template.Spec.Volumes, "the tunnel does not need a ConfigMap")
+
+			// the tapped upstream is recoverable from the Pod for attach
+			scheme, port, err := localUpstream(v1.Pod{Spec: dpl.Spec.Template.Spec})
+			require.Nil(err)
+			require.Equal("http", scheme)
+			require.Equal(8080, port)
+
+			svc, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+			require.Nil(err)
+			require.Equal(uiLocal, tappedUI(svc))
+
+			require.Nil(NewUntapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+			svc, err = fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+			require.Nil(err)
+			require.NotContains(svc.GetAnnotations(), annotationUI)
+		})
+	}
+}
+
+func Test_TunnelWorker(t *testing.T) {
+	require := require.New(t)
+
+	// the local proxy answers every request
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	defer proxy.Close()
+	go func() {
+		for {
+			conn, err := proxy.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.ReadAll(conn)
+				_, _ = conn.Write([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+			}()
+		}
+	}()
+
+	// the sidecar end of the port-forward
+	sidecar, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	defer sidecar.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runTunnels(ctx, sidecar.Addr().String(), proxy.Addr().String(), 1)
+
+	tunnel, err := sidecar.Accept()
+	require.Nil(err)
+	defer tunnel.Close()
+	_, err = tunnel.Write(append([]byte{localTunnelReady}, "GET / HTTP/1.1\r\n\r\n"...))
+	require.Nil(err)
+	require.Nil(tunnel.(*net.TCPConn).CloseWrite())
+	reply, err := io.ReadAll(tunnel)
+	require.Nil(err)
+	require.Equal("HTTP/1.1 204 No Content\r\n\r\n", string(reply))
+
+	// a paired tunnel is replaced right away
+	next, err := sidecar.Accept()
+	require.Nil(err)
+	defer next.Close()
+}
@@ -15,12 +15,14 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 var (
@@ -34,10 +36,20 @@ const (
 	annotationOriginalTargetPort = "mittens.io/original-port"
 	annotationConfigMap          = "mittens.io/proxy-config"
 	annotationIsTapped           = "mittens.io/tapped"
+	annotationUI                 = "mittens.io/ui"
+	annotationProtocol           = "mittens.io/protocol"
+	annotationStrategy           = "mittens.io/strategy"
+	annotationSidecar            = "mittens.io/sidecar"
+	annotationOriginalSelector   = "mittens.io/original-selector"
+	annotationCanaryPort         = "mittens.io/canary-port"
+	annotationExpiresAt          = "mittens.io/expires-at"
+	annotationTappedAt           = "mittens.io/tapped-at"
 
 	defaultImageHTTP = "ghcr.io/lappihuan/mittens-mitmproxy:latest"
 	defaultImageRaw  = "ghcr.io/lappihuan/mittens-raw:latest"
 	defaultImageGRPC = "ghcr.io/lappihuan/mittens-grpc:latest"
+
+	defaultCommandArgs = "mitmproxy"
 )
 
 // die exit the program, printing the error.
@@ -46,19 +58,41 @@ func die(args ...any) {
 	os.Exit(1)
 }
 
+// targetNamespace returns the namespace a command works in, the --namespace
+// flag or the namespace of the kubeconfig context, see main. Like kubectl,
+// it falls back to "default".
+func targetNamespace(viper *viper.Viper) string {
+	if namespace := viper.GetString("namespace"); namespace != "" {
+		return namespace
+	}
+	return "default"
+}
+
+// printTarget prints the kubeconfig context and namespace a command is about
+// to change, all namespaces if namespace is empty.
+func printTarget(out io.Writer, viper *viper.Viper, namespace string) {
+	target := fmt.Sprintf("namespace %q", namespace)
+	if namespace == "" {
+		target = "all namespaces"
+	}
+	if kubeContext := viper.GetString("kubeContext"); kubeContext != "" {
+		_, _ = fmt.Fprintf(out, "Using context %q, %s\n", kubeContext, target)
+		return
+	}
+	_, _ = fmt.Fprintf(out, "Using %s\n", target)
+}
+
 func main() {
 	exiter := &Exit{}
 
 	kubernetesConfigFlags := genericclioptions.NewConfigFlags(false)
 
-	config, err := kubernetesConfigFlags.ToRESTConfig()
-	if err != nil {
-		die(err)
-	}
-	client, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		die(err)
-	}
+	// The client is created once flags are parsed so that --context,
+	// --kubeconfig, --as and friends are honored.
+	var (
+		config *rest.Config
+		client kubernetes.Interface
+	)
 
 	rootCmd := &cobra.Command{
 		Use:   "kubectl mittens [SERVICE] [OPTIONS]",
@@ -76,12 +110,93 @@ Original project (kubetap):
 		Example: ` Proxy a Service with mitmproxy:
    kubectl mittens -n demo -p443 --https sample-service
 
+ Relay and hexdump a raw TCP Service:
+   kubectl mittens -n demo -p6379 --protocol tcp redis
+
+ Log DNS queries to a UDP Service:
+   kubectl mittens -n kube-system -p53 --protocol udp --decode dns kube-dns
+
+ Decode a gRPC Service with a descriptor set:
+   kubectl mittens -n demo -p9090 --protocol grpc --proto api.protoset grpc-service
+
+ Inspect traffic in the browser with mitmweb:
+   kubectl mittens -n demo --ui web --open sample-service
+
+ Run mitmproxy locally with your own addons, tunneling traffic from the cluster:
+   kubectl mittens -n demo --ui local --command-args "mitmproxy -s addon.py" sample-service
+
+ Tap running Pods through an ephemeral container, without restarting them:
+   kubectl mittens -n demo --strategy ephemeral sample-service
+
+ Tap through a separate proxy Deployment, leaving an operator-owned workload untouched:
+   kubectl mittens -n demo --strategy standalone sample-service
+
+ Intercept the traffic of a single canary Pod instead of every replica:
+   kubectl mittens -n demo --replicas 1 sample-service
+
+ Show what a tap would change without changing anything:
+   kubectl mittens -n demo --dry-run=server sample-service
+
+ Tap for at most 15 minutes, even if the session is left open:
+   kubectl mittens -n demo --duration 15m sample-service
+
+ Tap in the background and attach later:
+   kubectl mittens -n demo --detach sample-service
+   kubectl mittens attach -n demo sample-service
+
+ Print a Role with the permissions needed to tap a Service:
+   kubectl mittens can-i -n demo sample-service > role.yaml
+
+ List active taps in all namespaces:
+   kubectl mittens list -A
+
+ Remove a tap left behind by a crashed session:
+   kubectl mittens untap -n demo sample-service
+
+ Revert every tap in all namespaces:
+   kubectl mittens cleanup --all-namespaces
+
  Show mittens version:
    kubectl mittens version`,
 		SilenceUsage: true,
 	}
 
 	kubernetesConfigFlags.AddFlags(rootCmd.PersistentFlags())
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		// commands that never talk to the cluster work without a kubeconfig
+		if cmd.Name() == "version" || cmd.Name() == "help" || (cmd == rootCmd && len(args) == 0) {
+			return nil
+		}
+		// protect rules, see guardTap
+		if err := readConfig(viper.GetViper()); err != nil {
+			return err
+		}
+		var err error
+		config, err = kubernetesConfigFlags.ToRESTConfig()
+		if err != nil {
+			return err
+		}
+		client, err = kubernetes.NewForConfig(config)
+		if err != nil {
+			return err
+		}
+		// without --namespace, the namespace of the kubeconfig context is used, as by kubectl
+		loader := kubernetesConfigFlags.ToRawKubeConfigLoader()
+		namespace, _, err := loader.Namespace()
+		if err != nil {
+			return err
+		}
+		viper.Set("namespace", namespace)
+		// in-cluster, e.g. for the janitor, there is no kubeconfig context
+		if rawConfig, err := loader.RawConfig(); err == nil {
+			kubeContext := rawConfig.CurrentContext
+			if *kubernetesConfigFlags.Context != "" {
+				kubeContext = *kubernetesConfigFlags.Context
+			}
+			viper.Set("kubeContext", kubeContext)
+		}
+		return nil
+	}
 	if err := viper.BindPFlags(rootCmd.PersistentFlags()); err != nil {
 		die(err)
 	}
@@ -90,12 +205,113 @@ Original project (kubetap):
 	versionCmd := NewVersionCmd()
 	rootCmd.AddCommand(versionCmd)
 
+	attachCmd := &cobra.Command{
+		Use:   "attach SERVICE",
+		Short: "Reconnect to the proxy session of a tapped Service",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := bindAttachFlags(cmd, args); err != nil {
+				return err
+			}
+			return NewAttachCommand(client, config, viper.GetViper())(cmd, args)
+		},
+	}
+	attachCmd.Flags().Int("web-port", 0, "local port for the web UI (a free port is picked if 0)")
+	attachCmd.Flags().Bool("open", false, "open the web UI in a browser")
+	attachCmd.Flags().String("command-args", defaultCommandArgs, "local proxy command for taps with --ui local")
+	attachCmd.Flags().String("janitor-image", defaultImageJanitor, "image of the janitor reverting the tap if mittens is killed")
+	attachCmd.Flags().Duration("timeout", defaultTimeout, "how long to wait for the proxy Pod to become ready (0 waits forever)")
+	rootCmd.AddCommand(attachCmd)
+
+	untapCmd := &cobra.Command{
+		Use:   "untap SERVICE",
+		Short: "Remove the proxy from a tapped Service",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return NewUntapCommand(client, config, viper.GetViper())(cmd, args)
+		},
+	}
+	rootCmd.AddCommand(untapCmd)
+
+	cleanupCmd := &cobra.Command{
+		Use:   "cleanup",
+		Short: "Revert every tap and remove leftover mittens resources",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := bindCleanupFlags(cmd, args); err != nil {
+				return err
+			}
+			return NewCleanupCommand(client, config, viper.GetViper())(cmd, args)
+		},
+	}
+	cleanupCmd.Flags().BoolP("all-namespaces", "A", false, "clean up taps in all namespaces")
+	cleanupCmd.Flags().BoolP("yes", "y", false, "do not ask for confirmation")
+	rootCmd.AddCommand(cleanupCmd)
+
+	listCmd := &cobra.Command{
+		Use:     "list",
+		Aliases: []string{"ls"},
+		Short:   "List active taps",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := bindListFlags(cmd, args); err != nil {
+				return err
+			}
+			return NewListCommand(client, viper.GetViper())(cmd, args)
+		},
+	}
+	listCmd.Flags().BoolP("all-namespaces", "A", false, "list taps in all namespaces")
+	listCmd.Flags().StringP("output", "o", outputTable, "output format. One of: [ table, json, yaml ]")
+	rootCmd.AddCommand(listCmd)
+
+	janitorCmd := &cobra.Command{
+		Use:    "janitor SERVICE",
+		Short:  "Revert a tapped Service once its session Lease expires",
+		Hidden: true,
+		Args:   cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return NewJanitorCommand(client, viper.GetViper())(cmd, args)
+		},
+	}
+	rootCmd.AddCommand(janitorCmd)
+
+	canICmd := &cobra.Command{
+		Use:   "can-i [SERVICE]",
+		Short: "Check the permissions a tap needs and print a Role granting them",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := bindCanIFlags(cmd, args); err != nil {
+				return err
+			}
+			return NewCanICommand(client, viper.GetViper())(cmd, args)
+		},
+	}
+	canICmd.Flags().String("strategy", strategyTemplate, "strategy of the tap. Supported strategies: [ template, ephemeral, standalone ]")
+	canICmd.Flags().String("replicas", "", "check the permissions to tap a canary of this many Pods, e.g. 1 or 10%")
+	canICmd.Flags().String("ui", uiTUI, "mitmproxy UI of the tap. Supported UIs: [ tui, web, local ]")
+	rootCmd.AddCommand(canICmd)
+
 	// Add flags to root command for direct usage
 	rootCmd.Flags().StringP("port", "p", "", "target Service port (auto-detected if not provided)")
 	rootCmd.Flags().StringP("image", "i", defaultImageHTTP, "image to run in proxy container")
 	rootCmd.Flags().Bool("https", false, "enable if target listener uses HTTPS")
-	rootCmd.Flags().String("command-args", "mitmproxy", "specify command arguments for the proxy sidecar container")
-	rootCmd.Flags().String("protocol", "http", "specify a protocol. Supported protocols: [ http ]")
+	rootCmd.Flags().String("command-args", defaultCommandArgs, "specify command arguments for the proxy sidecar container")
+	rootCmd.Flags().String("protocol", "http", "specify a protocol. Supported protocols: [ http, tcp, udp, grpc ]")
+	rootCmd.Flags().String("decode", "", "decode UDP payloads. Supported decoders: [ dns ]")
+	rootCmd.Flags().String("ui", uiTUI, "specify the mitmproxy UI. Supported UIs: [ tui, web, local ]")
+	rootCmd.Flags().Int("web-port", 0, "local port for the web UI (a free port is picked if 0)")
+	rootCmd.Flags().Bool("open", false, "open the web UI in a browser")
+	rootCmd.Flags().String("strategy", strategyTemplate, "how the proxy is added in front of the Pods. Supported strategies: [ template, ephemeral, standalone ]")
+	rootCmd.Flags().String("replicas", "", "only tap a canary of this many Pods, or a percentage of the running Pods, e.g. 1 or 10%")
+	rootCmd.Flags().BoolP("detach", "d", false, "tap the Service and exit without attaching, the tap stays in place")
+	rootCmd.Flags().String("dry-run", dryRunNone, "only print the objects the tap would change. One of: [ none, client, server ]")
+	rootCmd.Flags().StringP("output", "o", "", "output format. json streams the phases of the tap as JSON events, diff and yaml print --dry-run. One of: [ json, diff, yaml ]")
+	rootCmd.Flags().Duration("duration", 0, "remove the tap after this long, e.g. 15m, even if the session is still attached (0 keeps it until untapped)")
+	rootCmd.Flags().String("janitor-image", defaultImageJanitor, "image of the janitor reverting the tap if mittens is killed")
+	rootCmd.Flags().BoolP("yes", "y", false, "tap Services protected by the mittens config without typing their name")
+	rootCmd.Flags().Duration("timeout", defaultTimeout, "how long to wait for the proxy to become ready (0 waits forever)")
+	rootCmd.Flags().Bool("preflight", true, "check that all permissions the tap needs are granted before changing anything")
+	rootCmd.Flags().StringSlice("proto", nil, ".proto files or FileDescriptorSets used to decode gRPC messages (server reflection is used if omitted)")
 
 	// Handle root command with service as positional arg (kubectl mittens <service>)
 	rootCmd.RunE = func(cmd *cobra.Command, args []string) error {
@@ -134,6 +350,106 @@ func bindTapFlags(cmd *cobra.Command, _ []string) error {
 	if err := viper.BindPFlag("protocol", cmd.Flags().Lookup("protocol")); err != nil {
 		return err
 	}
+	if err := viper.BindPFlag("protoFiles", cmd.Flags().Lookup("proto")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("decode", cmd.Flags().Lookup("decode")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("detach", cmd.Flags().Lookup("detach")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("ui", cmd.Flags().Lookup("ui")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("strategy", cmd.Flags().Lookup("strategy")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("replicas", cmd.Flags().Lookup("replicas")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("janitorImage", cmd.Flags().Lookup("janitor-image")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("duration", cmd.Flags().Lookup("duration")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("dryRun", cmd.Flags().Lookup("dry-run")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("output", cmd.Flags().Lookup("output")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("timeout", cmd.Flags().Lookup("timeout")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("preflight", cmd.Flags().Lookup("preflight")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("yes", cmd.Flags().Lookup("yes")); err != nil {
+		return err
+	}
+	return bindWebFlags(cmd, nil)
+}
+
+// bindAttachFlags is a workaround for https://github.com/spf13/viper/issues/233
+func bindAttachFlags(cmd *cobra.Command, args []string) error {
+	if err := viper.BindPFlag("commandArgs", cmd.Flags().Lookup("command-args")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("janitorImage", cmd.Flags().Lookup("janitor-image")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("timeout", cmd.Flags().Lookup("timeout")); err != nil {
+		return err
+	}
+	return bindWebFlags(cmd, args)
+}
+
+// bindWebFlags is a workaround for https://github.com/spf13/viper/issues/233
+func bindWebFlags(cmd *cobra.Command, _ []string) error {
+	if err := viper.BindPFlag("webPort", cmd.Flags().Lookup("web-port")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("openBrowser", cmd.Flags().Lookup("open")); err != nil {
+		return err
+	}
+	return nil
+}
+
+// bindCleanupFlags is a workaround for https://github.com/spf13/viper/issues/233
+func bindCleanupFlags(cmd *cobra.Command, _ []string) error {
+	if err := viper.BindPFlag("allNamespaces", cmd.Flags().Lookup("all-namespaces")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("yes", cmd.Flags().Lookup("yes")); err != nil {
+		return err
+	}
+	return nil
+}
+
+// bindListFlags is a workaround for https://github.com/spf13/viper/issues/233
+func bindListFlags(cmd *cobra.Command, _ []string) error {
+	if err := viper.BindPFlag("allNamespaces", cmd.Flags().Lookup("all-namespaces")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("output", cmd.Flags().Lookup("output")); err != nil {
+		return err
+	}
+	return nil
+}
+
+// bindCanIFlags is a workaround for https://github.com/spf13/viper/issues/233
+func bindCanIFlags(cmd *cobra.Command, _ []string) error {
+	if err := viper.BindPFlag("strategy", cmd.Flags().Lookup("strategy")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("replicas", cmd.Flags().Lookup("replicas")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("ui", cmd.Flags().Lookup("ui")); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -16,9 +16,13 @@ package main
 import (
 	"bytes"
 	"io/ioutil"
+	"strings"
 	"testing"
 
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/rest"
 )
 
 type MockExiter struct {
@@ -40,3 +44,39 @@ func Test_VersionCmd(t *testing.T) {
 	require.Nil(err)
 	require.Contains(string(out), "commit: ", "versionCmd does not produce expected output")
 }
+
+func Test_PrintTarget(t *testing.T) {
+	tests := []struct {
+		Name        string
+		KubeContext string
+		Namespace   string
+		Expected    string
+	}{
+		{"context", "kind-dev", "demo", "Using context \"kind-dev\", namespace \"demo\"\n"},
+		{"in_cluster", "", "demo", "Using namespace \"demo\"\n"},
+		{"all_namespaces", "kind-dev", "", "Using context \"kind-dev\", all namespaces\n"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			testViper := viper.New()
+			testViper.Set("kubeContext", tc.KubeContext)
+			b := bytes.NewBufferString("")
+			printTarget(b, testViper, tc.Namespace)
+			require.Equal(t, tc.Expected, b.String())
+		})
+	}
+}
+
+func Test_TapPrintsTarget(t *testing.T) {
+	require := require.New(t)
+	testViper := viper.New()
+	testViper.Set("kubeContext", "kind-dev")
+	testViper.Set("proxyPort", 80)
+	testViper.Set("proxyImage", defaultImageHTTP)
+	testViper.Set("commandArgs", defaultCommandArgs)
+	b := bytes.NewBufferString("")
+	cmd := &cobra.Command{}
+	cmd.SetOutput(b)
+	require.Nil(NewTapCommand(fakeClientUntappedSimple(), &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+	require.True(strings.HasPrefix(b.String(), "Using context \"kind-dev\", namespace \"default\"\n"), "the target is printed before the tap: %s", b.String())
+}
@@ -19,7 +19,6 @@ import (
 	"fmt"
 	"os"
 
-	k8sappsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
@@ -31,6 +30,7 @@ var (
 	// data volume names must have a "mittens" prefix to be
 	// properly removed during untapping.
 	mitmproxyDataVolName = "mittens-mitmproxy-data"
+	mitmproxySessionName = "mitmproxy"
 	mitmproxyConfigFile  = "config.yaml"
 	mitmproxyBaseConfig  = `listen_port: 7777
 ssl_insecure: true
@@ -124,26 +124,33 @@ type Mitmproxy struct {
 }
 
 // Sidecar provides a proxy sidecar container.
-func (m *Mitmproxy) Sidecar(deploymentName string) v1.Container {
+func (m *Mitmproxy) Sidecar(workloadName string) v1.Container {
 	c := MitmproxySidecarContainer
-	c.VolumeMounts[0].Name = mittensConfigMapPrefix + deploymentName
+	c.VolumeMounts[0].Name = mittensConfigMapPrefix + workloadName
+	if m.ProxyOpts.UI == uiWeb {
+		c.Ports = append(append([]v1.ContainerPort{}, c.Ports...), v1.ContainerPort{
+			Name:          mittensWebPortName,
+			ContainerPort: mitmwebPort,
+			Protocol:      v1.ProtocolTCP,
+		})
+	}
 	return c
 }
 
-// PatchDeployment provides any necessary tweaks to the deployment after the sidecar is added.
-func (m *Mitmproxy) PatchDeployment(deployment *k8sappsv1.Deployment) {
-	deployment.Spec.Template.Spec.Volumes = append(deployment.Spec.Template.Spec.Volumes, v1.Volume{
-		Name: mittensConfigMapPrefix + deployment.Name,
+// PatchWorkload provides any necessary tweaks to the pod template after the sidecar is added.
+func (m *Mitmproxy) PatchWorkload(tmpl *v1.PodTemplateSpec, workloadName string) {
+	tmpl.Spec.Volumes = append(tmpl.Spec.Volumes, v1.Volume{
+		Name: mittensConfigMapPrefix + workloadName,
 		VolumeSource: v1.VolumeSource{
 			ConfigMap: &v1.ConfigMapVolumeSource{
 				LocalObjectReference: v1.LocalObjectReference{
-					Name: mittensConfigMapPrefix + deployment.Name,
+					Name: mittensConfigMapPrefix + workloadName,
 				},
 			},
 		},
 	})
 	// add emptydir to resolve permission problems, and to down the road export dumps
-	deployment.Spec.Template.Spec.Volumes = append(deployment.Spec.Template.Spec.Volumes, v1.Volume{
+	tmpl.Spec.Volumes = append(tmpl.Spec.Volumes, v1.Volume{
 		Name: mitmproxyDataVolName,
 		VolumeSource: v1.VolumeSource{
 			EmptyDir: &v1.EmptyDirVolumeSource{},
@@ -151,6 +158,16 @@ func (m *Mitmproxy) PatchDeployment(deployment *k8sappsv1.Deployment) {
 	})
 }
 
+// AttachCommand attaches to the tmux session running mitmproxy.
+func (m *Mitmproxy) AttachCommand() []string {
+	return []string{"tmux", "attach-session", "-t", mitmproxySessionName}
+}
+
+// SessionCommand checks whether the tmux session running mitmproxy is alive.
+func (m *Mitmproxy) SessionCommand() []string {
+	return []string{"tmux", "has-session", "-t", mitmproxySessionName}
+}
+
 // Protocols returns a slice of protocols supported by Mitmproxy, currently only HTTP.
 func (m *Mitmproxy) Protocols() []Protocol {
 	return m.Protos
@@ -167,11 +184,11 @@ func (m *Mitmproxy) ReadyEnv() error {
 	// Create the ConfigMap based the options we're configuring mitmproxy with
 	if err := createMitmproxyConfigMap(configmapsClient, m.ProxyOpts); err != nil {
 		// If the service hasn't been tapped but still has a configmap from a previous
-		// run (which can happen if the deployment borks and "tap off" isn't explicitly run,
+		// run (which can happen if the workload borks and "tap off" isn't explicitly run,
 		// delete the configmap and try again.
 		// This is mostly here to fix development environments that become broken during
 		// code testing.
-		_ = destroyMitmproxyConfigMap(configmapsClient, m.ProxyOpts.dplName)
+		_ = destroyMitmproxyConfigMap(configmapsClient, m.ProxyOpts.workloadName)
 		rErr := createMitmproxyConfigMap(configmapsClient, m.ProxyOpts)
 		if rErr != nil {
 			if errors.Is(rErr, os.ErrInvalid) {
@@ -186,7 +203,7 @@ func (m *Mitmproxy) ReadyEnv() error {
 // UnreadyEnv removes tap supporting configmap.
 func (m *Mitmproxy) UnreadyEnv() error {
 	configmapsClient := m.Client.CoreV1().ConfigMaps(m.ProxyOpts.Namespace)
-	return destroyMitmproxyConfigMap(configmapsClient, m.ProxyOpts.dplName)
+	return destroyMitmproxyConfigMap(configmapsClient, m.ProxyOpts.workloadName)
 }
 
 // createMitmproxyConfigMap creates a mitmproxy configmap based on the proxy mode, however currently
@@ -198,9 +215,9 @@ func createMitmproxyConfigMap(configmapClient corev1.ConfigMapInterface, proxyOp
 	switch proxyOpts.Mode {
 	case "reverse":
 		if proxyOpts.UpstreamHTTPS {
-			mitmproxyConfig = append([]byte(mitmproxyBaseConfig), []byte("mode:\n  - reverse:https://127.0.0.1:"+proxyOpts.UpstreamPort)...)
+			mitmproxyConfig = append([]byte(mitmproxyBaseConfig), []byte("mode:\n  - reverse:https://"+proxyOpts.upstream())...)
 		} else {
-			mitmproxyConfig = append([]byte(mitmproxyBaseConfig), []byte("mode:\n  - reverse:http://127.0.0.1:"+proxyOpts.UpstreamPort)...)
+			mitmproxyConfig = append([]byte(mitmproxyBaseConfig), []byte("mode:\n  - reverse:http://"+proxyOpts.upstream())...)
 		}
 	case "regular":
 		// non-applicable
@@ -217,14 +234,24 @@ func createMitmproxyConfigMap(configmapClient corev1.ConfigMapInterface, proxyOp
 	default:
 		return errors.New("invalid proxy mode: \"" + proxyOpts.Mode + "\"")
 	}
+	if proxyOpts.Protocol == protocolGRPC {
+		mitmproxyConfig = append(mitmproxyConfig, grpcConfig(proxyOpts)...)
+	}
+	if proxyOpts.UI == uiWeb {
+		mitmproxyConfig = append(mitmproxyConfig, webConfig(proxyOpts)...)
+	}
 	cmData := make(map[string][]byte)
+	// descriptors are mounted next to the config for the gRPC addon to load
+	for name, data := range proxyOpts.ProtoFiles {
+		cmData[name] = data
+	}
 	cmData[mitmproxyConfigFile] = mitmproxyConfig
 	cm := v1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      mittensConfigMapPrefix + proxyOpts.dplName,
+			Name:      mittensConfigMapPrefix + proxyOpts.workloadName,
 			Namespace: proxyOpts.Namespace,
 			Annotations: map[string]string{
-				annotationConfigMap: configMapAnnotationPrefix + proxyOpts.dplName,
+				annotationConfigMap: configMapAnnotationPrefix + proxyOpts.workloadName,
 			},
 		},
 		BinaryData: cmData,
@@ -233,7 +260,7 @@ func createMitmproxyConfigMap(configmapClient corev1.ConfigMapInterface, proxyOp
 	if slen == 0 {
 		return os.ErrInvalid
 	}
-	ccm, err := configmapClient.Create(context.TODO(), &cm, metav1.CreateOptions{})
+	ccm, err := configmapClient.Create(context.TODO(), &cm, metav1.CreateOptions{FieldManager: fieldManager})
 	if err != nil {
 		return err
 	}
@@ -248,8 +275,8 @@ func createMitmproxyConfigMap(configmapClient corev1.ConfigMapInterface, proxyOp
 }
 
 // destroyMitmproxyConfigMap removes a mitmproxy ConfigMap from the environment.
-func destroyMitmproxyConfigMap(configmapClient corev1.ConfigMapInterface, deploymentName string) error {
-	if deploymentName == "" {
+func destroyMitmproxyConfigMap(configmapClient corev1.ConfigMapInterface, workloadName string) error {
+	if workloadName == "" {
 		return os.ErrInvalid
 	}
 	cms, err := configmapClient.List(context.TODO(), metav1.ListOptions{})
@@ -263,7 +290,7 @@ func destroyMitmproxyConfigMap(configmapClient corev1.ConfigMapInterface, deploy
 			continue
 		}
 		for k, v := range anns {
-			if k == annotationConfigMap && v == configMapAnnotationPrefix+deploymentName {
+			if k == annotationConfigMap && v == configMapAnnotationPrefix+workloadName {
 				targetConfigMapNames = append(targetConfigMapNames, cm.Name)
 			}
 		}
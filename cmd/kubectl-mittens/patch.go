@@ -0,0 +1,184 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// fieldManager owns the fields mittens sets on objects it does not own.
+const fieldManager = "mittens"
+
+var patchOptions = metav1.PatchOptions{FieldManager: fieldManager}
+
+// jsonPatchOp is an operation of an RFC 6902 JSON patch.
+type jsonPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// patchPodTemplate applies the changes mutate makes to the pod template of
+// a workload as a strategic merge patch, so containers, volumes and
+// annotations are added and removed by name and changes made by others
+// since the workload was fetched are kept.
+func patchPodTemplate(w Workload, mutate func(*v1.PodTemplateSpec)) error {
+	if err := w.Refresh(); err != nil {
+		return err
+	}
+	orig, err := json.Marshal(w.PodTemplate())
+	if err != nil {
+		return err
+	}
+	mutate(w.PodTemplate())
+	mod, err := json.Marshal(w.PodTemplate())
+	if err != nil {
+		return err
+	}
+	patch, err := strategicpatch.CreateTwoWayMergePatch(orig, mod, v1.PodTemplateSpec{})
+	if err != nil {
+		return fmt.Errorf("error creating %s patch: %w", w.Kind(), err)
+	}
+	if string(patch) == "{}" {
+		return nil
+	}
+	return w.Patch(types.StrategicMergePatchType, []byte(`{"spec":{"template":`+string(patch)+`}}`))
+}
+
+// patchService applies the changes mutate makes to a Service as a JSON
+// patch. The ports that are changed are tested first, so a concurrent change
+// to one of them fails the patch, which is then retried on a fresh copy.
+func patchService(svcClient corev1.ServiceInterface, svcName string, mutate func(*v1.Service) error) error {
+	return retry.OnError(retry.DefaultRetry, func(err error) bool {
+		// a failed test operation is reported as invalid
+		return apierrors.IsConflict(err) || apierrors.IsInvalid(err)
+	}, func() error {
+		svc, err := svcClient.Get(context.TODO(), svcName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		mod := svc.DeepCopy()
+		if err := mutate(mod); err != nil {
+			return err
+		}
+		ops := servicePatch(svc, mod)
+		if len(ops) == 0 {
+			return nil
+		}
+		patch, err := json.Marshal(ops)
+		if err != nil {
+			return err
+		}
+		_, err = svcClient.Patch(context.TODO(), svcName, types.JSONPatchType, patch, patchOptions)
+		return err
+	})
+}
+
+// servicePatch returns the JSON patch operations turning the annotations,
+// selector and ports of orig into those of mod. Strategic merge patches are
+// not used, as they merge Service ports on their number alone and confuse
+// ports sharing a number across protocols.
+func servicePatch(orig, mod *v1.Service) []jsonPatchOp {
+	ops := annotationsPatch(orig.GetAnnotations(), mod.GetAnnotations())
+	if !reflect.DeepEqual(orig.Spec.Selector, mod.Spec.Selector) {
+		switch {
+		case len(mod.Spec.Selector) == 0:
+			ops = append(ops, jsonPatchOp{Op: "remove", Path: "/spec/selector"})
+		case len(orig.Spec.Selector) == 0:
+			ops = append(ops, jsonPatchOp{Op: "add", Path: "/spec/selector", Value: mod.Spec.Selector})
+		default:
+			ops = append(ops, jsonPatchOp{Op: "replace", Path: "/spec/selector", Value: mod.Spec.Selector})
+		}
+	}
+	if len(orig.Spec.Ports) != len(mod.Spec.Ports) {
+		return append(ops,
+			jsonPatchOp{Op: "test", Path: "/spec/ports", Value: orig.Spec.Ports},
+			jsonPatchOp{Op: "replace", Path: "/spec/ports", Value: mod.Spec.Ports},
+		)
+	}
+	for i := range orig.Spec.Ports {
+		if reflect.DeepEqual(orig.Spec.Ports[i], mod.Spec.Ports[i]) {
+			continue
+		}
+		path := "/spec/ports/" + strconv.Itoa(i)
+		ops = append(ops,
+			jsonPatchOp{Op: "test", Path: path, Value: orig.Spec.Ports[i]},
+			jsonPatchOp{Op: "replace", Path: path, Value: mod.Spec.Ports[i]},
+		)
+	}
+	return ops
+}
+
+// annotationsPatch returns the JSON patch operations turning the annotations
+// orig into mod, key by key.
+func annotationsPatch(orig, mod map[string]string) []jsonPatchOp {
+	if len(orig) == 0 {
+		if len(mod) == 0 {
+			return nil
+		}
+		return []jsonPatchOp{{Op: "add", Path: "/metadata/annotations", Value: mod}}
+	}
+	keys := make([]string, 0, len(orig)+len(mod))
+	for k := range orig {
+		keys = append(keys, k)
+	}
+	for k := range mod {
+		if _, ok := orig[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var ops []jsonPatchOp
+	for _, k := range keys {
+		path := "/metadata/annotations/" + jsonPointerEscape(k)
+		o, inOrig := orig[k]
+		m, inMod := mod[k]
+		switch {
+		case !inMod:
+			ops = append(ops, jsonPatchOp{Op: "remove", Path: path})
+		case !inOrig:
+			ops = append(ops, jsonPatchOp{Op: "add", Path: path, Value: m})
+		case o != m:
+			ops = append(ops, jsonPatchOp{Op: "replace", Path: path, Value: m})
+		}
+	}
+	return ops
+}
+
+// jsonPointerEscape escapes a key for use in a JSON pointer, see RFC 6901.
+func jsonPointerEscape(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+// metadataMergePatch returns a merge patch setting the annotations and
+// labels of an object, keys set to nil are removed.
+func metadataMergePatch(anns, labels map[string]interface{}) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": anns, "labels": labels},
+	})
+}
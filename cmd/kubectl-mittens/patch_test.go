@@ -0,0 +1,145 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	k8sappsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func Test_ServicePatch(t *testing.T) {
+	tapped := func(svc *v1.Service) {
+		svc.Annotations[annotationStrategy] = strategyStandalone
+		svc.Spec.Ports[1].TargetPort = intstr.FromInt(mittensProxyListenPort)
+		svc.Spec.Selector = standaloneLabels(svc.Name)
+	}
+	tests := []struct {
+		Name     string
+		Orig     func(*v1.Service)
+		Mutate   func(*v1.Service)
+		Expected []jsonPatchOp
+	}{
+		{"unchanged", nil, func(*v1.Service) {}, nil},
+		{"tapped", nil, tapped, []jsonPatchOp{
+			{Op: "add", Path: "/metadata/annotations/mittens.io~1strategy", Value: strategyStandalone},
+			{Op: "replace", Path: "/spec/selector", Value: map[string]string{labelStandalone: "dns"}},
+			{Op: "test", Path: "/spec/ports/1", Value: v1.ServicePort{Port: 53, Protocol: v1.ProtocolUDP, TargetPort: intstr.FromInt(53)}},
+			{Op: "replace", Path: "/spec/ports/1", Value: v1.ServicePort{Port: 53, Protocol: v1.ProtocolUDP, TargetPort: intstr.FromInt(mittensProxyListenPort)}},
+		}},
+		{"no_annotations", func(svc *v1.Service) { svc.Annotations = nil }, func(svc *v1.Service) {
+			svc.Annotations = map[string]string{annotationProtocol: "udp"}
+		}, []jsonPatchOp{
+			{Op: "add", Path: "/metadata/annotations", Value: map[string]string{annotationProtocol: "udp"}},
+		}},
+		{"untapped", func(svc *v1.Service) {
+			svc.Annotations[annotationProtocol] = "udp"
+			svc.Annotations["keep"] = "old"
+		}, func(svc *v1.Service) {
+			delete(svc.Annotations, annotationProtocol)
+			svc.Annotations["keep"] = "new"
+		}, []jsonPatchOp{
+			{Op: "replace", Path: "/metadata/annotations/keep", Value: "new"},
+			{Op: "remove", Path: "/metadata/annotations/mittens.io~1protocol"},
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			orig := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "dns", Annotations: map[string]string{"my-annotation": "some-annotation"}},
+				Spec: v1.ServiceSpec{
+					Selector: map[string]string{"app": "dns"},
+					Ports: []v1.ServicePort{
+						{Port: 53, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(53)},
+						{Port: 53, Protocol: v1.ProtocolUDP, TargetPort: intstr.FromInt(53)},
+					},
+				},
+			}
+			if tc.Orig != nil {
+				tc.Orig(orig)
+			}
+			mod := orig.DeepCopy()
+			tc.Mutate(mod)
+			require.Equal(t, tc.Expected, servicePatch(orig, mod))
+		})
+	}
+}
+
+func Test_TapKeepsConcurrentChanges(t *testing.T) {
+	require := require.New(t)
+	fakeClient := fakeClientUntappedSimple()
+	// an autoscaler and a GitOps tool change the objects right before mittens patches them
+	replicas := int32(5)
+	fakeClient.PrependReactor("patch", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		obj, err := fakeClient.Tracker().Get(action.GetResource(), action.GetNamespace(), "sample-deployment")
+		if err != nil {
+			return true, nil, err
+		}
+		dpl := obj.(*k8sappsv1.Deployment)
+		dpl.Spec.Replicas = &replicas
+		return false, nil, fakeClient.Tracker().Update(action.GetResource(), dpl, action.GetNamespace())
+	})
+	fakeClient.PrependReactor("patch", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		obj, err := fakeClient.Tracker().Get(action.GetResource(), action.GetNamespace(), "sample-service")
+		if err != nil {
+			return true, nil, err
+		}
+		svc := obj.(*v1.Service)
+		svc.Annotations["synced-by"] = "gitops"
+		return false, nil, fakeClient.Tracker().Update(action.GetResource(), svc, action.GetNamespace())
+	})
+
+	testViper := viper.New()
+	testViper.Set("proxyPort", 80)
+	testViper.Set("namespace", "default")
+	testViper.Set("proxyImage", defaultImageHTTP)
+	testViper.Set("commandArgs", defaultCommandArgs)
+	cmd := &cobra.Command{}
+	cmd.SetOutput(ioutil.Discard)
+	require.Nil(NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+	require.Nil(NewUntapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+
+	dpl, err := fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "sample-deployment", metav1.GetOptions{})
+	require.Nil(err)
+	require.Equal(replicas, *dpl.Spec.Replicas)
+	require.Len(dpl.Spec.Template.Spec.Containers, 1)
+	svc, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+	require.Nil(err)
+	require.Equal("gitops", svc.Annotations["synced-by"])
+	require.Equal(simpleService.Spec.Ports, svc.Spec.Ports)
+
+	// objects mittens does not own are only ever patched, as the mittens field manager
+	var patches int
+	for _, action := range fakeClient.Actions() {
+		switch a := action.(type) {
+		case k8stesting.UpdateAction:
+			require.NotContains([]string{"deployments", "services"}, a.GetResource().Resource, "unexpected update")
+		case k8stesting.PatchActionImpl:
+			patches++
+			require.Equal(fieldManager, a.PatchOptions.FieldManager)
+		}
+	}
+	require.Equal(4, patches)
+}
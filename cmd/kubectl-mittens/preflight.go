@@ -0,0 +1,374 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	k8sappsv1 "k8s.io/api/apps/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// canIRoleName is the name of the Role printed by the can-i command.
+const canIRoleName = "mittens"
+
+// ErrPermissionsMissing occurs when the preflight finds permissions a tap
+// needs that the user is not granted.
+var ErrPermissionsMissing = errors.New("permissions missing to tap, see kubectl mittens can-i for a Role granting them")
+
+// workloadResources are the resources of the workload kinds mittens taps.
+var workloadResources = map[string]string{
+	kindDeployment:  "deployments",
+	kindStatefulSet: "statefulsets",
+	kindDaemonSet:   "daemonsets",
+	kindReplicaSet:  "replicasets",
+}
+
+// permission is a verb on a resource mittens uses in the namespace of a tap.
+type permission struct {
+	Verb        string
+	Group       string
+	Resource    string
+	Subresource string
+	// Optional permissions are only needed for crash safety, taps work without them
+	Optional bool
+}
+
+// String formats the permission like kubectl auth can-i, e.g. "patch deployments.apps".
+func (p permission) String() string {
+	return p.Verb + " " + p.groupResource()
+}
+
+// groupResource returns the resource qualified by its API group, e.g. "deployments.apps".
+func (p permission) groupResource() string {
+	if p.Group != "" {
+		return p.resource() + "." + p.Group
+	}
+	return p.resource()
+}
+
+// resource returns the resource of the permission as written in a Role rule.
+func (p permission) resource() string {
+	if p.Subresource != "" {
+		return p.Resource + "/" + p.Subresource
+	}
+	return p.Resource
+}
+
+// requiredPermissions returns the permissions a tap with the given strategy
+// and UI needs. Without a workload, the permissions to tap any workload kind
+// are returned.
+func requiredPermissions(strategy, ui string, workload Workload) []permission {
+	perms := []permission{
+		{Verb: "get", Resource: "services"},
+		// Services are listed when the Namespace cannot be read, see hasNamespace
+		{Verb: "list", Resource: "services"},
+		{Verb: "patch", Resource: "services"},
+		// snapshots and proxy configuration
+		{Verb: "get", Resource: "configmaps"},
+		{Verb: "list", Resource: "configmaps"},
+		{Verb: "create", Resource: "configmaps"},
+		{Verb: "update", Resource: "configmaps"},
+		{Verb: "delete", Resource: "configmaps"},
+		// the proxy Pods are looked up to attach to them, watched until they
+		// are ready and while attached, see waitForMittensPod and watchProxyPod
+		{Verb: "get", Resource: "pods"},
+		{Verb: "list", Resource: "pods"},
+		{Verb: "watch", Resource: "pods"},
+		// events tell why the proxy Pods fail to start, see watchFailedCreate
+		{Verb: "list", Resource: "events"},
+		{Verb: "watch", Resource: "events"},
+	}
+	if strategy != strategyStandalone {
+		// the workload is resolved from the Service selectors
+		for _, kind := range []string{kindDeployment, kindStatefulSet, kindDaemonSet, kindReplicaSet} {
+			perms = append(perms, permission{Verb: "list", Group: k8sappsv1.GroupName, Resource: workloadResources[kind]})
+		}
+	}
+	switch strategy {
+	case strategyEphemeral:
+		perms = append(perms,
+			permission{Verb: "patch", Resource: "pods"},
+			permission{Verb: "patch", Resource: "pods", Subresource: "ephemeralcontainers"},
+			// untap stops the ephemeral proxies through exec
+			permission{Verb: "create", Resource: "pods", Subresource: "exec"},
+		)
+		// Pods that cannot take an ephemeral container are tapped by
+		// patching the pod template instead
+		perms = append(perms, templatePermissions(workload)...)
+	case strategyStandalone:
+		perms = append(perms,
+			permission{Verb: "create", Group: k8sappsv1.GroupName, Resource: "deployments"},
+			permission{Verb: "delete", Group: k8sappsv1.GroupName, Resource: "deployments"},
+			permission{Verb: "create", Resource: "services"},
+			permission{Verb: "delete", Resource: "services"},
+		)
+	case strategyCanary:
+		perms = append(perms,
+			permission{Verb: "create", Group: k8sappsv1.GroupName, Resource: "deployments"},
+			permission{Verb: "delete", Group: k8sappsv1.GroupName, Resource: "deployments"},
+		)
+	default:
+		perms = append(perms, templatePermissions(workload)...)
+	}
+	switch ui {
+	case uiWeb, uiLocal:
+		perms = append(perms, permission{Verb: "create", Resource: "pods", Subresource: "portforward"})
+	default:
+		perms = append(perms, permission{Verb: "create", Resource: "pods", Subresource: "exec"})
+	}
+	// the session Lease and the janitor, see guardSession, and the rules
+	// of the janitor Role, which may only grant what the user holds
+	perms = append(perms,
+		permission{Verb: "get", Group: coordinationv1.GroupName, Resource: "leases", Optional: true},
+		permission{Verb: "create", Group: coordinationv1.GroupName, Resource: "leases", Optional: true},
+		permission{Verb: "update", Group: coordinationv1.GroupName, Resource: "leases", Optional: true},
+		permission{Verb: "patch", Group: coordinationv1.GroupName, Resource: "leases", Optional: true},
+		permission{Verb: "delete", Group: coordinationv1.GroupName, Resource: "leases", Optional: true},
+		permission{Verb: "create", Group: k8sappsv1.GroupName, Resource: "deployments", Optional: true},
+		permission{Verb: "delete", Group: k8sappsv1.GroupName, Resource: "deployments", Optional: true},
+		permission{Verb: "create", Resource: "serviceaccounts", Optional: true},
+		permission{Verb: "create", Group: rbacv1.GroupName, Resource: "roles", Optional: true},
+		permission{Verb: "create", Group: rbacv1.GroupName, Resource: "rolebindings", Optional: true},
+	)
+	return dedupePermissions(perms)
+}
+
+// dedupePermissions drops repeated permissions, keeping the order of their
+// first occurrence. A permission both required and optional is required.
+func dedupePermissions(perms []permission) []permission {
+	type key struct{ verb, group, resource string }
+	index := map[key]int{}
+	var deduped []permission
+	for _, p := range perms {
+		k := key{p.Verb, p.Group, p.resource()}
+		if i, ok := index[k]; ok {
+			deduped[i].Optional = deduped[i].Optional && p.Optional
+			continue
+		}
+		index[k] = len(deduped)
+		deduped = append(deduped, p)
+	}
+	return deduped
+}
+
+// missingPermissions issues a SelfSubjectAccessReview for every permission in
+// a namespace and returns the ones that are not allowed.
+func missingPermissions(ctx context.Context, client kubernetes.Interface, namespace string, perms []permission) ([]permission, error) {
+	var missing []permission
+	for _, p := range perms {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace:   namespace,
+					Verb:        p.Verb,
+					Group:       p.Group,
+					Resource:    p.Resource,
+					Subresource: p.Subresource,
+				},
+			},
+		}
+		review, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if !review.Status.Allowed {
+			missing = append(missing, p)
+		}
+	}
+	return missing, nil
+}
+
+// templatePermissions returns the permissions to patch the pod template of
+// the workload and roll it out. Without a workload, the permissions for any
+// workload kind are returned.
+func templatePermissions(workload Workload) []permission {
+	kinds := []string{kindDeployment, kindStatefulSet, kindDaemonSet, kindReplicaSet}
+	if workload != nil {
+		kinds = []string{workload.Kind()}
+	}
+	var perms []permission
+	for _, kind := range kinds {
+		perms = append(perms,
+			permission{Verb: "get", Group: k8sappsv1.GroupName, Resource: workloadResources[kind]},
+			permission{Verb: "patch", Group: k8sappsv1.GroupName, Resource: workloadResources[kind]},
+		)
+	}
+	if workload == nil || !workload.RollsOnUpdate() {
+		// see rolloutWorkload
+		perms = append(perms, permission{Verb: "create", Resource: "pods", Subresource: "eviction"})
+	}
+	return perms
+}
+
+// preflightTap checks that the user holds every permission a tap of a
+// Service needs before anything is changed, and prints the missing ones.
+func preflightTap(ctx context.Context, out io.Writer, client kubernetes.Interface, svc *v1.Service, strategy, ui string) error {
+	var workload Workload
+	if strategy == strategyTemplate || strategy == strategyEphemeral {
+		var err error
+		workload, err = workloadFromSelectors(client, svc.Namespace, svc.Spec.Selector)
+		if err != nil {
+			// the tap fails on the same error before changing anything
+			return nil
+		}
+	}
+	missing, err := missingPermissions(ctx, client, svc.Namespace, requiredPermissions(strategy, ui, workload))
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "Warning: skipping the permission preflight, error reviewing access: %v\n", err)
+		return nil
+	}
+	var required, optional []permission
+	for _, p := range missing {
+		if p.Optional {
+			optional = append(optional, p)
+		} else {
+			required = append(required, p)
+		}
+	}
+	if len(optional) > 0 {
+		_, _ = fmt.Fprintf(out, "Warning: the tap is not reverted if mittens is killed, permissions missing in Namespace %q:\n", svc.Namespace)
+		for _, p := range optional {
+			_, _ = fmt.Fprintf(out, "  %s\n", p)
+		}
+	}
+	if len(required) > 0 {
+		_, _ = fmt.Fprintf(out, "Permissions missing in Namespace %q:\n", svc.Namespace)
+		for _, p := range required {
+			_, _ = fmt.Fprintf(out, "  %s\n", p)
+		}
+		return ErrPermissionsMissing
+	}
+	return nil
+}
+
+// NewCanICommand checks the permissions a tap needs in a namespace, printing
+// the result to stderr and a minimal Role granting them to stdout. With a
+// Service, only the permissions for its workload kind are included.
+func NewCanICommand(client kubernetes.Interface, viper *viper.Viper) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		namespace := targetNamespace(viper)
+		strategy := viper.GetString("strategy")
+		if strategy == "" {
+			strategy = strategyTemplate
+		}
+		if strategy != strategyTemplate && strategy != strategyEphemeral && strategy != strategyStandalone {
+			return fmt.Errorf("%w: %q", ErrStrategyNotSupported, strategy)
+		}
+		if viper.GetString("replicas") != "" {
+			if strategy != strategyTemplate {
+				return fmt.Errorf("%w: --replicas cannot be combined with strategy %q", ErrStrategyNotSupported, strategy)
+			}
+			strategy = strategyCanary
+		}
+		ui := viper.GetString("ui")
+		if ui == "" {
+			ui = uiTUI
+		}
+		if ui != uiTUI && ui != uiWeb && ui != uiLocal {
+			return fmt.Errorf("%w: %q", ErrUINotSupported, ui)
+		}
+		ctx := cmd.Context()
+		if ctx == nil {
+			ctx = context.Background()
+		}
+
+		var workload Workload
+		if len(args) > 0 && (strategy == strategyTemplate || strategy == strategyEphemeral) {
+			svc, err := client.CoreV1().Services(namespace).Get(ctx, args[0], metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			workload, err = workloadFromSelectors(client, namespace, svc.Spec.Selector)
+			if err != nil {
+				return fmt.Errorf("error resolving workload from Service selectors: %w", err)
+			}
+		}
+		perms := requiredPermissions(strategy, ui, workload)
+		missing, err := missingPermissions(ctx, client, namespace, perms)
+		if err != nil {
+			return fmt.Errorf("error reviewing access: %w", err)
+		}
+		printPermissions(cmd.ErrOrStderr(), perms, missing)
+
+		manifest, err := yaml.Marshal(permissionsRole(namespace, perms))
+		if err != nil {
+			return err
+		}
+		_, err = cmd.OutOrStdout().Write(manifest)
+		return err
+	}
+}
+
+// printPermissions writes a table of the permissions and whether they are granted.
+func printPermissions(out io.Writer, perms, missing []permission) {
+	denied := map[permission]bool{}
+	for _, p := range missing {
+		denied[p] = true
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "VERB\tRESOURCE\tALLOWED\tNEEDED FOR")
+	for _, p := range perms {
+		allowed := "yes"
+		if denied[p] {
+			allowed = "no"
+		}
+		neededFor := "tap"
+		if p.Optional {
+			neededFor = "crash safety"
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.Verb, p.groupResource(), allowed, neededFor)
+	}
+	_ = w.Flush()
+}
+
+// permissionsRole returns a Role granting the permissions, with one rule
+// per resource.
+func permissionsRole(namespace string, perms []permission) *rbacv1.Role {
+	role := &rbacv1.Role{
+		TypeMeta: metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "Role"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      canIRoleName,
+			Namespace: namespace,
+		},
+	}
+	type key struct{ group, resource string }
+	index := map[key]int{}
+	for _, p := range perms {
+		k := key{p.Group, p.resource()}
+		i, ok := index[k]
+		if !ok {
+			i = len(role.Rules)
+			index[k] = i
+			role.Rules = append(role.Rules, rbacv1.PolicyRule{
+				APIGroups: []string{p.Group},
+				Resources: []string{p.resource()},
+			})
+		}
+		role.Rules[i].Verbs = append(role.Rules[i].Verbs, p.Verb)
+	}
+	return role
+}
@@ -0,0 +1,170 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/yaml"
+)
+
+func Test_PreflightTap(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Strategy string
+		Denied   []string
+		Err      error
+		Output   []string
+	}{
+		{"allowed", strategyTemplate, nil, nil, nil},
+		{"workload_denied", strategyTemplate, []string{"patch deployments.apps", "create pods/exec"}, ErrPermissionsMissing, []string{"  patch deployments.apps\n", "  create pods/exec\n"}},
+		{"watch_denied", strategyTemplate, []string{"watch pods", "watch events"}, ErrPermissionsMissing, []string{"  watch pods\n", "  watch events\n"}},
+		{"other_kind_denied", strategyTemplate, []string{"patch statefulsets.apps"}, nil, nil},
+		{"lease_denied", strategyTemplate, []string{"create leases.coordination.k8s.io"}, nil, []string{"Warning: the tap is not reverted if mittens is killed", "  create leases.coordination.k8s.io\n"}},
+		{"standalone_denied", strategyStandalone, []string{"create deployments.apps"}, ErrPermissionsMissing, []string{"  create deployments.apps\n"}},
+		{"review_error", strategyTemplate, []string{"*"}, nil, []string{"Warning: skipping the permission preflight"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			fakeClient := fakeClientWithAccessReviews(fakeClientUntappedSimple(), tc.Denied...)
+			testViper := viper.New()
+			testViper.Set("proxyPort", 80)
+			testViper.Set("namespace", "default")
+			testViper.Set("proxyImage", defaultImageHTTP)
+			testViper.Set("commandArgs", defaultCommandArgs)
+			testViper.Set("strategy", tc.Strategy)
+			testViper.Set("preflight", true)
+			var out bytes.Buffer
+			cmd := &cobra.Command{}
+			cmd.SetOutput(&out)
+			err := NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+			require.True(errors.Is(err, tc.Err), "expected %v, got %v", tc.Err, err)
+			for _, s := range tc.Output {
+				require.Contains(out.String(), s)
+			}
+			if tc.Err != nil {
+				for _, action := range fakeClient.Actions() {
+					if action.GetResource().Resource == "selfsubjectaccessreviews" {
+						continue
+					}
+					require.Contains([]string{"get", "list"}, action.GetVerb(), "nothing is changed before the preflight passes")
+				}
+			}
+		})
+	}
+}
+
+func Test_RequiredPermissions(t *testing.T) {
+	require := require.New(t)
+	fakeClient := fakeClientUntappedSimple()
+	workload, err := workloadFromSelectors(fakeClient, "default", simpleService.Spec.Selector)
+	require.Nil(err)
+
+	perms := requiredPermissions(strategyTemplate, uiTUI, workload)
+	require.Contains(perms, permission{Verb: "patch", Group: "apps", Resource: "deployments"})
+	require.NotContains(perms, permission{Verb: "patch", Group: "apps", Resource: "statefulsets"})
+	require.NotContains(perms, permission{Verb: "create", Resource: "pods", Subresource: "eviction"}, "Deployments roll out by themselves")
+	for _, p := range []permission{{Verb: "watch", Resource: "pods"}, {Verb: "list", Resource: "events"}, {Verb: "watch", Resource: "events"}} {
+		require.Contains(perms, p, "the readiness of the proxy is watched")
+	}
+	require.Contains(perms, permission{Verb: "get", Resource: "pods"}, "the proxy Pod is checked when a session breaks")
+
+	require.Contains(perms, permission{Verb: "list", Resource: "services"}, "Services are listed when the Namespace cannot be read")
+
+	perms = requiredPermissions(strategyEphemeral, uiTUI, workload)
+	require.Contains(perms, permission{Verb: "patch", Resource: "pods", Subresource: "ephemeralcontainers"})
+	require.Contains(perms, permission{Verb: "patch", Group: "apps", Resource: "deployments"}, "the tap falls back to patching the pod template")
+
+	perms = requiredPermissions(strategyStandalone, uiWeb, nil)
+	require.Contains(perms, permission{Verb: "create", Group: "apps", Resource: "deployments"}, "the proxy Deployment is required, not only the janitor")
+	require.Contains(perms, permission{Verb: "create", Resource: "pods", Subresource: "portforward"})
+	require.NotContains(perms, permission{Verb: "list", Group: "apps", Resource: "deployments"})
+}
+
+func Test_CanI(t *testing.T) {
+	require := require.New(t)
+	fakeClient := fakeClientWithAccessReviews(fakeClientUntappedSimple(), "patch deployments.apps")
+	testViper := viper.New()
+	testViper.Set("namespace", "default")
+	var out, errOut bytes.Buffer
+	cmd := &cobra.Command{}
+	cmd.SetOut(&out)
+	cmd.SetErr(&errOut)
+	require.Nil(NewCanICommand(fakeClient, testViper)(cmd, []string{"sample-service"}))
+	require.Regexp(`patch\s+deployments.apps\s+no\s+tap`, errOut.String())
+	require.Regexp(`create\s+leases.coordination.k8s.io\s+yes\s+crash safety`, errOut.String())
+	require.NotRegexp(`patch\s+statefulsets`, errOut.String())
+
+	var role rbacv1.Role
+	require.Nil(yaml.Unmarshal(out.Bytes(), &role))
+	require.Equal("Role", role.Kind)
+	require.Equal("default", role.Namespace)
+	require.Contains(role.Rules, rbacv1.PolicyRule{
+		APIGroups: []string{"apps"},
+		Resources: []string{"deployments"},
+		Verbs:     []string{"list", "get", "patch", "create", "delete"},
+	})
+	require.Contains(role.Rules, rbacv1.PolicyRule{
+		APIGroups: []string{""},
+		Resources: []string{"pods/exec"},
+		Verbs:     []string{"create"},
+	})
+
+	errOut.Reset()
+	testViper.Set("replicas", "1")
+	require.Nil(NewCanICommand(fakeClient, testViper)(cmd, nil))
+	require.Regexp(`create\s+deployments.apps\s+yes\s+tap`, errOut.String(), "a canary tap creates a Deployment")
+
+	testViper.Set("strategy", strategyStandalone)
+	require.True(errors.Is(NewCanICommand(fakeClient, testViper)(cmd, nil), ErrStrategyNotSupported), "--replicas cannot be combined with a strategy")
+	testViper.Set("replicas", "")
+	testViper.Set("strategy", strategyCanary)
+	require.True(errors.Is(NewCanICommand(fakeClient, testViper)(cmd, nil), ErrStrategyNotSupported), "a canary tap is selected with --replicas")
+	testViper.Set("strategy", "sidecar")
+	require.True(errors.Is(NewCanICommand(fakeClient, testViper)(cmd, nil), ErrStrategyNotSupported))
+}
+
+// fakeClientWithAccessReviews answers SelfSubjectAccessReviews, allowing
+// everything but the denied permissions, formatted like permission.String.
+// Denying "*" fails every review.
+func fakeClientWithAccessReviews(client *fake.Clientset, denied ...string) *fake.Clientset {
+	client.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if len(denied) == 1 && denied[0] == "*" {
+			return true, nil, errors.New("review failed")
+		}
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		attrs := review.Spec.ResourceAttributes
+		p := permission{Verb: attrs.Verb, Group: attrs.Group, Resource: attrs.Resource, Subresource: attrs.Subresource}
+		review.Status.Allowed = true
+		for _, d := range denied {
+			if d == p.String() {
+				review.Status.Allowed = false
+			}
+		}
+		return true, review, nil
+	})
+	return client
+}
@@ -0,0 +1,210 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// The phases of a tap, in the order they are reported.
+const (
+	phaseConfigMap   = "configmap-created"
+	phaseWorkload    = "workload-patched"
+	phaseService     = "service-rewired"
+	phaseRollout     = "rollout"
+	phaseTerminating = "pods-terminating"
+	phaseReady       = "proxy-ready"
+	phaseAttaching   = "session-attaching"
+	phaseWarning     = "warning"
+	phaseFailed      = "failed"
+)
+
+// progressEvent is a phase of a tap, printed as a line of JSON with --output json.
+type progressEvent struct {
+	Time      time.Time `json:"time"`
+	Phase     string    `json:"phase"`
+	Namespace string    `json:"namespace"`
+	Service   string    `json:"service"`
+	Message   string    `json:"message"`
+	// Ready and Desired count the Pods of a rollout
+	Ready   *int `json:"ready,omitempty"`
+	Desired *int `json:"desired,omitempty"`
+	// Terminating counts the Pods being replaced
+	Terminating *int `json:"terminating,omitempty"`
+}
+
+// progress reports the phases of a tap, in a Spinner on terminals or as JSON
+// events for scripts. It is safe for concurrent use.
+type progress struct {
+	namespace, service string
+	// events receives the JSON events, nil without --output json
+	events io.Writer
+	// out receives warnings and failures while no Spinner runs
+	out      io.Writer
+	terminal bool
+
+	mu      sync.Mutex
+	spinner *Spinner
+	message string
+	suffix  string
+	// the last rollout reported, only changes are reported
+	ready, desired, terminating int
+}
+
+// newProgress returns the progress of a tap of a Service. With --output json
+// the events are written to the output of cmd, which then writes to its error
+// output instead so scripts can parse the events.
+func newProgress(cmd *cobra.Command, viper *viper.Viper, namespace, service string) *progress {
+	p := &progress{namespace: namespace, service: service, ready: -1, desired: -1}
+	if viper.GetString("output") == outputJSON {
+		p.events = cmd.OutOrStdout()
+		cmd.SetOut(cmd.ErrOrStderr())
+	}
+	p.out = cmd.OutOrStdout()
+	_, p.terminal = p.out.(*os.File)
+	return p
+}
+
+// start shows a Spinner with message on terminals, replacing a running one.
+func (p *progress) start(message string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.spinner != nil {
+		p.spinner.Stop(p.message)
+		p.spinner = nil
+	}
+	p.message, p.suffix = message, ""
+	if p.events != nil || !p.terminal {
+		return
+	}
+	p.spinner = NewSpinner(message)
+}
+
+// report records a phase, updating the Spinner text.
+func (p *progress) report(phase, message string) {
+	p.emit(progressEvent{Phase: phase, Message: message})
+}
+
+// rollout reports the ready and desired Pods of the tapped workload and the
+// Pods still terminating, if they changed since the last report.
+func (p *progress) rollout(ready, desired, terminating int) {
+	p.mu.Lock()
+	changed := ready != p.ready || desired != p.desired
+	terminatingChanged := terminating != p.terminating
+	p.ready, p.desired, p.terminating = ready, desired, terminating
+	p.mu.Unlock()
+	if changed {
+		p.emit(progressEvent{
+			Phase:   phaseRollout,
+			Message: fmt.Sprintf("New Pods ready: %d/%d", ready, desired),
+			Ready:   &ready,
+			Desired: &desired,
+		})
+	}
+	if terminatingChanged && terminating > 0 {
+		p.emit(progressEvent{
+			Phase:       phaseTerminating,
+			Message:     fmt.Sprintf("New Pods ready: %d/%d, old Pods terminating: %d", ready, desired, terminating),
+			Terminating: &terminating,
+		})
+	}
+}
+
+// setSuffix appends suffix to the Spinner text, e.g. a countdown.
+func (p *progress) setSuffix(suffix string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.suffix = suffix
+	if p.spinner != nil {
+		p.spinner.Update(p.message + p.suffix)
+	}
+}
+
+// stop reports a phase that completes the Spinner with a success message.
+func (p *progress) stop(phase, message string) {
+	p.emit(progressEvent{Phase: phase, Message: message})
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.spinner != nil {
+		p.spinner.Stop(message)
+		p.spinner = nil
+	}
+}
+
+// warn shows a warning, which interrupts a running Spinner.
+func (p *progress) warn(message string) {
+	p.emit(progressEvent{Phase: phaseWarning, Message: message})
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.spinner == nil {
+		_, _ = fmt.Fprintln(p.out, message)
+		return
+	}
+	p.spinner.Warn(message)
+	p.spinner = NewSpinner(p.message + p.suffix)
+}
+
+// fail shows a failure, stopping a running Spinner.
+func (p *progress) fail(message string) {
+	p.emit(progressEvent{Phase: phaseFailed, Message: message})
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.spinner == nil {
+		_, _ = fmt.Fprintln(p.out, message)
+		return
+	}
+	p.spinner.Fail(message)
+	p.spinner = nil
+}
+
+// abort stops a running Spinner with a failure message, e.g. when an error
+// is returned that the Spinner did not show yet.
+func (p *progress) abort(message string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.spinner != nil {
+		p.spinner.Fail(message)
+		p.spinner = nil
+	}
+}
+
+// emit writes an event as JSON, or updates the Spinner text with its message.
+func (p *progress) emit(ev progressEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.events == nil {
+		if ev.Phase != phaseWarning && ev.Phase != phaseFailed {
+			p.message = ev.Message
+			if p.spinner != nil {
+				p.spinner.Update(p.message + p.suffix)
+			}
+		}
+		return
+	}
+	ev.Time = time.Now().UTC()
+	ev.Namespace, ev.Service = p.namespace, p.service
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	_, _ = fmt.Fprintln(p.events, string(b))
+}
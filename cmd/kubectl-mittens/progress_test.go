@@ -0,0 +1,172 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	k8sappsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func Test_TapProgressJSON(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Strategy string
+		Phases   []string
+	}{
+		{"template", strategyTemplate, []string{phaseConfigMap, phaseWorkload, phaseService}},
+		{"standalone", strategyStandalone, []string{phaseWorkload, phaseService}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			testViper := viper.New()
+			testViper.Set("proxyPort", 80)
+			testViper.Set("namespace", "default")
+			testViper.Set("proxyImage", defaultImageHTTP)
+			testViper.Set("commandArgs", defaultCommandArgs)
+			testViper.Set("strategy", tc.Strategy)
+			testViper.Set("output", outputJSON)
+			var out, errOut bytes.Buffer
+			cmd := &cobra.Command{}
+			cmd.SetOut(&out)
+			cmd.SetErr(&errOut)
+			require.Nil(NewTapCommand(fakeClientUntappedSimple(), &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+
+			var phases []string
+			for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+				var ev progressEvent
+				require.Nil(json.Unmarshal([]byte(line), &ev), "every line of stdout is an event: %q", line)
+				require.Equal("default", ev.Namespace)
+				require.Equal("sample-service", ev.Service)
+				require.False(ev.Time.IsZero())
+				phases = append(phases, ev.Phase)
+			}
+			require.Equal(tc.Phases, phases)
+			require.Contains(errOut.String(), `Port 80 of Service "sample-service" has been tapped!`)
+		})
+	}
+}
+
+func Test_ProgressRollout(t *testing.T) {
+	require := require.New(t)
+	testViper := viper.New()
+	testViper.Set("output", outputJSON)
+	var out bytes.Buffer
+	cmd := &cobra.Command{}
+	cmd.SetOutput(&out)
+	p := newProgress(cmd, testViper, "default", "sample-service")
+	p.rollout(0, 2, 0)
+	p.rollout(0, 2, 0)
+	p.rollout(1, 2, 1)
+	p.rollout(1, 2, 0)
+
+	var events []progressEvent
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var ev progressEvent
+		require.Nil(json.Unmarshal([]byte(line), &ev))
+		events = append(events, ev)
+	}
+	require.Len(events, 3, "only changes are reported")
+	require.Equal(phaseRollout, events[0].Phase)
+	require.Equal(0, *events[0].Ready)
+	require.Equal(2, *events[0].Desired)
+	require.Equal(phaseRollout, events[1].Phase)
+	require.Equal(1, *events[1].Ready)
+	require.Equal(phaseTerminating, events[2].Phase)
+	require.Equal(1, *events[2].Terminating)
+}
+
+func Test_RolloutStatus(t *testing.T) {
+	require := require.New(t)
+	workload, err := workloadFromSelectors(fakeClientUntappedSimple(), "default", simpleService.Spec.Selector)
+	require.Nil(err)
+	tapped := map[string]string{annotationIsTapped: workload.Name()}
+	readyStatus := v1.PodStatus{Conditions: []v1.PodCondition{{Type: v1.ContainersReady, Status: v1.ConditionTrue}}}
+	deleted := metav1.Now()
+	pods := map[string]*v1.Pod{
+		"new-ready":   {ObjectMeta: metav1.ObjectMeta{Annotations: tapped}, Status: readyStatus},
+		"new-pending": {ObjectMeta: metav1.ObjectMeta{Annotations: tapped}},
+		"old":         {Status: readyStatus},
+		"old-deleted": {ObjectMeta: metav1.ObjectMeta{DeletionTimestamp: &deleted}, Status: readyStatus},
+	}
+	ready, desired, terminating := rolloutStatus(pods, workload, 3)
+	require.Equal(1, ready)
+	require.Equal(3, desired)
+	require.Equal(1, terminating)
+}
+
+func Test_ProxyReplicas(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Client   func() *fake.Clientset
+		Strategy string
+		Desired  int
+	}{
+		{"template", fakeClientUntappedSimple, strategyTemplate, 1},
+		{"ephemeral", fakeClientEphemeralTappedTwoOfThree, strategyEphemeral, 2},
+		{"canary", fakeClientCanaryTapped, strategyCanary, 2},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			client := tc.Client()
+			workload, err := workloadFromSelectors(client, "default", simpleService.Spec.Selector)
+			require.Nil(err)
+			sel, err := metav1.LabelSelectorAsSelector(workload.Selector())
+			require.Nil(err)
+			svc := simpleService
+			svc.Annotations = map[string]string{annotationStrategy: tc.Strategy}
+			require.Equal(tc.Desired, proxyReplicas(context.TODO(), client, &svc, workload, sel))
+		})
+	}
+}
+
+// fakeClientEphemeralTappedTwoOfThree has two Pods with an ephemeral proxy
+// and one created after the tap.
+func fakeClientEphemeralTappedTwoOfThree() *fake.Clientset {
+	client := fakeClientUntappedSimple()
+	for i, tapped := range []bool{true, true, false} {
+		pod := runningPod(mittensContainerName)
+		pod.Name = fmt.Sprintf("sample-pod-%d", i)
+		if tapped {
+			pod.Labels = map[string]string{"app": "myapp", labelEphemeral: "true"}
+			pod.Annotations = map[string]string{annotationIsTapped: "sample-deployment", annotationSidecar: mittensContainerName}
+		}
+		_ = client.Tracker().Add(pod)
+	}
+	return client
+}
+
+func fakeClientCanaryTapped() *fake.Clientset {
+	client := fakeClientUntappedSimple()
+	replicas := int32(2)
+	_ = client.Tracker().Add(&k8sappsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: standaloneName(canaryPrefix, "sample-service"), Namespace: "default"},
+		Spec:       k8sappsv1.DeploymentSpec{Replicas: &replicas},
+	})
+	return client
+}
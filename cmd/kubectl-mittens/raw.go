@@ -0,0 +1,142 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// rawSessionName is the tmux session the relay runs in.
+	rawSessionName = "mittens"
+)
+
+// NewRawSidecarContainer returns the proxy sidecar for raw taps. It runs
+// mittens-relay, which logs connections and hexdumps the relayed traffic.
+func NewRawSidecarContainer(protocol Protocol) v1.Container {
+	if protocol == protocolUDP {
+		// UDP cannot be probed, the relay is ready once it is running.
+		return v1.Container{
+			Name:            mittensContainerName,
+			ImagePullPolicy: v1.PullAlways,
+			Ports: []v1.ContainerPort{
+				{
+					Name:          mittensPortName,
+					ContainerPort: mittensProxyListenPort,
+					Protocol:      v1.ProtocolUDP,
+				},
+			},
+		}
+	}
+	return v1.Container{
+		Name: mittensContainerName,
+		// Image:           image,       // Image is controlled by main
+		ImagePullPolicy: v1.PullAlways,
+		Ports: []v1.ContainerPort{
+			{
+				Name:          mittensPortName,
+				ContainerPort: mittensProxyListenPort,
+				Protocol:      v1.ProtocolTCP,
+			},
+		},
+		ReadinessProbe: &v1.Probe{
+			ProbeHandler: v1.ProbeHandler{
+				TCPSocket: &v1.TCPSocketAction{
+					Port: intstr.FromInt(mittensProxyListenPort),
+				},
+			},
+			InitialDelaySeconds: 2,
+			PeriodSeconds:       5,
+			SuccessThreshold:    1,
+			TimeoutSeconds:      5,
+		},
+	}
+}
+
+// NewRaw initializes a new raw Tap that relays TCP streams or UDP datagrams.
+func NewRaw(c kubernetes.Interface, p ProxyOptions) Tap {
+	return &Raw{
+		Protos:    []Protocol{protocolTCP, protocolUDP},
+		Client:    c,
+		ProxyOpts: p,
+	}
+}
+
+// Raw relays arbitrary streams or datagrams to the tapped container without
+// interpreting them. Every connection is logged with a hexdump of its traffic
+// inside a tmux session, which users can attach to via:
+//
+//	kubectl exec -it <pod> -- tmux attach-session -t mittens
+type Raw struct {
+	Protos    []Protocol
+	Client    kubernetes.Interface
+	ProxyOpts ProxyOptions
+}
+
+// Sidecar provides a relay sidecar container configured through its environment.
+func (r *Raw) Sidecar(_ string) v1.Container {
+	c := NewRawSidecarContainer(r.ProxyOpts.Protocol)
+	c.Env = []v1.EnvVar{
+		{
+			Name:  "MITTENS_UPSTREAM",
+			Value: r.ProxyOpts.upstream(),
+		},
+		{
+			Name:  "MITTENS_PROTOCOL",
+			Value: string(r.ProxyOpts.Protocol),
+		},
+	}
+	if r.ProxyOpts.Decoder != "" {
+		c.Env = append(c.Env, v1.EnvVar{
+			Name:  "MITTENS_DECODE",
+			Value: r.ProxyOpts.Decoder,
+		})
+	}
+	return c
+}
+
+// PatchWorkload is a no-op, the relay does not need any volumes.
+func (r *Raw) PatchWorkload(_ *v1.PodTemplateSpec, _ string) {}
+
+// ReadyEnv is a no-op, the relay is configured entirely through its environment.
+func (r *Raw) ReadyEnv() error {
+	return nil
+}
+
+// UnreadyEnv is a no-op, see ReadyEnv.
+func (r *Raw) UnreadyEnv() error {
+	return nil
+}
+
+// AttachCommand attaches to the tmux session running the relay.
+func (r *Raw) AttachCommand() []string {
+	return []string{"tmux", "attach-session", "-t", rawSessionName}
+}
+
+// SessionCommand checks whether the tmux session running the relay is alive.
+func (r *Raw) SessionCommand() []string {
+	return []string{"tmux", "has-session", "-t", rawSessionName}
+}
+
+// Protocols returns a slice of protocols supported by Raw.
+func (r *Raw) Protocols() []Protocol {
+	return r.Protos
+}
+
+// String is called to conveniently print the type of Tap to stdout.
+func (r *Raw) String() string {
+	return "raw"
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func Test_NewTap(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Protocol Protocol
+		Tap      string
+		Err      error
+	}{
+		{"default", "", "mitmproxy", nil},
+		{"http", protocolHTTP, "mitmproxy", nil},
+		{"tcp", protocolTCP, "raw", nil},
+		{"unknown", Protocol("sctp"), "", ErrProtocolNotSupported},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			tap, err := NewTap(fake.NewSimpleClientset(), ProxyOptions{Protocol: tc.Protocol})
+			if tc.Err != nil {
+				require.True(errors.Is(err, tc.Err))
+				return
+			}
+			require.Nil(err)
+			require.Equal(tc.Tap, tap.String())
+		})
+	}
+}
+
+func Test_TapRawTCP(t *testing.T) {
+	require := require.New(t)
+	fakeClient := fakeClientUntappedSimple()
+	testViper := viper.New()
+	testViper.Set("proxyPort", 80)
+	testViper.Set("namespace", "default")
+	testViper.Set("protocol", "tcp")
+	testViper.Set("proxyImage", defaultImageHTTP)
+	testViper.Set("commandArgs", defaultCommandArgs)
+	cmd := &cobra.Command{}
+	cmd.SetOutput(ioutil.Discard)
+	err := NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+	require.Nil(err)
+
+	dpl, err := fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "sample-deployment", metav1.GetOptions{})
+	require.Nil(err)
+	var sidecar *v1.Container
+	for i, c := range dpl.Spec.Template.Spec.Containers {
+		if c.Name == mittensContainerName {
+			sidecar = &dpl.Spec.Template.Spec.Containers[i]
+		}
+	}
+	require.NotNil(sidecar, "sidecar was not added to the deployment")
+	require.Equal(defaultImageRaw, sidecar.Image)
+	require.Empty(sidecar.Args, "mitmproxy arguments must not be passed to the relay")
+	require.Contains(sidecar.Env, v1.EnvVar{Name: "MITTENS_UPSTREAM", Value: "127.0.0.1:8080"})
+	require.Contains(sidecar.Env, v1.EnvVar{Name: "MITTENS_PROTOCOL", Value: "tcp"})
+	require.Empty(dpl.Spec.Template.Spec.Volumes, "the relay does not need volumes")
+
+	svc, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+	require.Nil(err)
+	require.Equal(string(protocolTCP), svc.Annotations[annotationProtocol])
+	require.Equal(mittensProxyListenPort, svc.Spec.Ports[0].TargetPort.IntValue())
+
+	err = NewUntapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+	require.Nil(err)
+	svc, err = fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+	require.Nil(err)
+	require.NotContains(svc.Annotations, annotationProtocol)
+	require.Equal(8080, svc.Spec.Ports[0].TargetPort.IntValue())
+}
+
+func Test_TapRawUDP(t *testing.T) {
+	require := require.New(t)
+	namespace := simpleNamespace
+	deployment := simpleDeployment
+	service := simpleService
+	service.Spec.Ports = []v1.ServicePort{
+		{
+			Name:       "dns-tcp",
+			Port:       53,
+			Protocol:   v1.ProtocolTCP,
+			TargetPort: intstr.FromInt(5353),
+		},
+		{
+			Name:       "dns",
+			Port:       53,
+			Protocol:   v1.ProtocolUDP,
+			TargetPort: intstr.FromInt(5353),
+		},
+	}
+	fakeClient := fake.NewSimpleClientset(&namespace, &deployment, &service)
+
+	testViper := viper.New()
+	testViper.Set("proxyPort", 53)
+	testViper.Set("namespace", "default")
+	testViper.Set("protocol", "udp")
+	testViper.Set("decode", "dns")
+	testViper.Set("proxyImage", defaultImageHTTP)
+	testViper.Set("commandArgs", defaultCommandArgs)
+	cmd := &cobra.Command{}
+	cmd.SetOutput(ioutil.Discard)
+	err := NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+	require.Nil(err)
+
+	dpl, err := fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "sample-deployment", metav1.GetOptions{})
+	require.Nil(err)
+	sidecar := dpl.Spec.Template.Spec.Containers[1]
+	require.Equal(defaultImageRaw, sidecar.Image)
+	require.Equal(v1.ProtocolUDP, sidecar.Ports[0].Protocol)
+	require.Nil(sidecar.ReadinessProbe, "UDP sidecars cannot be probed over TCP")
+	require.Contains(sidecar.Env, v1.EnvVar{Name: "MITTENS_PROTOCOL", Value: "udp"})
+	require.Contains(sidecar.Env, v1.EnvVar{Name: "MITTENS_DECODE", Value: "dns"})
+
+	svc, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+	require.Nil(err)
+	require.Equal(5353, svc.Spec.Ports[0].TargetPort.IntValue(), "the TCP port must not be tapped")
+	require.Equal(mittensProxyListenPort, svc.Spec.Ports[1].TargetPort.IntValue(), "the UDP port was not tapped")
+
+	err = NewUntapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+	require.Nil(err)
+	svc, err = fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+	require.Nil(err)
+	require.Equal(5353, svc.Spec.Ports[1].TargetPort.IntValue())
+}
@@ -0,0 +1,216 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/viper"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	watchtools "k8s.io/client-go/tools/watch"
+)
+
+const (
+	// defaultTimeout is how long the proxy gets to become ready without --timeout.
+	defaultTimeout = 90 * time.Second
+	// podEventsShown is how many of the latest events of a failed Pod are printed.
+	podEventsShown = 10
+)
+
+// ErrMittensPodFailed occurs when the proxy Pod cannot become ready, e.g.
+// because its image cannot be pulled or its Pods cannot be created.
+var ErrMittensPodFailed = errors.New("the proxy Pod cannot start")
+
+// failedWaitingReasons are the reasons of waiting containers that will not
+// start without a change to the Pod or its environment.
+var failedWaitingReasons = map[string]bool{
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CrashLoopBackOff":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+	"RunContainerError":          true,
+}
+
+// readinessTimeout returns how long to wait for the proxy to become ready, 0 waits forever.
+func readinessTimeout(viper *viper.Viper) time.Duration {
+	if !viper.IsSet("timeout") {
+		return defaultTimeout
+	}
+	return viper.GetDuration("timeout")
+}
+
+// podFailure returns why a tapped Pod cannot become ready, or an empty string
+// while it still may. Only the proxy is considered in Pods tapped with an
+// ephemeral container, as the rest of the Pod was running before.
+func podFailure(pod *v1.Pod) string {
+	if _, ephemeral := pod.GetAnnotations()[annotationSidecar]; ephemeral {
+		return containerFailure(pod.Status.EphemeralContainerStatuses, sidecarName(*pod))
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == v1.PodScheduled && cond.Status == v1.ConditionFalse && cond.Reason == v1.PodReasonUnschedulable {
+			return fmt.Sprintf("%s: %s", cond.Reason, cond.Message)
+		}
+	}
+	if failure := containerFailure(pod.Status.InitContainerStatuses, ""); failure != "" {
+		return failure
+	}
+	return containerFailure(pod.Status.ContainerStatuses, "")
+}
+
+// containerFailure returns why the named container, or any if name is empty,
+// will not start.
+func containerFailure(statuses []v1.ContainerStatus, name string) string {
+	for _, cs := range statuses {
+		if name != "" && cs.Name != name {
+			continue
+		}
+		if w := cs.State.Waiting; w != nil && failedWaitingReasons[w.Reason] {
+			return fmt.Sprintf("container %q: %s: %s", cs.Name, w.Reason, w.Message)
+		}
+	}
+	return ""
+}
+
+// podListWatch lists and watches the Pods in a namespace matching a label selector.
+func podListWatch(client kubernetes.Interface, namespace, selector string) cache.ListerWatcher {
+	pods := client.CoreV1().Pods(namespace)
+	return cache.ToListWatcherWithWatchListSemantics(&cache.ListWatch{
+		ListWithContextFunc: func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+			opts.LabelSelector = selector
+			return pods.List(ctx, opts)
+		},
+		WatchFuncWithContext: func(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+			opts.LabelSelector = selector
+			return pods.Watch(ctx, opts)
+		},
+	}, client)
+}
+
+// watchFailedCreate returns an error once the controller of a workload fails
+// to create its Pods, e.g. because a quota is exceeded or an admission
+// webhook rejects them. Events that exist when the watch starts are only
+// reported once they repeat, and ctx errors are not returned.
+func watchFailedCreate(ctx context.Context, client kubernetes.Interface, workload Workload) error {
+	events := client.CoreV1().Events(workload.Namespace())
+	selector := fields.Set{"type": v1.EventTypeWarning, "reason": "FailedCreate"}.AsSelector().String()
+	lw := cache.ToListWatcherWithWatchListSemantics(&cache.ListWatch{
+		ListWithContextFunc: func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+			opts.FieldSelector = selector
+			return events.List(ctx, opts)
+		},
+		WatchFuncWithContext: func(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+			opts.FieldSelector = selector
+			return events.Watch(ctx, opts)
+		},
+	}, client)
+	// the count of an event grows when it repeats
+	seen := map[string]int32{}
+	existing, err := events.List(ctx, metav1.ListOptions{FieldSelector: selector})
+	if err != nil {
+		// the events only speed up failing, the Pod watch still times out
+		return nil
+	}
+	for i := range existing.Items {
+		seen[existing.Items[i].Name] = eventCount(&existing.Items[i])
+	}
+	_, err = watchtools.UntilWithSync(ctx, lw, &v1.Event{}, nil, func(e watch.Event) (bool, error) {
+		ev, ok := e.Object.(*v1.Event)
+		if !ok || e.Type == watch.Deleted || ev.Type != v1.EventTypeWarning || ev.Reason != "FailedCreate" || !createsPodsOf(ev.InvolvedObject, workload) {
+			return false, nil
+		}
+		if count, ok := seen[ev.Name]; ok && eventCount(ev) <= count {
+			return false, nil
+		}
+		return false, fmt.Errorf("%w: %s %q: %s", ErrMittensPodFailed, ev.InvolvedObject.Kind, ev.InvolvedObject.Name, ev.Message)
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// eventCount returns how often an event occurred.
+func eventCount(ev *v1.Event) int32 {
+	if ev.Series != nil {
+		return ev.Series.Count
+	}
+	return ev.Count
+}
+
+// createsPodsOf reports whether an object creates the Pods of a workload,
+// the workload itself or, for Deployments, one of their ReplicaSets.
+func createsPodsOf(obj v1.ObjectReference, workload Workload) bool {
+	if obj.Kind == workload.Kind() && obj.Name == workload.Name() {
+		return true
+	}
+	return workload.Kind() == kindDeployment && obj.Kind == kindReplicaSet && strings.HasPrefix(obj.Name, workload.Name()+"-")
+}
+
+// printPodEvents writes the latest events of a Pod, explaining why it failed.
+func printPodEvents(ctx context.Context, out io.Writer, client kubernetes.Interface, pod *v1.Pod) {
+	selector := fields.Set{"involvedObject.kind": "Pod", "involvedObject.name": pod.Name}.AsSelector().String()
+	list, err := client.CoreV1().Events(pod.Namespace).List(ctx, metav1.ListOptions{FieldSelector: selector})
+	if err != nil {
+		return
+	}
+	var events []v1.Event
+	for _, ev := range list.Items {
+		if ev.InvolvedObject.Kind == "Pod" && ev.InvolvedObject.Name == pod.Name {
+			events = append(events, ev)
+		}
+	}
+	if len(events) == 0 {
+		return
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return eventTime(events[i]).Before(eventTime(events[j]))
+	})
+	if len(events) > podEventsShown {
+		events = events[len(events)-podEventsShown:]
+	}
+	_, _ = fmt.Fprintf(out, "Events of Pod %q:\n", pod.Name)
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, ev := range events {
+		_, _ = fmt.Fprintf(w, "  %s\t%s\t%s\n", ev.Type, ev.Reason, strings.TrimSpace(ev.Message))
+	}
+	_ = w.Flush()
+}
+
+// eventTime returns when an event last occurred.
+func eventTime(ev v1.Event) time.Time {
+	switch {
+	case ev.Series != nil:
+		return ev.Series.LastObservedTime.Time
+	case !ev.LastTimestamp.IsZero():
+		return ev.LastTimestamp.Time
+	case !ev.EventTime.IsZero():
+		return ev.EventTime.Time
+	}
+	return ev.FirstTimestamp.Time
+}
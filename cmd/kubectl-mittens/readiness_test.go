@@ -0,0 +1,80 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_PodFailure(t *testing.T) {
+	waiting := func(name, reason string) v1.ContainerStatus {
+		return v1.ContainerStatus{Name: name, State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: reason}}}
+	}
+	tests := []struct {
+		Name    string
+		Pod     v1.Pod
+		Failure string
+	}{
+		{"starting", v1.Pod{Status: v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{waiting(mittensContainerName, "ContainerCreating")}}}, ""},
+		{"image_pull", v1.Pod{Status: v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{waiting(mittensContainerName, "ImagePullBackOff")}}}, "ImagePullBackOff"},
+		{"init_crash", v1.Pod{Status: v1.PodStatus{InitContainerStatuses: []v1.ContainerStatus{waiting("init", "CrashLoopBackOff")}}}, "CrashLoopBackOff"},
+		{"unschedulable", v1.Pod{Status: v1.PodStatus{Conditions: []v1.PodCondition{
+			{Type: v1.PodScheduled, Status: v1.ConditionFalse, Reason: v1.PodReasonUnschedulable, Message: "0/3 nodes are available"},
+		}}}, "0/3 nodes are available"},
+		{"ephemeral_other_container", v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{annotationSidecar: mittensContainerName}},
+			Status:     v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{waiting("someapp", "CrashLoopBackOff")}},
+		}, ""},
+		{"ephemeral_image_pull", v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{annotationSidecar: mittensContainerName}},
+			Status:     v1.PodStatus{EphemeralContainerStatuses: []v1.ContainerStatus{waiting(mittensContainerName, "ErrImagePull")}},
+		}, "ErrImagePull"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			failure := podFailure(&tc.Pod)
+			if tc.Failure == "" {
+				require.Empty(t, failure)
+				return
+			}
+			require.Contains(t, failure, tc.Failure)
+		})
+	}
+}
+
+func Test_CreatesPodsOf(t *testing.T) {
+	require := require.New(t)
+	workload, err := workloadFromSelectors(fakeClientUntappedSimple(), "default", simpleService.Spec.Selector)
+	require.Nil(err)
+	require.True(createsPodsOf(v1.ObjectReference{Kind: kindDeployment, Name: "sample-deployment"}, workload))
+	require.True(createsPodsOf(v1.ObjectReference{Kind: kindReplicaSet, Name: "sample-deployment-5d4f8"}, workload))
+	require.False(createsPodsOf(v1.ObjectReference{Kind: kindReplicaSet, Name: "other-deployment-5d4f8"}, workload))
+	require.False(createsPodsOf(v1.ObjectReference{Kind: kindStatefulSet, Name: "sample-deployment"}, workload))
+}
+
+func Test_ReadinessTimeout(t *testing.T) {
+	require := require.New(t)
+	testViper := viper.New()
+	require.Equal(defaultTimeout, readinessTimeout(testViper))
+	testViper.Set("timeout", "5m")
+	require.Equal(5*time.Minute, readinessTimeout(testViper))
+	testViper.Set("timeout", 0)
+	require.Zero(readinessTimeout(testViper))
+}
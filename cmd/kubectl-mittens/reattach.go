@@ -0,0 +1,118 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	watchtools "k8s.io/client-go/tools/watch"
+)
+
+// ErrProxyReplaced occurs when the proxy Pod of a session is deleted, evicted
+// or its proxy container restarted, ending the session with it.
+var ErrProxyReplaced = errors.New("the proxy Pod was replaced")
+
+// proxyRestarts returns how often the proxy container of a Pod restarted.
+func proxyRestarts(pod *v1.Pod) int32 {
+	name := sidecarName(*pod)
+	for _, statuses := range [][]v1.ContainerStatus{pod.Status.ContainerStatuses, pod.Status.EphemeralContainerStatuses} {
+		for _, cs := range statuses {
+			if cs.Name == name {
+				return cs.RestartCount
+			}
+		}
+	}
+	return 0
+}
+
+// proxyGone reports whether the session attached to in the proxy of pod is
+// gone in cur, the current state of the Pod or nil if it was deleted.
+func proxyGone(pod, cur *v1.Pod) bool {
+	switch {
+	case cur == nil, cur.UID != pod.UID, cur.DeletionTimestamp != nil:
+		return true
+	case cur.Status.Phase == v1.PodFailed, cur.Status.Phase == v1.PodSucceeded:
+		// e.g. evicted
+		return true
+	}
+	return proxyRestarts(cur) > proxyRestarts(pod)
+}
+
+// proxyReplaced reports whether the proxy of pod is gone, checked once a
+// session ended. A Forbidden error is returned, as the Pod can never be
+// checked. Other errors report false, as the connection to the cluster may
+// be lost.
+func proxyReplaced(ctx context.Context, client kubernetes.Interface, pod v1.Pod) (bool, error) {
+	cur, err := client.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		return true, nil
+	case apierrors.IsForbidden(err):
+		return false, fmt.Errorf("error checking the proxy Pod %q: %w", pod.Name, err)
+	case err != nil:
+		return false, nil
+	}
+	return proxyGone(&pod, cur), nil
+}
+
+// watchProxyPod returns ErrProxyReplaced once the proxy of pod is gone, or
+// nil when ctx is done.
+func watchProxyPod(ctx context.Context, client kubernetes.Interface, pod v1.Pod) error {
+	pods := client.CoreV1().Pods(pod.Namespace)
+	selector := fields.OneTermEqualSelector("metadata.name", pod.Name).String()
+	lw := cache.ToListWatcherWithWatchListSemantics(&cache.ListWatch{
+		ListWithContextFunc: func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+			opts.FieldSelector = selector
+			return pods.List(ctx, opts)
+		},
+		WatchFuncWithContext: func(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+			opts.FieldSelector = selector
+			return pods.Watch(ctx, opts)
+		},
+	}, client)
+	_, err := watchtools.UntilWithSync(ctx, lw, &v1.Pod{}, func(store cache.Store) (bool, error) {
+		// the Pod may be gone before the watch started
+		_, exists, err := store.Get(&pod)
+		if err != nil {
+			return false, err
+		}
+		return !exists, nil
+	}, func(e watch.Event) (bool, error) {
+		cur, ok := e.Object.(*v1.Pod)
+		if !ok || cur.Name != pod.Name {
+			return false, nil
+		}
+		if e.Type == watch.Deleted {
+			cur = nil
+		}
+		return proxyGone(&pod, cur), nil
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return ErrProxyReplaced
+}
@@ -0,0 +1,118 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func Test_ProxyGone(t *testing.T) {
+	pod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "sample-mittens-pod", UID: "1"},
+		Status: v1.PodStatus{
+			Phase:             v1.PodRunning,
+			ContainerStatuses: []v1.ContainerStatus{{Name: mittensContainerName, RestartCount: 1}},
+		},
+	}
+	deleted := metav1.Now()
+	tests := []struct {
+		Name   string
+		Modify func(*v1.Pod) *v1.Pod
+		Gone   bool
+	}{
+		{"unchanged", func(p *v1.Pod) *v1.Pod { return p }, false},
+		{"deleted", func(*v1.Pod) *v1.Pod { return nil }, true},
+		{"terminating", func(p *v1.Pod) *v1.Pod { p.DeletionTimestamp = &deleted; return p }, true},
+		{"evicted", func(p *v1.Pod) *v1.Pod { p.Status.Phase = v1.PodFailed; return p }, true},
+		{"recreated", func(p *v1.Pod) *v1.Pod { p.UID = "2"; return p }, true},
+		{"proxy_restarted", func(p *v1.Pod) *v1.Pod { p.Status.ContainerStatuses[0].RestartCount = 2; return p }, true},
+		{"other_container_restarted", func(p *v1.Pod) *v1.Pod {
+			p.Status.ContainerStatuses = append(p.Status.ContainerStatuses, v1.ContainerStatus{Name: "someapp", RestartCount: 3})
+			return p
+		}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require.Equal(t, tc.Gone, proxyGone(&pod, tc.Modify(pod.DeepCopy())))
+		})
+	}
+}
+
+func Test_WatchProxyPod(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Change func(*fake.Clientset)
+		Err    error
+	}{
+		{"deleted", func(client *fake.Clientset) {
+			_ = client.CoreV1().Pods("default").Delete(context.TODO(), "sample-mittens-pod", metav1.DeleteOptions{})
+		}, ErrProxyReplaced},
+		{"restarted", func(client *fake.Clientset) {
+			pod, _ := client.CoreV1().Pods("default").Get(context.TODO(), "sample-mittens-pod", metav1.GetOptions{})
+			pod.Status.ContainerStatuses[1].RestartCount++
+			_, _ = client.CoreV1().Pods("default").UpdateStatus(context.TODO(), pod, metav1.UpdateOptions{})
+		}, ErrProxyReplaced},
+		{"unchanged", func(*fake.Clientset) {}, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			client := fakeClientTappedWithPod()
+			pod, err := client.CoreV1().Pods("default").Get(context.TODO(), "sample-mittens-pod", metav1.GetOptions{})
+			require.Nil(err)
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				tc.Change(client)
+			}()
+			err = watchProxyPod(ctx, client, *pod)
+			require.True(errors.Is(err, tc.Err), "expected %v, got %v", tc.Err, err)
+		})
+	}
+}
+
+func Test_ProxyReplaced(t *testing.T) {
+	require := require.New(t)
+	client := fakeClientTappedWithPod()
+	pod, err := client.CoreV1().Pods("default").Get(context.TODO(), "sample-mittens-pod", metav1.GetOptions{})
+	require.Nil(err)
+	replaced, err := proxyReplaced(context.TODO(), client, *pod)
+	require.Nil(err)
+	require.False(replaced)
+	require.Nil(client.CoreV1().Pods("default").Delete(context.TODO(), pod.Name, metav1.DeleteOptions{}))
+	replaced, err = proxyReplaced(context.TODO(), client, *pod)
+	require.Nil(err)
+	require.True(replaced)
+
+	// the Pod cannot be checked, which must not be taken for a live proxy
+	client.PrependReactor("get", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "pods"}, pod.Name, errors.New("denied"))
+	})
+	replaced, err = proxyReplaced(context.TODO(), client, *pod)
+	require.True(apierrors.IsForbidden(err), "expected Forbidden, got %v", err)
+	require.False(replaced)
+}
@@ -0,0 +1,44 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// resizePollInterval is how often the console size is checked, Windows has
+// no signal for console resizes.
+const resizePollInterval = 250 * time.Millisecond
+
+// notifyResize signals on resized periodically, the size queue drops
+// reports that did not change the size.
+func notifyResize(ctx context.Context, resized chan<- struct{}) {
+	ticker := time.NewTicker(resizePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			select {
+			case resized <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,380 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	snapshotPrefix = "mittens-snapshot-"
+	snapshotKey    = "snapshot.json"
+	// labelSnapshot marks the snapshot ConfigMap with the name of the tapped Service.
+	labelSnapshot = "mittens.io/snapshot"
+	// snapshotAnnotationPrefix prefixes the annotationConfigMap value of
+	// snapshots, so cleanup finds them next to the proxy configs.
+	snapshotAnnotationPrefix = "snapshot-"
+)
+
+// tapAnnotations are the Service annotations a tap sets.
+var tapAnnotations = []string{
+	annotationOriginalTargetPort,
+	annotationProtocol,
+	annotationUI,
+	annotationStrategy,
+	annotationOriginalSelector,
+	annotationCanaryPort,
+	annotationExpiresAt,
+	annotationTappedAt,
+	fluxDriftDetectionAnnotation,
+}
+
+// snapshot is the state of a Service and its workload before they were
+// tapped, which untap restores and verifies against.
+type snapshot struct {
+	Service serviceSnapshot `json:"service"`
+	// Workload is nil for standalone taps, which never resolve a workload.
+	Workload *workloadSnapshot `json:"workload,omitempty"`
+}
+
+// serviceSnapshot holds the fields of a Service a tap modifies.
+type serviceSnapshot struct {
+	Name        string            `json:"name"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Selector    map[string]string `json:"selector,omitempty"`
+	Ports       []v1.ServicePort  `json:"ports"`
+}
+
+// workloadSnapshot holds the pod template of a workload.
+type workloadSnapshot struct {
+	Kind     string             `json:"kind"`
+	Name     string             `json:"name"`
+	Template v1.PodTemplateSpec `json:"template"`
+}
+
+// newSnapshot captures a Service and its workload, which may be nil.
+func newSnapshot(svc *v1.Service, workload Workload) snapshot {
+	s := snapshot{
+		Service: serviceSnapshot{
+			Name:        svc.Name,
+			Annotations: svc.GetAnnotations(),
+			Selector:    svc.Spec.Selector,
+			Ports:       svc.Spec.Ports,
+		},
+	}
+	if workload != nil {
+		s.Workload = &workloadSnapshot{
+			Kind:     workload.Kind(),
+			Name:     workload.Name(),
+			Template: *workload.PodTemplate().DeepCopy(),
+		}
+	}
+	return s
+}
+
+// saveSnapshot stores a snapshot in a ConfigMap next to the Service,
+// replacing a stale one left behind by an interrupted tap.
+func saveSnapshot(cmClient corev1.ConfigMapInterface, s snapshot) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("error encoding snapshot: %w", err)
+	}
+	cm := v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   standaloneName(snapshotPrefix, s.Service.Name),
+			Labels: map[string]string{labelSnapshot: s.Service.Name},
+			Annotations: map[string]string{
+				annotationConfigMap: snapshotAnnotationPrefix + s.Service.Name,
+			},
+		},
+		Data: map[string]string{snapshotKey: string(data)},
+	}
+	_, err = cmClient.Create(context.TODO(), &cm, metav1.CreateOptions{FieldManager: fieldManager})
+	if apierrors.IsAlreadyExists(err) {
+		_, err = cmClient.Update(context.TODO(), &cm, metav1.UpdateOptions{FieldManager: fieldManager})
+	}
+	if err != nil {
+		return fmt.Errorf("error saving snapshot: %w", err)
+	}
+	return nil
+}
+
+// loadSnapshot returns the snapshot of a Service, or nil for Services tapped
+// before snapshots were taken.
+func loadSnapshot(cmClient corev1.ConfigMapInterface, svcName string) (*snapshot, error) {
+	cm, err := cmClient.Get(context.TODO(), standaloneName(snapshotPrefix, svcName), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting snapshot: %w", err)
+	}
+	return decodeSnapshot(*cm)
+}
+
+// decodeSnapshot reads the snapshot stored in a ConfigMap.
+func decodeSnapshot(cm v1.ConfigMap) (*snapshot, error) {
+	var s snapshot
+	if err := json.Unmarshal([]byte(cm.Data[snapshotKey]), &s); err != nil {
+		return nil, fmt.Errorf("error decoding snapshot %q: %w", cm.Name, err)
+	}
+	return &s, nil
+}
+
+// deleteSnapshot removes the snapshot of a Service, if any.
+func deleteSnapshot(cmClient corev1.ConfigMapInterface, svcName string) error {
+	err := cmClient.Delete(context.TODO(), standaloneName(snapshotPrefix, svcName), metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error deleting snapshot: %w", err)
+	}
+	return nil
+}
+
+// snapshotsIn returns the snapshots among ConfigMaps by namespace and Service
+// name. ConfigMaps that cannot be decoded are skipped.
+func snapshotsIn(cms []v1.ConfigMap) map[types.NamespacedName]*snapshot {
+	snaps := map[types.NamespacedName]*snapshot{}
+	for _, cm := range cms {
+		svcName, ok := cm.GetLabels()[labelSnapshot]
+		if !ok {
+			continue
+		}
+		if s, err := decodeSnapshot(cm); err == nil {
+			snaps[types.NamespacedName{Namespace: cm.Namespace, Name: svcName}] = s
+		}
+	}
+	return snaps
+}
+
+// workloadSnapshotIn returns the snapshot of a workload among snaps, or nil.
+func workloadSnapshotIn(snaps map[types.NamespacedName]*snapshot, w Workload) *workloadSnapshot {
+	for key, s := range snaps {
+		if key.Namespace == w.Namespace() && s.matches(w) {
+			return s.Workload
+		}
+	}
+	return nil
+}
+
+// matches reports whether the snapshot was taken of a workload.
+func (s *snapshot) matches(w Workload) bool {
+	return s != nil && s.Workload != nil && s.Workload.Kind == w.Kind() && s.Workload.Name == w.Name()
+}
+
+// restore sets the tapped port, the selector if the tap swapped it and the
+// tap annotations of a Service back to the snapshot. Other ports and
+// annotations may have changed during the tap and are kept.
+func (s serviceSnapshot) restore(svc *v1.Service) {
+	canaryPort := svc.GetAnnotations()[annotationCanaryPort]
+	for i, sp := range svc.Spec.Ports {
+		if sp.TargetPort.IntValue() != mittensProxyListenPort && strconv.Itoa(int(sp.Port)) != canaryPort {
+			continue
+		}
+		for _, orig := range s.Ports {
+			if orig.Port == sp.Port && servicePortProtocol(orig) == servicePortProtocol(sp) {
+				svc.Spec.Ports[i].Name = orig.Name
+				svc.Spec.Ports[i].TargetPort = orig.TargetPort
+			}
+		}
+	}
+	if _, ok := svc.GetAnnotations()[annotationOriginalSelector]; ok {
+		svc.Spec.Selector = s.Selector
+	}
+	anns := map[string]string{}
+	for k, v := range svc.GetAnnotations() {
+		anns[k] = v
+	}
+	for _, k := range tapAnnotations {
+		if v, ok := s.Annotations[k]; ok {
+			anns[k] = v
+		} else {
+			delete(anns, k)
+		}
+	}
+	if len(anns) == 0 && s.Annotations == nil {
+		anns = nil
+	}
+	svc.SetAnnotations(anns)
+}
+
+// restore removes the containers and volumes the tap added to a pod
+// template and restores the tapped annotation. It reports whether a
+// container was removed.
+func (s workloadSnapshot) restore(tmpl *v1.PodTemplateSpec) bool {
+	containers := map[string]bool{}
+	for _, c := range s.Template.Spec.Containers {
+		containers[c.Name] = true
+	}
+	var keptContainers []v1.Container
+	for _, c := range tmpl.Spec.Containers {
+		if containers[c.Name] {
+			keptContainers = append(keptContainers, c)
+		}
+	}
+	removed := len(keptContainers) != len(tmpl.Spec.Containers)
+	tmpl.Spec.Containers = keptContainers
+
+	volumes := map[string]bool{}
+	for _, vol := range s.Template.Spec.Volumes {
+		volumes[vol.Name] = true
+	}
+	var keptVolumes []v1.Volume
+	for _, vol := range tmpl.Spec.Volumes {
+		if volumes[vol.Name] {
+			keptVolumes = append(keptVolumes, vol)
+		}
+	}
+	tmpl.Spec.Volumes = keptVolumes
+
+	anns := tmpl.GetAnnotations()
+	if v, ok := s.Template.GetAnnotations()[annotationIsTapped]; ok {
+		if anns == nil {
+			anns = map[string]string{}
+		}
+		anns[annotationIsTapped] = v
+	} else {
+		delete(anns, annotationIsTapped)
+	}
+	if len(anns) == 0 && s.Template.Annotations == nil {
+		anns = nil
+	}
+	tmpl.SetAnnotations(anns)
+	return removed
+}
+
+// verifySnapshot writes a warning for every field of the Service and the
+// workload that does not match the snapshot. The snapshot is deleted only
+// when everything matches, so the untap can be retried. The workload may be
+// nil.
+func verifySnapshot(out io.Writer, client kubernetes.Interface, namespace string, s *snapshot, workload Workload) error {
+	if s == nil {
+		return nil
+	}
+	svc, err := client.CoreV1().Services(namespace).Get(context.TODO(), s.Service.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	svcDiffs := diffFields("", s.Service, newSnapshot(svc, nil).Service)
+	printDiffs(out, "Service", s.Service.Name, svcDiffs)
+	var workloadDiffs []string
+	if workload != nil && s.matches(workload) {
+		if err := workload.Refresh(); err != nil {
+			return err
+		}
+		workloadDiffs = diffFields("template", s.Workload.Template, workload.PodTemplate())
+		printDiffs(out, workload.Kind(), workload.Name(), workloadDiffs)
+	}
+	if len(svcDiffs) > 0 || len(workloadDiffs) > 0 {
+		_, _ = fmt.Fprintf(out, "The snapshot is kept in ConfigMap %q. Fix the fields above and run \"kubectl mittens untap %s -n %s\" again, or delete the snapshot with \"kubectl mittens cleanup -n %s\".\n",
+			standaloneName(snapshotPrefix, s.Service.Name), s.Service.Name, namespace, namespace)
+		return nil
+	}
+	return deleteSnapshot(client.CoreV1().ConfigMaps(namespace), s.Service.Name)
+}
+
+// printDiffs warns about the fields of a resource that differ from its snapshot.
+func printDiffs(out io.Writer, kind, name string, diffs []string) {
+	if len(diffs) == 0 {
+		return
+	}
+	_, _ = fmt.Fprintf(out, "Warning: %s %q does not match its state before the tap:\n", kind, name)
+	for _, d := range diffs {
+		_, _ = fmt.Fprintf(out, "  %s\n", d)
+	}
+}
+
+// diffFields returns the paths of the fields that differ between want and
+// got, compared through their JSON encoding.
+func diffFields(path string, want, got interface{}) []string {
+	var w, g interface{}
+	if b, err := json.Marshal(want); err == nil {
+		_ = json.Unmarshal(b, &w)
+	}
+	if b, err := json.Marshal(got); err == nil {
+		_ = json.Unmarshal(b, &g)
+	}
+	return diffValues(path, w, g)
+}
+
+func diffValues(path string, want, got interface{}) []string {
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := map[string]bool{}
+		for k := range w {
+			keys[k] = true
+		}
+		for k := range g {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+		var diffs []string
+		for _, k := range sorted {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			diffs = append(diffs, diffValues(p, w[k], g[k])...)
+		}
+		return diffs
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok {
+			break
+		}
+		var diffs []string
+		for i := 0; i < len(w) || i < len(g); i++ {
+			p := path + "[" + strconv.Itoa(i) + "]"
+			switch {
+			case i >= len(g):
+				diffs = append(diffs, p+" (removed)")
+			case i >= len(w):
+				diffs = append(diffs, p+" (added)")
+			default:
+				diffs = append(diffs, diffValues(p, w[i], g[i])...)
+			}
+		}
+		return diffs
+	}
+	if reflect.DeepEqual(want, got) {
+		return nil
+	}
+	switch {
+	case want == nil:
+		return []string{path + " (added)"}
+	case got == nil:
+		return []string{path + " (removed)"}
+	}
+	return []string{path}
+}
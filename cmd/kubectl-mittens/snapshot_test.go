@@ -0,0 +1,196 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func Test_SnapshotRestore(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Drift    func(*fake.Clientset) error
+		Warnings []string
+		Check    func(*require.Assertions, *v1.Service)
+	}{
+		{"exact", nil, nil, nil},
+		{"image_changed", func(c *fake.Clientset) error {
+			dpl, err := c.AppsV1().Deployments("default").Get(context.TODO(), "sample-deployment", metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			dpl.Spec.Template.Spec.Containers[0].Image = "ghcr.io/lappihuan/someapp:v2"
+			_, err = c.AppsV1().Deployments("default").Update(context.TODO(), dpl, metav1.UpdateOptions{})
+			return err
+		}, []string{`Deployment "sample-deployment"`, "template.spec.containers[0].image"}, nil},
+		{"annotation_added", func(c *fake.Clientset) error {
+			svc, err := c.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			svc.Annotations["added-during-tap"] = "yes"
+			_, err = c.CoreV1().Services("default").Update(context.TODO(), svc, metav1.UpdateOptions{})
+			return err
+		}, []string{`Service "sample-service"`, "annotations.added-during-tap (added)"}, nil},
+		{"port_added", func(c *fake.Clientset) error {
+			svc, err := c.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{Name: "metrics", Port: 9090, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(9090)})
+			_, err = c.CoreV1().Services("default").Update(context.TODO(), svc, metav1.UpdateOptions{})
+			return err
+		}, []string{`Service "sample-service"`, "ports"}, func(require *require.Assertions, svc *v1.Service) {
+			require.Len(svc.Spec.Ports, 2, "the port added during the tap must be kept")
+			require.Equal(intstr.FromInt(9090), svc.Spec.Ports[1].TargetPort)
+			require.NotEqual(mittensProxyListenPort, svc.Spec.Ports[0].TargetPort.IntValue(), "the tapped port must be restored")
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			fakeClient := fakeClientUntappedWithUserVolume()
+			origSvc, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+			require.Nil(err)
+			origDpl, err := fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "sample-deployment", metav1.GetOptions{})
+			require.Nil(err)
+			testViper := viper.New()
+			testViper.Set("proxyPort", 80)
+			testViper.Set("namespace", "default")
+			testViper.Set("proxyImage", defaultImageHTTP)
+			testViper.Set("commandArgs", defaultCommandArgs)
+			b := bytes.NewBufferString("")
+			cmd := &cobra.Command{}
+			cmd.SetOutput(b)
+			require.Nil(NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+
+			snap, err := loadSnapshot(fakeClient.CoreV1().ConfigMaps("default"), "sample-service")
+			require.Nil(err)
+			require.NotNil(snap)
+			require.Equal(origSvc.Spec.Ports, snap.Service.Ports)
+			require.Equal(kindDeployment, snap.Workload.Kind)
+			require.Equal(origDpl.Spec.Template, snap.Workload.Template)
+
+			if tc.Drift != nil {
+				require.Nil(tc.Drift(fakeClient))
+			}
+			b.Reset()
+			require.Nil(NewUntapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+			if len(tc.Warnings) == 0 {
+				require.NotContains(b.String(), "Warning")
+				svc, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+				require.Nil(err)
+				require.Equal(origSvc.Spec, svc.Spec)
+				require.Equal(origSvc.GetAnnotations(), svc.GetAnnotations(), "the original Flux annotation must be restored")
+				dpl, err := fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "sample-deployment", metav1.GetOptions{})
+				require.Nil(err)
+				require.Equal(origDpl.Spec.Template, dpl.Spec.Template, "the user volume must be kept")
+			}
+			for _, w := range tc.Warnings {
+				require.Contains(b.String(), w)
+			}
+			if tc.Check != nil {
+				svc, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+				require.Nil(err)
+				tc.Check(require, svc)
+			}
+			_, err = fakeClient.CoreV1().ConfigMaps("default").Get(context.TODO(), snapshotPrefix+"sample-service", metav1.GetOptions{})
+			if len(tc.Warnings) == 0 {
+				require.True(apierrors.IsNotFound(err), "the snapshot must be deleted")
+				return
+			}
+			require.Nil(err, "the snapshot must be kept when the resources do not match it")
+			require.Contains(b.String(), "kubectl mittens cleanup -n default")
+		})
+	}
+}
+
+func Test_CleanupSnapshot(t *testing.T) {
+	require := require.New(t)
+	fakeClient := fakeClientUntappedWithUserVolume()
+	origDpl, err := fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "sample-deployment", metav1.GetOptions{})
+	require.Nil(err)
+	testViper := viper.New()
+	testViper.Set("proxyPort", 80)
+	testViper.Set("namespace", "default")
+	testViper.Set("proxyImage", defaultImageHTTP)
+	testViper.Set("commandArgs", defaultCommandArgs)
+	cmd := &cobra.Command{}
+	cmd.SetOutput(bytes.NewBufferString(""))
+	require.Nil(NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+
+	testViper.Set("yes", true)
+	require.Nil(NewCleanupCommand(fakeClient, &rest.Config{}, testViper)(cmd, nil))
+	l, err := findLeftovers(context.TODO(), fakeClient, "default")
+	require.Nil(err)
+	require.True(l.empty())
+	dpl, err := fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "sample-deployment", metav1.GetOptions{})
+	require.Nil(err)
+	require.Equal(origDpl.Spec.Template, dpl.Spec.Template)
+	svc, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+	require.Nil(err)
+	require.Equal(fluxDriftDetectionEnabled, svc.GetAnnotations()[fluxDriftDetectionAnnotation])
+}
+
+func Test_DiffFields(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Want     interface{}
+		Got      interface{}
+		Expected []string
+	}{
+		{"equal", v1.ServicePort{Port: 80}, v1.ServicePort{Port: 80}, nil},
+		{"changed", v1.ServicePort{Port: 80, TargetPort: intstr.FromInt(8080)}, v1.ServicePort{Port: 80, TargetPort: intstr.FromInt(7777)}, []string{"spec.targetPort"}},
+		{"added", map[string]string{"a": "1"}, map[string]string{"a": "1", "b": "2"}, []string{"spec.b (added)"}},
+		{"removed", map[string]string{"a": "1", "b": "2"}, map[string]string{"a": "1"}, []string{"spec.b (removed)"}},
+		{"extra_item", []string{"a"}, []string{"a", "b"}, []string{"spec[1] (added)"}},
+		{"missing_item", []string{"a", "b"}, []string{"a"}, []string{"spec[1] (removed)"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require.Equal(t, tc.Expected, diffFields("spec", tc.Want, tc.Got))
+		})
+	}
+}
+
+// fluxDriftDetectionEnabled is set by the user before the tap.
+const fluxDriftDetectionEnabled = "enabled"
+
+// fakeClientUntappedWithUserVolume has a user volume named like the proxy
+// volumes and a Flux annotation the tap overwrites.
+func fakeClientUntappedWithUserVolume() *fake.Clientset {
+	namespace := simpleNamespace
+	deployment := simpleDeployment.DeepCopy()
+	deployment.Spec.Template.Spec.Volumes = []v1.Volume{
+		{Name: "mittens-data", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}},
+	}
+	service := simpleService.DeepCopy()
+	service.Annotations = map[string]string{
+		"my-annotation":              "some-annotation",
+		fluxDriftDetectionAnnotation: fluxDriftDetectionEnabled,
+	}
+	return fake.NewSimpleClientset(&namespace, deployment, service)
+}
@@ -71,6 +71,21 @@ func (s *Spinner) Fail(message string) {
 	}
 }
 
+// Warn stops the spinner and displays a warning message.
+func (s *Spinner) Warn(message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.spinner != nil && !s.stopped {
+		_ = s.spinner.Stop()
+		// Give the spinner goroutine time to fully stop
+		time.Sleep(50 * time.Millisecond)
+		pterm.Warning.Println(message)
+		s.spinner = nil
+		s.stopped = true
+	}
+}
+
 // Update updates the spinner text.
 func (s *Spinner) Update(message string) {
 	s.mu.Lock()
@@ -0,0 +1,180 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	k8sappsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// strategyStandalone runs the proxy in a Deployment of its own, so the
+	// tapped workload is never modified.
+	strategyStandalone = "standalone"
+
+	standaloneProxyPrefix  = "mittens-proxy-"
+	standaloneShadowPrefix = "mittens-shadow-"
+	// labelStandalone marks the proxy Deployment, its Pods and the shadow
+	// Service with the name of the tapped Service.
+	labelStandalone = "mittens.io/standalone"
+)
+
+// ErrStandaloneMultiPort occurs when a standalone tap would break the other
+// ports of a Service, as its selector is pointed at the proxy as a whole.
+var ErrStandaloneMultiPort = errors.New("standalone taps redirect the whole Service, it must only expose the tapped port")
+
+// standaloneName returns the name of a standalone resource of a Service,
+// shortened to fit a DNS label.
+func standaloneName(prefix, svcName string) string {
+	name := prefix + svcName
+	if len(name) > validation.DNS1035LabelMaxLength {
+		name = strings.TrimRight(name[:validation.DNS1035LabelMaxLength], "-")
+	}
+	return name
+}
+
+// standaloneLabels select the Pods of the proxy Deployment of a Service.
+func standaloneLabels(svcName string) map[string]string {
+	return map[string]string{labelStandalone: svcName}
+}
+
+// tapStandalone creates a shadow Service selecting the original Pods and a
+// proxy Deployment forwarding to it. The tapped Service is left untouched,
+// see tapSvc for pointing it at the proxy.
+func tapStandalone(client kubernetes.Interface, targetService *v1.Service, targetPort int32, image string, commandArgs []string, proxyOpts ProxyOptions) error {
+	namespace := proxyOpts.Namespace
+	if len(targetService.Spec.Selector) == 0 {
+		return ErrSelectorsMissing
+	}
+	var tappedPort *v1.ServicePort
+	for i, sp := range targetService.Spec.Ports {
+		if sp.Port != targetPort || servicePortProtocol(sp) != proxyOpts.Protocol.ServiceProtocol() {
+			return fmt.Errorf("%w: port %d/%s is not tapped", ErrStandaloneMultiPort, sp.Port, servicePortProtocol(sp))
+		}
+		tappedPort = &targetService.Spec.Ports[i]
+	}
+	if tappedPort == nil {
+		return ErrServiceMissingPort
+	}
+
+	labels := standaloneLabels(targetService.Name)
+	selector := make(map[string]string, len(targetService.Spec.Selector))
+	for k, v := range targetService.Spec.Selector {
+		selector[k] = v
+	}
+	shadow := v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      standaloneName(standaloneShadowPrefix, targetService.Name),
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: v1.ServiceSpec{
+			Selector: selector,
+			Ports: []v1.ServicePort{
+				{
+					Name:       tappedPort.Name,
+					Protocol:   tappedPort.Protocol,
+					Port:       tappedPort.Port,
+					TargetPort: tappedPort.TargetPort,
+				},
+			},
+		},
+	}
+	if _, err := client.CoreV1().Services(namespace).Create(context.TODO(), &shadow, metav1.CreateOptions{FieldManager: fieldManager}); err != nil {
+		return fmt.Errorf("error creating shadow Service: %w", err)
+	}
+
+	proxyName := standaloneName(standaloneProxyPrefix, targetService.Name)
+	proxyOpts.UpstreamHost = shadow.Name
+	proxyOpts.UpstreamPort = strconv.Itoa(int(tappedPort.Port))
+	proxyOpts.workloadName = proxyName
+	proxy, err := NewTap(client, proxyOpts)
+	if err != nil {
+		return err
+	}
+	if err := proxy.ReadyEnv(); err != nil {
+		return err
+	}
+	sidecar := proxy.Sidecar(proxyName)
+	sidecar.Image = image
+	if len(commandArgs) > 0 {
+		sidecar.Args = commandArgs
+	}
+	replicas := int32(1)
+	dpl := k8sappsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      proxyName,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: k8sappsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+					Annotations: map[string]string{
+						annotationIsTapped: proxyName,
+					},
+				},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{sidecar},
+				},
+			},
+		},
+	}
+	proxy.PatchWorkload(&dpl.Spec.Template, proxyName)
+	if _, err := client.AppsV1().Deployments(namespace).Create(context.TODO(), &dpl, metav1.CreateOptions{FieldManager: fieldManager}); err != nil {
+		return fmt.Errorf("error creating proxy Deployment: %w", err)
+	}
+	return nil
+}
+
+// untapStandalone deletes the proxy Deployment, the shadow Service and the
+// proxy config of a standalone tap. Resources that are already gone are skipped.
+func untapStandalone(client kubernetes.Interface, namespace, svcName string, protocol Protocol, ui string) error {
+	proxyName := standaloneName(standaloneProxyPrefix, svcName)
+	proxy, err := NewTap(client, ProxyOptions{
+		Namespace:    namespace,
+		Target:       svcName,
+		Protocol:     protocol,
+		UI:           ui,
+		workloadName: proxyName,
+	})
+	if err != nil {
+		return err
+	}
+	if err := proxy.UnreadyEnv(); err != nil && !errors.Is(err, ErrConfigMapNoMatch) {
+		return err
+	}
+	err = client.AppsV1().Deployments(namespace).Delete(context.TODO(), proxyName, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error deleting proxy Deployment: %w", err)
+	}
+	err = client.CoreV1().Services(namespace).Delete(context.TODO(), standaloneName(standaloneShadowPrefix, svcName), metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error deleting shadow Service: %w", err)
+	}
+	return nil
+}
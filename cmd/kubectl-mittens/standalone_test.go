@@ -0,0 +1,174 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func Test_TapStandalone(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Client   func() *fake.Clientset
+		Protocol string
+		UI       string
+		Upstream string
+		Err      error
+	}{
+		{"http", fakeClientUntappedSimple, "http", "", "reverse:http://mittens-shadow-sample-service:80", nil},
+		{"tcp", fakeClientUntappedSimple, "tcp", "", "mittens-shadow-sample-service:80", nil},
+		{"multi_port", fakeClientUntappedMultiPort, "http", "", "", ErrStandaloneMultiPort},
+		{"local_ui", fakeClientUntappedSimple, "http", uiLocal, "", ErrUINotSupported},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			fakeClient := tc.Client()
+			origSvc, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+			require.Nil(err)
+			testViper := viper.New()
+			testViper.Set("proxyPort", 80)
+			testViper.Set("namespace", "default")
+			testViper.Set("protocol", tc.Protocol)
+			testViper.Set("ui", tc.UI)
+			testViper.Set("strategy", strategyStandalone)
+			testViper.Set("proxyImage", defaultImageHTTP)
+			testViper.Set("commandArgs", defaultCommandArgs)
+			cmd := &cobra.Command{}
+			cmd.SetOutput(ioutil.Discard)
+			err = NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+			if tc.Err != nil {
+				require.True(errors.Is(err, tc.Err), "expected (%v), got (%v)", tc.Err, err)
+				// nothing is left behind
+				_, err = fakeClient.CoreV1().Services("default").Get(context.TODO(), "mittens-shadow-sample-service", metav1.GetOptions{})
+				require.True(apierrors.IsNotFound(err))
+				return
+			}
+			require.Nil(err)
+
+			// the tapped workload is not touched
+			dpl, err := fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "sample-deployment", metav1.GetOptions{})
+			require.Nil(err)
+			require.Len(dpl.Spec.Template.Spec.Containers, 1)
+
+			shadow, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "mittens-shadow-sample-service", metav1.GetOptions{})
+			require.Nil(err)
+			require.Equal(origSvc.Spec.Selector, shadow.Spec.Selector)
+			require.Equal(intstr.FromInt(8080), shadow.Spec.Ports[0].TargetPort)
+
+			proxyDpl, err := fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "mittens-proxy-sample-service", metav1.GetOptions{})
+			require.Nil(err)
+			require.Equal(mittensContainerName, proxyDpl.Spec.Template.Spec.Containers[0].Name)
+			if Protocol(tc.Protocol) == protocolTCP {
+				require.Contains(proxyDpl.Spec.Template.Spec.Containers[0].Env, v1.EnvVar{Name: "MITTENS_UPSTREAM", Value: tc.Upstream})
+			} else {
+				cm, err := fakeClient.CoreV1().ConfigMaps("default").Get(context.TODO(), mittensConfigMapPrefix+"mittens-proxy-sample-service", metav1.GetOptions{})
+				require.Nil(err)
+				require.Contains(string(cm.BinaryData[mitmproxyConfigFile]), tc.Upstream)
+			}
+
+			svc, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+			require.Nil(err)
+			require.Equal(standaloneLabels("sample-service"), svc.Spec.Selector)
+			require.Equal(strategyStandalone, tappedStrategy(svc))
+			require.Equal(int32(mittensProxyListenPort), svc.Spec.Ports[0].TargetPort.IntVal)
+
+			// the proxy is found through the rewritten selector
+			w, err := workloadFromSelectors(fakeClient, "default", svc.Spec.Selector)
+			require.Nil(err)
+			require.Equal("mittens-proxy-sample-service", w.Name())
+
+			require.Nil(NewUntapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+			svc, err = fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+			require.Nil(err)
+			require.Equal(origSvc.Spec, svc.Spec, "untap must restore the Service exactly")
+			require.Equal(origSvc.GetAnnotations(), svc.GetAnnotations())
+			_, err = fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "mittens-proxy-sample-service", metav1.GetOptions{})
+			require.True(apierrors.IsNotFound(err))
+			_, err = fakeClient.CoreV1().Services("default").Get(context.TODO(), "mittens-shadow-sample-service", metav1.GetOptions{})
+			require.True(apierrors.IsNotFound(err))
+			cms, err := fakeClient.CoreV1().ConfigMaps("default").List(context.TODO(), metav1.ListOptions{})
+			require.Nil(err)
+			require.Empty(cms.Items)
+		})
+	}
+}
+
+func Test_CleanupStandalone(t *testing.T) {
+	require := require.New(t)
+	fakeClient := fakeClientUntappedSimple()
+	testViper := viper.New()
+	testViper.Set("proxyPort", 80)
+	testViper.Set("namespace", "default")
+	testViper.Set("strategy", strategyStandalone)
+	testViper.Set("proxyImage", defaultImageHTTP)
+	testViper.Set("commandArgs", defaultCommandArgs)
+	cmd := &cobra.Command{}
+	cmd.SetOutput(ioutil.Discard)
+	require.Nil(NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+
+	l, err := findLeftovers(context.TODO(), fakeClient, "default")
+	require.Nil(err)
+	require.Len(l.Services, 1)
+	require.Empty(l.Workloads, "the proxy Deployment is deleted, not untapped")
+	require.Len(l.ProxyDeployments, 1)
+	require.Len(l.ShadowServices, 1)
+	require.Len(l.ConfigMaps, 2, "the proxy config and the snapshot")
+
+	testViper.Set("yes", true)
+	require.Nil(NewCleanupCommand(fakeClient, &rest.Config{}, testViper)(cmd, nil))
+	l, err = findLeftovers(context.TODO(), fakeClient, "default")
+	require.Nil(err)
+	require.True(l.empty())
+	svc, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+	require.Nil(err)
+	require.Equal(simpleService.Spec.Selector, svc.Spec.Selector)
+}
+
+func Test_StandaloneName(t *testing.T) {
+	require.Equal(t, "mittens-proxy-sample-service", standaloneName(standaloneProxyPrefix, "sample-service"))
+	// the name is cut right after a dash, which must not end the label
+	long := standaloneName(standaloneShadowPrefix, strings.Repeat("a", 47)+"-"+strings.Repeat("b", 15))
+	require.Equal(t, standaloneShadowPrefix+strings.Repeat("a", 47), long)
+}
+
+func fakeClientUntappedMultiPort() *fake.Clientset {
+	namespace := simpleNamespace
+	deployment := simpleDeployment
+	service := *simpleService.DeepCopy()
+	service.Spec.Ports = append(service.Spec.Ports, v1.ServicePort{
+		Name:       "metrics",
+		Port:       9090,
+		TargetPort: intstr.FromInt(9090),
+	})
+	return fake.NewSimpleClientset(
+		&namespace,
+		&deployment,
+		&service,
+	)
+}
@@ -15,10 +15,11 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"os"
-	"os/exec"
 	"os/signal"
 	"strconv"
 	"strings"
@@ -27,15 +28,13 @@ import (
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	k8sappsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes"
-	appsv1 "k8s.io/client-go/kubernetes/typed/apps/v1"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
-	"k8s.io/client-go/util/retry"
 
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 )
@@ -48,7 +47,6 @@ const (
 	mittensProxyListenPort = 7777
 	mittensConfigMapPrefix = "mittens-target-"
 
-	interactiveTimeoutSeconds = 90
 	configMapAnnotationPrefix = "target-"
 
 	// Flux drift detection annotation to prevent automatic rollback of Service mutations.
@@ -59,43 +57,75 @@ const (
 	protocolTCP  Protocol = "tcp"
 	protocolUDP  Protocol = "udp"
 	protocolGRPC Protocol = "grpc"
+
+	uiTUI   = "tui"
+	uiWeb   = "web"
+	uiLocal = "local"
 )
 
 var (
-	ErrNamespaceNotExist          = errors.New("the provided Namespace does not exist")
-	ErrServiceMissingPort         = errors.New("the target Service does not have the provided port")
-	ErrServiceSelectorNoMatch     = errors.New("the Service selector did not match any Deployments")
-	ErrServiceSelectorMultiMatch  = errors.New("the Service selector matched multiple Deployments")
-	ErrDeploymentOutsideNamespace = errors.New("the Service selector matched Deployment outside the specified Namespace")
-	ErrSelectorsMissing           = errors.New("no selectors are set for the target Service")
-	ErrConfigMapNoMatch           = errors.New("the ConfigMap list did not match any ConfigMaps")
-	ErrMittensPodNoMatch          = errors.New("a Mittens Pod was not found")
-	ErrCreateResourceMismatch     = errors.New("the created resource did not match the desired state")
-	ErrDeploymentMissingPorts     = errors.New("error resolving Service port number by name from Deployment")
+	ErrNamespaceNotExist         = errors.New("the provided Namespace does not exist")
+	ErrServiceMissingPort        = errors.New("the target Service does not have the provided port")
+	ErrServiceSelectorNoMatch    = errors.New("the Service selector did not match any workloads")
+	ErrServiceSelectorMultiMatch = errors.New("the Service selector matched multiple workloads")
+	ErrWorkloadOutsideNamespace  = errors.New("the Service selector matched a workload outside the specified Namespace")
+	ErrSelectorsMissing          = errors.New("no selectors are set for the target Service")
+	ErrConfigMapNoMatch          = errors.New("the ConfigMap list did not match any ConfigMaps")
+	ErrMittensPodNoMatch         = errors.New("a Mittens Pod was not found")
+	ErrCreateResourceMismatch    = errors.New("the created resource did not match the desired state")
+	ErrWorkloadMissingPorts      = errors.New("error resolving Service port number by name from the workload")
+	ErrProtocolNotSupported      = errors.New("the protocol is not supported")
 )
 
 // Protocol is a supported tap method, and ultimately determines what container
 // is injected as a sidecar.
 type Protocol string
 
+// ServiceProtocol returns the transport protocol of Service ports carrying
+// traffic of the tap protocol.
+func (p Protocol) ServiceProtocol() v1.Protocol {
+	if p == protocolUDP {
+		return v1.ProtocolUDP
+	}
+	return v1.ProtocolTCP
+}
+
+// servicePortProtocol returns the protocol of a Service port, which defaults to TCP.
+func servicePortProtocol(sp v1.ServicePort) v1.Protocol {
+	if sp.Protocol == "" {
+		return v1.ProtocolTCP
+	}
+	return sp.Protocol
+}
+
 // Tap is a method of implementing a "Tap" for a Kubernetes cluster.
 type Tap interface {
 	// Sidecar produces a sidecar container to be added to a
-	// Deployment.
+	// workload.
 	Sidecar(string) v1.Container
 
-	// PatchDeployment tweaks a Deployment after a Sidecar is added
-	// during the tap process.
+	// PatchWorkload tweaks the pod template of a workload after a
+	// Sidecar is added during the tap process. Resources the sidecar
+	// needs are named after workloadName, the workload that is tapped.
 	// Example: mitmproxy calls this function to configure the ConfigMap volume refs.
-	PatchDeployment(*k8sappsv1.Deployment)
+	PatchWorkload(tmpl *v1.PodTemplateSpec, workloadName string)
 
 	// ReadyEnv and UnreadyEnv are used to prepare the environment
 	// with resources that will be necessary for the sidecar, but do
-	// not exist within a given Deployment.
+	// not exist within a given workload.
 	// Example: mitmproxy calls this function to apply and remove ConfigMaps for mitmproxy.
 	ReadyEnv() error
 	UnreadyEnv() error
 
+	// AttachCommand returns the command executed in the sidecar to
+	// attach to its interactive session.
+	AttachCommand() []string
+
+	// SessionCommand returns a command executed in the sidecar that
+	// succeeds while the interactive session is still running. It is
+	// used to tell a detached client from one that ended the session.
+	SessionCommand() []string
+
 	// String prints the tap method, be it mitmproxy, tcpdump, etc.
 	String() string
 
@@ -107,44 +137,89 @@ type Tap interface {
 type ProxyOptions struct {
 	// Target is the target Service
 	Target string `json:"target"`
-	// Protocol is the protocol type, one of [http, https]
+	// Protocol is the protocol type, one of [http, tcp, udp, grpc]
 	Protocol Protocol `json:"protocol"`
 	// UpstreamHTTPS should be set to true if the target is using HTTPS
 	UpstreamHTTPS bool `json:"upstreamHttps"`
 	// UpstreamPort is the listening port for the target Service
 	UpstreamPort string `json:"upstreamPort"`
+	// UpstreamHost is the host the proxy forwards to, the tapped container
+	// next to it when empty
+	UpstreamHost string `json:"upstreamHost"`
 	// Mode is the proxy mode. Only "reverse" is currently supported.
 	Mode string `json:"mode"`
-	// Namespace is the namespace that the Service and Deployment are in
+	// Namespace is the namespace that the Service and workload are in
 	Namespace string `json:"namespace"`
 	// Image is the proxy image to deploy as a sidecar
 	Image string `json:"image"`
+	// Decoder is an optional payload decoder for UDP taps, e.g. "dns"
+	Decoder string `json:"decoder"`
+	// ProtoFiles are .proto files or FileDescriptorSets, keyed by file name,
+	// used by gRPC taps to decode messages
+	ProtoFiles map[string][]byte `json:"-"`
+	// UI is the mitmproxy interface, one of [tui, web, local]
+	UI string `json:"ui"`
+	// WebToken protects the mitmweb UI
+	WebToken string `json:"-"`
+	// Strategy is how the proxy is added to the Pods, one of [template, ephemeral]
+	Strategy string `json:"strategy"`
+	// ExpiresAt is when the tap is removed, zero for taps without a duration
+	ExpiresAt time.Time `json:"-"`
+
+	// workloadName tracks the current workload target
+	workloadName string
+	// canaryPort is the named port canary taps point the Service at
+	canaryPort string
+}
+
+// upstream returns the address the proxy forwards traffic to.
+func (p ProxyOptions) upstream() string {
+	host := p.UpstreamHost
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, p.UpstreamPort)
+}
 
-	// dplName tracks the current deployment target
-	dplName string
+// NewTap returns the Tap implementation for the protocol in the ProxyOptions.
+func NewTap(client kubernetes.Interface, p ProxyOptions) (Tap, error) {
+	switch p.Protocol { //nolint: exhaustive
+	case protocolHTTP, "":
+		if p.UI == uiLocal {
+			return NewLocal(client, p), nil
+		}
+		return NewMitmproxy(client, p), nil
+	case protocolTCP, protocolUDP:
+		return NewRaw(client, p), nil
+	case protocolGRPC:
+		return NewGrpc(client, p), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrProtocolNotSupported, p.Protocol)
+	}
 }
 
-// NewTapCommand identifies a target employment through service selectors and modifies that
-// deployment to add a proxy sidecar.
-func NewTapCommand(client kubernetes.Interface, _ *rest.Config, viper *viper.Viper) func(*cobra.Command, []string) error { //nolint: gocyclo
+// NewTapCommand identifies a target workload through service selectors and modifies that
+// workload to add a proxy sidecar.
+func NewTapCommand(client kubernetes.Interface, config *rest.Config, viper *viper.Viper) func(*cobra.Command, []string) error { //nolint: gocyclo
 	return func(cmd *cobra.Command, args []string) error {
+		if dryRun := viper.GetString("dryRun"); dryRun != "" && dryRun != dryRunNone {
+			return NewDryRunTapCommand(client, config, viper)(cmd, args)
+		}
+		if output := viper.GetString("output"); output != "" && output != outputJSON {
+			return ErrOutputWithoutDryRun
+		}
 		targetSvcName := args[0]
 
 		protocol := viper.GetString("protocol")
+		if protocol == "" {
+			protocol = string(protocolHTTP)
+		}
 		targetSvcPort := viper.GetInt32("proxyPort")
-		namespace := viper.GetString("namespace")
+		namespace := targetNamespace(viper)
 		image := viper.GetString("proxyImage")
 		https := viper.GetBool("https")
 
 		commandArgs := strings.Fields(viper.GetString("commandArgs"))
-		if namespace == "" {
-			// TODO: There is probably a way to get the default namespace from the
-			// client context, but I'm not sure what that API is. Will dig
-			// for that at some point.
-			// BUG: "default" is not always the "correct default".
-			viper.Set("namespace", "default")
-			namespace = "default"
-		}
 		exists, err := hasNamespace(client, namespace)
 		if err != nil {
 			return fmt.Errorf("error fetching namespaces: %w", err)
@@ -152,6 +227,8 @@ func NewTapCommand(client kubernetes.Interface, _ *rest.Config, viper *viper.Vip
 		if !exists {
 			return ErrNamespaceNotExist
 		}
+		progress := newProgress(cmd, viper, namespace, targetSvcName)
+		printTarget(cmd.OutOrStdout(), viper, namespace)
 
 		// Get the service first for port auto-detection
 		targetService, err := client.CoreV1().Services(namespace).Get(context.TODO(), targetSvcName, metav1.GetOptions{})
@@ -181,35 +258,133 @@ func NewTapCommand(client kubernetes.Interface, _ *rest.Config, viper *viper.Vip
 
 		proxyOpts := ProxyOptions{
 			Target:        targetSvcName,
+			Protocol:      Protocol(protocol),
 			UpstreamHTTPS: https,
 			Mode:          "reverse", // eventually this may be configurable
 			Namespace:     namespace,
+			Decoder:       viper.GetString("decode"),
 		}
 		// Adjust default image by protocol if not manually set
 		if image == defaultImageHTTP {
 			switch Protocol(protocol) { //nolint: exhaustive
 			case protocolTCP, protocolUDP:
-				// TODO: make this container and remove error
 				image = defaultImageRaw
-				return fmt.Errorf("mode %q is currently not supported", image)
 			case protocolGRPC:
-				// TODO: make this container and remove error
 				image = defaultImageGRPC
-				return fmt.Errorf("mode %q is currently not supported", image)
 			}
 			viper.Set("proxyImage", image)
 		}
+		// The default command arguments start mitmproxy, the relay runs its own default command.
+		if (Protocol(protocol) == protocolTCP || Protocol(protocol) == protocolUDP) && viper.GetString("commandArgs") == defaultCommandArgs {
+			commandArgs = nil
+		}
+		ui := viper.GetString("ui")
+		if ui == "" {
+			ui = uiTUI
+		}
+		localCommand := strings.Fields(viper.GetString("commandArgs"))
+		switch {
+		case ui != uiTUI && ui != uiWeb && ui != uiLocal:
+			return fmt.Errorf("%w: %q", ErrUINotSupported, ui)
+		case ui == uiWeb && (Protocol(protocol) == protocolTCP || Protocol(protocol) == protocolUDP):
+			return fmt.Errorf("%w: %q has no web UI", ErrUINotSupported, protocol)
+		case ui == uiLocal && Protocol(protocol) != protocolHTTP:
+			return fmt.Errorf("%w: %q cannot run locally", ErrUINotSupported, protocol)
+		case ui == uiLocal:
+			// the command args start mitmproxy on this machine, the sidecar only tunnels
+			commandArgs = nil
+			proxyOpts.UI = ui
+			if image == defaultImageHTTP {
+				image = defaultImageRaw
+				viper.Set("proxyImage", image)
+			}
+		case ui == uiWeb:
+			if viper.GetString("commandArgs") == defaultCommandArgs {
+				commandArgs = []string{mitmwebCommand}
+			}
+			token, err := newWebToken()
+			if err != nil {
+				return err
+			}
+			proxyOpts.UI = ui
+			proxyOpts.WebToken = token
+		}
+		strategy := viper.GetString("strategy")
+		if strategy == "" {
+			strategy = strategyTemplate
+		}
+		if strategy != strategyTemplate && strategy != strategyEphemeral && strategy != strategyStandalone {
+			return fmt.Errorf("%w: %q", ErrStrategyNotSupported, strategy)
+		}
+		if replicas := viper.GetString("replicas"); replicas != "" {
+			if strategy != strategyTemplate {
+				return fmt.Errorf("%w: --replicas cannot be combined with strategy %q", ErrStrategyNotSupported, strategy)
+			}
+			strategy = strategyCanary
+		}
+		if strategy == strategyStandalone && proxyOpts.UI == uiLocal {
+			return fmt.Errorf("%w: the local UI needs the proxy next to the tapped container", ErrUINotSupported)
+		}
+		proxyOpts.Strategy = strategy
+		duration := viper.GetDuration("duration")
+		if duration < 0 {
+			return fmt.Errorf("%w: %s", ErrInvalidDuration, duration)
+		}
+		if duration > 0 {
+			proxyOpts.ExpiresAt = time.Now().Add(duration).Truncate(time.Second)
+		}
+		if Protocol(protocol) == protocolGRPC {
+			protoFiles, err := readProtoFiles(viper.GetStringSlice("protoFiles"))
+			if err != nil {
+				return err
+			}
+			proxyOpts.ProtoFiles = protoFiles
+		}
 
-		deploymentsClient := client.AppsV1().Deployments(namespace)
 		servicesClient := client.CoreV1().Services(namespace)
-		podsClient := client.CoreV1().Pods(namespace)
 
 		// Check if this service is already tapped
 		anns := targetService.GetAnnotations()
 		alreadyTapped := anns[annotationOriginalTargetPort] != ""
+		if alreadyTapped {
+			proxyOpts.Protocol = tappedProtocol(targetService)
+			proxyOpts.UI = tappedUI(targetService)
+			proxyOpts.Strategy = tappedStrategy(targetService)
+		}
+		proxy, err := NewTap(client, proxyOpts)
+		if err != nil {
+			return err
+		}
 
 		if !alreadyTapped {
-			if err := performTap(cmd, client, deploymentsClient, servicesClient, targetService, targetSvcName, targetSvcPort, image, commandArgs, protocol, proxyOpts, viper); err != nil {
+			if err := guardTap(cmd.OutOrStdout(), viper, targetService); err != nil {
+				return err
+			}
+		}
+		if !alreadyTapped && viper.GetBool("preflight") {
+			ctx := cmd.Context()
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			if err := preflightTap(ctx, cmd.OutOrStdout(), client, targetService, proxyOpts.Strategy, proxyOpts.UI); err != nil {
+				return err
+			}
+		}
+		if !alreadyTapped {
+			progress.start(fmt.Sprintf("Tapping Service %q...", targetSvcName))
+			if err := performTap(cmd, progress, client, config, servicesClient, targetService, targetSvcName, targetSvcPort, image, commandArgs, proxyOpts, viper); err != nil {
+				progress.abort("Tap failed")
+				return err
+			}
+		} else if !proxyOpts.ExpiresAt.IsZero() {
+			if err := setTapExpiry(servicesClient, targetSvcName, proxyOpts.ExpiresAt); err != nil {
+				return err
+			}
+		}
+		if !alreadyTapped || !proxyOpts.ExpiresAt.IsZero() {
+			// a standalone tap changed the selectors, the proxy Pod is looked up through them
+			targetService, err = servicesClient.Get(context.TODO(), targetSvcName, metav1.GetOptions{})
+			if err != nil {
 				return err
 			}
 		}
@@ -218,7 +393,25 @@ func NewTapCommand(client kubernetes.Interface, _ *rest.Config, viper *viper.Vip
 		if !alreadyTapped {
 			_, _ = fmt.Fprintf(cmd.OutOrStdout(), "Port %d of Service %q has been tapped!\n", targetSvcPort, targetSvcName)
 		} else {
-			_, _ = fmt.Fprintln(cmd.OutOrStdout(), "Service already tapped. Attaching to existing mitmproxy session...")
+			_, _ = fmt.Fprintf(cmd.OutOrStdout(), "Service already tapped. Attaching to existing %s session...\n", proxy)
+		}
+
+		ctx := cmd.Context()
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		expiresAt, expiring := tapExpiry(targetService)
+		if expiring {
+			// the janitor removes the tap in time while no client is attached
+			if err := startJanitor(ctx, client, namespace, targetSvcName, viper.GetString("janitorImage")); err != nil {
+				_, _ = fmt.Fprintf(cmd.OutOrStdout(), "Warning: the tap is only removed in time while attached, error starting janitor: %v\n", err)
+			}
+		}
+
+		if viper.GetBool("detach") {
+			announceExpiry(ctx, cmd.OutOrStdout(), expiresAt, nil)
+			printAttachHint(cmd.OutOrStdout(), namespace, targetSvcName)
+			return nil
 		}
 
 		// Only wait for pod and exec when explicitly requested by running from a terminal
@@ -228,125 +421,121 @@ func NewTapCommand(client kubernetes.Interface, _ *rest.Config, viper *viper.Vip
 			// Output is redirected or in a test, skip the waiting/exec
 			return nil
 		}
+		// a killed client leaves the Lease to expire, the janitor then reverts the Service
+		defer guardSession(ctx, cmd.OutOrStdout(), client, namespace, targetSvcName, viper.GetString("janitorImage"), expiring)()
+		ctx, cancel := untilExpiry(ctx, expiresAt)
+		defer cancel()
+		cmd.SetContext(ctx)
 
 		_, _ = fmt.Fprintf(cmd.OutOrStdout(), "\nWaiting for pod to start...\n\n")
 		ic := make(chan os.Signal, 1)
 		signal.Notify(ic, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
+		defer signal.Stop(ic)
 		go func() {
 			<-ic
 			_, _ = fmt.Fprintln(cmd.OutOrStdout(), "")
 			_, _ = fmt.Fprintln(cmd.OutOrStdout(), "Stopping mittens...")
-			_ = NewUntapCommand(client, viper)(cmd, args)
+			_ = NewUntapCommand(client, config, viper)(cmd, args)
 			die()
 		}()
 
-		s := make(chan struct{})
-		defer close(s)
-		go func() {
-			// Skip the first few checks to give pods time to come up.
-			// Race: If the first few cycles are not skipped, the condition status may be "Ready".
-			time.Sleep(5 * time.Second)
-			s <- struct{}{}
-		}()
-
-		// Use spinner instead of progress bar
-		spinner := NewSpinner("Waiting for Pod containers to become ready...")
-
-		var ready bool
-		for range interactiveTimeoutSeconds {
-			if ready {
-				break
-			}
-			// Check if context was cancelled (e.g., in tests)
-			if cmd.Context() != nil {
-				select {
-				case <-cmd.Context().Done():
-					_, _ = fmt.Fprintln(cmd.OutOrStdout(), "")
-					_, _ = fmt.Fprintln(cmd.OutOrStdout(), "Context cancelled. Stopping mittens...")
-					spinner.Fail("Cancelled")
-					_ = NewUntapCommand(client, viper)(cmd, args)
-					return cmd.Context().Err()
-				default:
-				}
+		pod, err := waitForMittensPod(cmd, progress, client, namespace, targetService, readinessTimeout(viper))
+		if err != nil {
+			if tapExpired(ctx) {
+				return untapExpired(cmd, client, config, viper, args)
 			}
-			time.Sleep(1 * time.Second)
-			select {
-			case <-time.After(1 * time.Nanosecond):
-				// if not ready this cycle, abort
-				continue
-			case <-s:
-				dp, err := deploymentFromSelectors(deploymentsClient, targetService.Spec.Selector)
-				if err != nil {
-					spinner.Fail("Error getting deployment")
-					return err
-				}
-				pod, err := mittensPod(podsClient, dp.Name)
-				if err != nil {
-					spinner.Fail("Error getting pod")
-					return err
-				}
-				for _, cond := range pod.Status.Conditions {
-					if cond.Type == "ContainersReady" {
-						if cond.Status == "True" {
-							ready = true
-						}
-					}
-				}
-				go func() {
-					s <- struct{}{}
-				}()
+			if errors.Is(err, context.Canceled) {
+				_, _ = fmt.Fprintln(cmd.OutOrStdout(), "")
+				_, _ = fmt.Fprintln(cmd.OutOrStdout(), "Context cancelled. Stopping mittens...")
+				_ = NewUntapCommand(client, config, viper)(cmd, args)
 			}
+			return err
 		}
-		if !ready {
-			spinner.Fail("Pod not running after 90 seconds. Cancelling.")
-			die()
-		}
-		spinner.Stop("Pod ready!")
-		dp, err := deploymentFromSelectors(deploymentsClient, targetService.Spec.Selector)
-		if err != nil {
+		progress.report(phaseAttaching, fmt.Sprintf("Attaching to Pod %q", pod.Name))
+		if proxyOpts.UI == uiLocal {
+			// serveLocal handles interrupts itself, the tap is removed once it returns
+			signal.Stop(ic)
+			announceExpiry(ctx, cmd.OutOrStdout(), expiresAt, nil)
+			err := serveLocal(cmd, client, config, pod, localCommand)
+			if tapExpired(ctx) {
+				return untapExpired(cmd, client, config, viper, args)
+			}
+			_, _ = fmt.Fprintln(cmd.OutOrStdout(), "")
+			_, _ = fmt.Fprintln(cmd.OutOrStdout(), "Cleaning up litter...")
+			if untapErr := NewUntapCommand(client, config, viper)(cmd, args); untapErr != nil {
+				return untapErr
+			}
 			return err
 		}
-		pod, err := mittensPod(podsClient, dp.Name)
-		if err != nil {
+		if token, ok := webUIToken(client, namespace, pod.GetAnnotations()[annotationIsTapped]); ok {
+			// serveWebUI handles interrupts itself, the tap is removed once it returns
+			signal.Stop(ic)
+			announceExpiry(ctx, cmd.OutOrStdout(), expiresAt, func(msg string) {
+				_, _ = fmt.Fprintln(cmd.OutOrStdout(), "Warning: "+msg)
+			})
+			err := serveWebUI(cmd, client, config, pod, token, viper.GetInt("webPort"), viper.GetBool("openBrowser"))
+			if tapExpired(ctx) {
+				return untapExpired(cmd, client, config, viper, args)
+			}
+			_, _ = fmt.Fprintln(cmd.OutOrStdout(), "")
+			_, _ = fmt.Fprintln(cmd.OutOrStdout(), "Cleaning up litter...")
+			if untapErr := NewUntapCommand(client, config, viper)(cmd, args); untapErr != nil {
+				return untapErr
+			}
 			return err
 		}
+		return attachOrUntap(cmd, progress, client, config, viper, args, pod, proxy, expiresAt)
+	}
+}
 
-		// Spawn kubectl exec to attach to mitmproxy tmux session
-		execCmd := exec.CommandContext(cmd.Context(), "kubectl", "exec", "-it", pod.Name, "-n", namespace, "-c", "mittens", "--", "tmux", "attach-session", "-t", "mitmproxy")
-		execCmd.Stdin = os.Stdin
-		execCmd.Stdout = os.Stdout
-		execCmd.Stderr = os.Stderr
-		err = execCmd.Run()
-
-		// User has exited the tmux session, clean up the tap
-		_, _ = fmt.Fprintln(cmd.OutOrStdout(), "")
-		_, _ = fmt.Fprintln(cmd.OutOrStdout(), "Cleaning up litter...")
-		untapErr := NewUntapCommand(client, viper)(cmd, args)
-		if untapErr != nil {
-			return untapErr
+// performTap handles the actual tapping logic for a service. The Service and
+// workload are snapshotted before they are modified, see NewUntapCommand.
+func performTap(cmd *cobra.Command, progress *progress, client kubernetes.Interface, config *rest.Config, servicesClient corev1.ServiceInterface, targetService *v1.Service, targetSvcName string, targetSvcPort int32, image string, commandArgs []string, proxyOpts ProxyOptions, v *viper.Viper) (retErr error) {
+	configMapsClient := client.CoreV1().ConfigMaps(proxyOpts.Namespace)
+	defer func() {
+		// a failed tap is reverted, its snapshot is stale
+		if retErr != nil {
+			_ = deleteSnapshot(configMapsClient, targetSvcName)
+		}
+	}()
+	if proxyOpts.Strategy == strategyStandalone {
+		if err := saveSnapshot(configMapsClient, newSnapshot(targetService, nil)); err != nil {
+			return err
+		}
+		// the tapped workload is never resolved, it may not even be a known kind
+		err := tapStandalone(client, targetService, targetSvcPort, image, commandArgs, proxyOpts)
+		if err == nil {
+			progress.report(phaseWorkload, "Standalone proxy Deployment created")
+			err = tapSvc(servicesClient, targetSvcName, targetSvcPort, proxyOpts)
+		}
+		if err != nil {
+			progress.fail("Error creating the standalone proxy, reverting tap...")
+			_ = untapStandalone(client, proxyOpts.Namespace, targetSvcName, proxyOpts.Protocol, proxyOpts.UI)
+			return err
 		}
+		progress.stop(phaseService, "Service rewired to the proxy")
+		return nil
+	}
+	workload, err := workloadFromSelectors(client, proxyOpts.Namespace, targetService.Spec.Selector)
+	if err != nil {
+		return fmt.Errorf("error resolving workload from Service selectors: %w", err)
+	}
+	proxyOpts.workloadName = workload.Name()
+	if err := saveSnapshot(configMapsClient, newSnapshot(targetService, workload)); err != nil {
 		return err
 	}
-}
 
-// performTap handles the actual tapping logic for a service.
-func performTap(cmd *cobra.Command, client kubernetes.Interface, deploymentsClient appsv1.DeploymentInterface, servicesClient corev1.ServiceInterface, targetService *v1.Service, targetSvcName string, targetSvcPort int32, image string, commandArgs []string, protocol string, proxyOpts ProxyOptions, v *viper.Viper) error {
 	// set the upstream port so the proxy knows where to forward traffic
 	for _, ports := range targetService.Spec.Ports {
-		if ports.Port != targetSvcPort {
+		if ports.Port != targetSvcPort || servicePortProtocol(ports) != proxyOpts.Protocol.ServiceProtocol() {
 			continue
 		}
 		if ports.TargetPort.Type == intstr.Int {
 			proxyOpts.UpstreamPort = ports.TargetPort.String()
 		}
-		// if named, must determine port from deployment spec
+		// if named, must determine port from the workload's pod template
 		if ports.TargetPort.Type == intstr.String {
-			var err error
-			targetDpl, err := deploymentFromSelectors(deploymentsClient, targetService.Spec.Selector)
-			if err != nil {
-				return fmt.Errorf("error resolving Deployment from Service selectors while setting proxy ports: %w", err)
-			}
-			for _, c := range targetDpl.Spec.Template.Spec.Containers {
+			for _, c := range workload.PodTemplate().Spec.Containers {
 				for _, p := range c.Ports {
 					if p.Name == ports.TargetPort.String() {
 						// Set the upstream (target) Service port
@@ -355,83 +544,115 @@ func performTap(cmd *cobra.Command, client kubernetes.Interface, deploymentsClie
 				}
 			}
 			if proxyOpts.UpstreamPort == "" {
-				return ErrDeploymentMissingPorts
+				return ErrWorkloadMissingPorts
 			}
 		}
 	}
 
-	targetDpl, err := deploymentFromSelectors(deploymentsClient, targetService.Spec.Selector)
-	if err != nil {
-		return fmt.Errorf("error resolving Deployment from Service selectors: %w", err)
+	if proxyOpts.Strategy == strategyCanary {
+		// the workload is left alone, only the canary Pods run the proxy
+		portName, err := tapCanary(client, targetService, targetSvcPort, workload, v.GetString("replicas"), image, commandArgs, proxyOpts)
+		if err == nil {
+			progress.report(phaseWorkload, "Canary Pods created")
+			proxyOpts.canaryPort = portName
+			err = tapSvc(servicesClient, targetSvcName, targetSvcPort, proxyOpts)
+		}
+		if err != nil {
+			progress.fail("Error creating the canary, reverting tap...")
+			_ = untapCanary(client, proxyOpts.Namespace, targetSvcName)
+			if proxy, tapErr := NewTap(client, proxyOpts); tapErr == nil {
+				_ = proxy.UnreadyEnv()
+			}
+			return err
+		}
+		progress.stop(phaseService, "Service rewired to the canary")
+		return nil
 	}
-	proxyOpts.dplName = targetDpl.Name
 
 	// Get a proxy based on the protocol type
-	var proxy Tap
-	switch Protocol(protocol) { //nolint: exhaustive
-	case protocolTCP, protocolUDP:
-	case protocolGRPC:
-	default:
-		// AKA, case protocolHTTP:
-		proxy = NewMitmproxy(client, proxyOpts)
+	proxy, err := NewTap(client, proxyOpts)
+	if err != nil {
+		return err
 	}
 
 	// Prepare the environment (configmaps, secrets, volumes, etc).
 	if err := proxy.ReadyEnv(); err != nil {
 		return err
 	}
+	progress.report(phaseConfigMap, "Proxy ConfigMap created")
 
 	// Setup the sidecar
-	dpl, err := deploymentFromSelectors(deploymentsClient, targetService.Spec.Selector)
-	if err != nil {
-		return err
+	sidecar := proxy.Sidecar(workload.Name())
+	sidecar.Image = image
+	if len(commandArgs) > 0 {
+		sidecar.Args = commandArgs
 	}
 
-	sidecar := proxy.Sidecar(dpl.Name)
-	sidecar.Image = image
-	sidecar.Args = commandArgs
+	if proxyOpts.Strategy == strategyEphemeral {
+		ctx := cmd.Context()
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		err := tapEphemeral(ctx, client, workload, targetService.Spec.Selector, sidecar, readinessTimeout(v))
+		if err == nil {
+			progress.report(phaseWorkload, "Ephemeral proxies started")
+			return tapSvcOrUntap(cmd, progress, client, config, servicesClient, targetSvcName, targetSvcPort, proxyOpts, v)
+		}
+		if !errors.Is(err, ErrEphemeralUnavailable) {
+			progress.fail("Error adding ephemeral containers, reverting tap...")
+			_ = untapEphemeral(ctx, client, config, proxyOpts.Namespace, workload.Name())
+			_ = proxy.UnreadyEnv()
+			return err
+		}
+		progress.warn(fmt.Sprintf("Cannot tap without restarting Pods (%v), falling back to patching the %s pod template...", err, workload.Kind()))
+		proxyOpts.Strategy = strategyTemplate
+	}
 
-	// Apply the Deployment configuration
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		dpl.Spec.Template.Spec.Containers = append(dpl.Spec.Template.Spec.Containers, sidecar)
-		proxy.PatchDeployment(&dpl)
+	// Apply the workload configuration
+	retryErr := patchPodTemplate(workload, func(tmpl *v1.PodTemplateSpec) {
+		tmpl.Spec.Containers = append(tmpl.Spec.Containers, sidecar)
+		proxy.PatchWorkload(tmpl, workload.Name())
 		// set annotation on pod to know what pods are tapped
-		anns := dpl.Spec.Template.GetAnnotations()
+		anns := tmpl.GetAnnotations()
 		if anns == nil {
 			anns = map[string]string{}
 		}
-		anns[annotationIsTapped] = dpl.Name
-		dpl.Spec.Template.SetAnnotations(anns)
-		_, updateErr := deploymentsClient.Update(context.TODO(), &dpl, metav1.UpdateOptions{})
-		return updateErr
+		anns[annotationIsTapped] = workload.Name()
+		tmpl.SetAnnotations(anns)
 	})
+	if retryErr == nil {
+		retryErr = rolloutWorkload(client.CoreV1().Pods(proxyOpts.Namespace), workload, readinessTimeout(v))
+	}
 	if retryErr != nil {
-		_, _ = fmt.Fprintln(cmd.OutOrStdout(), "Error modifying Deployment, reverting tap...")
+		progress.fail(fmt.Sprintf("Error modifying %s, reverting tap...", workload.Kind()))
 		args := []string{targetSvcName}
-		_ = NewUntapCommand(client, v)(cmd, args)
-		return fmt.Errorf("failed to add sidecars to Deployment: %w", retryErr)
+		_ = NewUntapCommand(client, config, v)(cmd, args)
+		return fmt.Errorf("failed to add sidecars to %s: %w", workload.Kind(), retryErr)
 	}
+	progress.report(phaseWorkload, fmt.Sprintf("%s %q patched", workload.Kind(), workload.Name()))
+
+	return tapSvcOrUntap(cmd, progress, client, config, servicesClient, targetSvcName, targetSvcPort, proxyOpts, v)
+}
 
+// tapSvcOrUntap points the Service at the proxy, reverting the whole tap on failure.
+func tapSvcOrUntap(cmd *cobra.Command, progress *progress, client kubernetes.Interface, config *rest.Config, servicesClient corev1.ServiceInterface, targetSvcName string, targetSvcPort int32, proxyOpts ProxyOptions, v *viper.Viper) error {
 	// Tap the Service to redirect the incoming traffic to our proxy
-	if err := tapSvc(servicesClient, targetSvcName, targetSvcPort); err != nil {
-		_, _ = fmt.Fprintln(cmd.OutOrStdout(), "Error modifying Service, reverting tap...")
+	if err := tapSvc(servicesClient, targetSvcName, targetSvcPort, proxyOpts); err != nil {
+		progress.fail("Error modifying Service, reverting tap...")
 		args := []string{targetSvcName}
-		_ = NewUntapCommand(client, v)(cmd, args)
+		_ = NewUntapCommand(client, config, v)(cmd, args)
 		return err
 	}
-
+	progress.stop(phaseService, "Service rewired to the proxy")
 	return nil
 }
 
 // NewUntapCommand unconditionally removes all proxies, taps, and artifacts. This is
 // the inverse of NewTapCommand.
-func NewUntapCommand(client kubernetes.Interface, viper *viper.Viper) func(*cobra.Command, []string) error {
+func NewUntapCommand(client kubernetes.Interface, config *rest.Config, viper *viper.Viper) func(*cobra.Command, []string) error {
 	return func(cmd *cobra.Command, args []string) error {
 		targetSvcName := args[0]
-		namespace := viper.GetString("namespace")
-		if namespace == "" {
-			namespace = "default"
-		}
+		namespace := targetNamespace(viper)
 		exists, err := hasNamespace(client, namespace)
 		if err != nil {
 			return fmt.Errorf("error fetching namespaces: %w", err)
@@ -439,27 +660,57 @@ func NewUntapCommand(client kubernetes.Interface, viper *viper.Viper) func(*cobr
 		if !exists {
 			return ErrNamespaceNotExist
 		}
+		printTarget(cmd.OutOrStdout(), viper, namespace)
 
-		deploymentsClient := client.AppsV1().Deployments(namespace)
 		servicesClient := client.CoreV1().Services(namespace)
 
 		targetService, err := client.CoreV1().Services(namespace).Get(context.TODO(), targetSvcName, metav1.GetOptions{})
 		if err != nil {
 			return err
 		}
-		dpl, err := deploymentFromSelectors(deploymentsClient, targetService.Spec.Selector)
+		snap, err := loadSnapshot(client.CoreV1().ConfigMaps(namespace), targetSvcName)
+		if err != nil {
+			return err
+		}
+		var svcSnap *serviceSnapshot
+		if snap != nil {
+			svcSnap = &snap.Service
+		}
+		if tappedStrategy(targetService) == strategyStandalone {
+			// restoring the selector sends the traffic back before the proxy goes away
+			if err := untapSvc(servicesClient, targetSvcName, svcSnap); err != nil {
+				return err
+			}
+			if err := untapStandalone(client, namespace, targetSvcName, tappedProtocol(targetService), tappedUI(targetService)); err != nil {
+				return err
+			}
+			if err := releaseSession(client, namespace, targetSvcName); err != nil {
+				return err
+			}
+			if err := verifySnapshot(cmd.OutOrStdout(), client, namespace, snap, nil); err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintf(cmd.OutOrStdout(), "Untapped Service %q\n", targetSvcName)
+			return nil
+		}
+		workload, err := workloadFromSelectors(client, namespace, targetService.Spec.Selector)
 		if err != nil {
 			return err
 		}
-		if dpl.Namespace != namespace {
-			panic(ErrDeploymentOutsideNamespace)
+		if workload.Namespace() != namespace {
+			return ErrWorkloadOutsideNamespace
 		}
 
-		proxy := NewMitmproxy(client, ProxyOptions{
-			Namespace: namespace,
-			Target:    targetSvcName,
-			dplName:   dpl.Name,
+		proxy, err := NewTap(client, ProxyOptions{
+			Namespace:    namespace,
+			Target:       targetSvcName,
+			Protocol:     tappedProtocol(targetService),
+			UI:           tappedUI(targetService),
+			workloadName: workload.Name(),
 		})
+		if err != nil {
+			return err
+		}
 
 		if err := proxy.UnreadyEnv(); err != nil {
 			// both error types below can be thrown
@@ -468,38 +719,44 @@ func NewUntapCommand(client kubernetes.Interface, viper *viper.Viper) func(*cobr
 			}
 		}
 
-		retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-			// Explicitly re-fetch the deployment to reduce the chance of having a race
-			deployment, getErr := deploymentsClient.Get(context.TODO(), dpl.Name, metav1.GetOptions{})
-			if getErr != nil {
-				return getErr
+		switch tappedStrategy(targetService) {
+		case strategyCanary:
+			if err := untapSvc(servicesClient, targetSvcName, svcSnap); err != nil {
+				return err
 			}
-			var containersNoProxy []v1.Container
-			for _, c := range deployment.Spec.Template.Spec.Containers {
-				if c.Name != mittensContainerName {
-					containersNoProxy = append(containersNoProxy, c)
-				}
+			if err := untapCanary(client, namespace, targetSvcName); err != nil {
+				return err
 			}
-			deployment.Spec.Template.Spec.Containers = containersNoProxy
-			var volumes []v1.Volume
-			for _, v := range deployment.Spec.Template.Spec.Volumes {
-				if !strings.HasPrefix(v.Name, "mittens") {
-					volumes = append(volumes, v)
-				}
+		case strategyEphemeral:
+			// the Pods keep running, so the Service is restored before the proxies stop
+			if err := untapSvc(servicesClient, targetSvcName, svcSnap); err != nil {
+				return err
 			}
-			deployment.Spec.Template.Spec.Volumes = volumes
-			anns := deployment.Spec.Template.GetAnnotations()
-			if anns != nil {
-				delete(anns, annotationIsTapped)
-				deployment.Spec.Template.SetAnnotations(anns)
+			ctx := cmd.Context()
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			// the session may have ended because the tap expired, the untap must still finish
+			ctx = context.WithoutCancel(ctx)
+			if err := untapEphemeral(ctx, client, config, namespace, workload.Name()); err != nil {
+				return err
+			}
+		default:
+			var workloadSnap *workloadSnapshot
+			if snap.matches(workload) {
+				workloadSnap = snap.Workload
+			}
+			if err := untapWorkload(client, workload, workloadSnap); err != nil {
+				return err
+			}
+			if err := untapSvc(servicesClient, targetSvcName, svcSnap); err != nil {
+				return err
 			}
-			_, updateErr := deploymentsClient.Update(context.TODO(), deployment, metav1.UpdateOptions{})
-			return updateErr
-		})
-		if retryErr != nil {
-			return fmt.Errorf("failed to remove sidecars from Deployment: %w", retryErr)
 		}
-		if err := untapSvc(servicesClient, targetSvcName); err != nil {
+		if err := releaseSession(client, namespace, targetSvcName); err != nil {
+			return err
+		}
+		if err := verifySnapshot(cmd.OutOrStdout(), client, namespace, snap, workload); err != nil {
 			return err
 		}
 		_, _ = fmt.Fprintf(cmd.OutOrStdout(), "Untapped Service %q\n", targetSvcName)
@@ -507,40 +764,49 @@ func NewUntapCommand(client kubernetes.Interface, viper *viper.Viper) func(*cobr
 	}
 }
 
-// deploymentFromSelectors returns a deployment given selector labels.
-func deploymentFromSelectors(deploymentsClient appsv1.DeploymentInterface, selectors map[string]string) (k8sappsv1.Deployment, error) {
-	var sel string
-	switch len(selectors) {
-	case 0:
-		return k8sappsv1.Deployment{}, ErrSelectorsMissing
-	case 1:
-		for k, v := range selectors {
-			sel = k + "=" + v
+// untapWorkload removes the proxy sidecar, its volumes and the tapped annotation
+// from the pod template of a workload. Without a snapshot, the sidecar and
+// volumes are recognized by their "mittens" names.
+func untapWorkload(client kubernetes.Interface, workload Workload, snap *workloadSnapshot) error {
+	var wasTapped bool
+	retryErr := patchPodTemplate(workload, func(tmpl *v1.PodTemplateSpec) {
+		if snap != nil {
+			wasTapped = snap.restore(tmpl)
+			return
+		}
+		var containersNoProxy []v1.Container
+		for _, c := range tmpl.Spec.Containers {
+			if c.Name != mittensContainerName {
+				containersNoProxy = append(containersNoProxy, c)
+			}
 		}
-	default:
-		for k, v := range selectors {
-			sel = strings.Join([]string{sel, k + "=" + v}, ",")
+		wasTapped = len(containersNoProxy) != len(tmpl.Spec.Containers)
+		tmpl.Spec.Containers = containersNoProxy
+		var volumes []v1.Volume
+		for _, v := range tmpl.Spec.Volumes {
+			if !strings.HasPrefix(v.Name, "mittens") {
+				volumes = append(volumes, v)
+			}
+		}
+		tmpl.Spec.Volumes = volumes
+		anns := tmpl.GetAnnotations()
+		if anns != nil {
+			delete(anns, annotationIsTapped)
+			tmpl.SetAnnotations(anns)
 		}
-		sel = strings.TrimLeft(sel, ",")
-	}
-	dpls, err := deploymentsClient.List(context.TODO(), metav1.ListOptions{
-		LabelSelector: sel,
 	})
-	if err != nil {
-		return k8sappsv1.Deployment{}, err
+	// only restart Pods of OnDelete workloads when a sidecar was actually removed
+	if retryErr == nil && wasTapped {
+		retryErr = rolloutWorkload(client.CoreV1().Pods(workload.Namespace()), workload, defaultTimeout)
 	}
-	switch len(dpls.Items) {
-	case 0:
-		return k8sappsv1.Deployment{}, ErrServiceSelectorNoMatch
-	case 1:
-		return dpls.Items[0], nil
-	default:
-		return k8sappsv1.Deployment{}, ErrServiceSelectorMultiMatch
+	if retryErr != nil {
+		return fmt.Errorf("failed to remove sidecars from %s: %w", workload.Kind(), retryErr)
 	}
+	return nil
 }
 
-// mittensPod returns a mittens pod matching a given Deployment name and Namespace.
-func mittensPod(podClient corev1.PodInterface, deploymentName string) (v1.Pod, error) {
+// mittensPod returns a mittens pod matching a given workload name and Namespace.
+func mittensPod(podClient corev1.PodInterface, workloadName string) (v1.Pod, error) {
 	pods, err := podClient.List(context.TODO(), metav1.ListOptions{})
 	if err != nil {
 		return v1.Pod{}, err
@@ -552,7 +818,7 @@ func mittensPod(podClient corev1.PodInterface, deploymentName string) (v1.Pod, e
 			continue
 		}
 		for k, v := range anns {
-			if k == annotationIsTapped && v == deploymentName {
+			if k == annotationIsTapped && v == workloadName {
 				return pod, nil
 			}
 		}
@@ -560,18 +826,38 @@ func mittensPod(podClient corev1.PodInterface, deploymentName string) (v1.Pod, e
 	return p, ErrMittensPodNoMatch
 }
 
+// tappedProtocol returns the protocol a Service was tapped with. Services
+// tapped before the protocol was recorded are HTTP taps.
+func tappedProtocol(svc *v1.Service) Protocol {
+	if p := svc.GetAnnotations()[annotationProtocol]; p != "" {
+		return Protocol(p)
+	}
+	return protocolHTTP
+}
+
+// tappedUI returns the UI a tapped Service was tapped with.
+func tappedUI(svc *v1.Service) string {
+	if ui := svc.GetAnnotations()[annotationUI]; ui != "" {
+		return ui
+	}
+	return uiTUI
+}
+
+// setTapExpiry moves the expiry of the tap of a Service.
+func setTapExpiry(svcClient corev1.ServiceInterface, svcName string, expiresAt time.Time) error {
+	return patchService(svcClient, svcName, func(svc *v1.Service) error {
+		svc.Annotations[annotationExpiresAt] = expiresAt.UTC().Format(time.RFC3339)
+		return nil
+	})
+}
+
 // tapSvc modifies a target port to point to a new proxy service.
-func tapSvc(svcClient corev1.ServiceInterface, svcName string, targetPort int32) error {
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		svc, getErr := svcClient.Get(context.TODO(), svcName, metav1.GetOptions{})
-		if getErr != nil {
-			return getErr
-		}
+func tapSvc(svcClient corev1.ServiceInterface, svcName string, targetPort int32, proxyOpts ProxyOptions) error {
+	protocol := proxyOpts.Protocol
+	retryErr := patchService(svcClient, svcName, func(svc *v1.Service) error {
 		anns := svc.GetAnnotations()
 		// If anns is nil, it means that the target Service had no annotations.
-		// BUG: this is probably safe if the comment above is true, but if it isn't
-		// true this could wipe the annotations associated with a Service, which
-		// would be highly undesirable....
+		// Only the keys set below end up in the patch, see annotationsPatch.
 		if anns == nil {
 			anns = make(map[string]string)
 		}
@@ -579,7 +865,7 @@ func tapSvc(svcClient corev1.ServiceInterface, svcName string, targetPort int32)
 		var targetSvcPort v1.ServicePort
 		var hasPort bool
 		for _, sp := range svc.Spec.Ports {
-			if sp.Port == targetPort {
+			if sp.Port == targetPort && servicePortProtocol(sp) == protocol.ServiceProtocol() {
 				hasPort = true
 				targetSvcPort = sp
 			}
@@ -589,6 +875,39 @@ func tapSvc(svcClient corev1.ServiceInterface, svcName string, targetPort int32)
 		}
 
 		anns[annotationOriginalTargetPort] = targetSvcPort.TargetPort.String()
+		anns[annotationProtocol] = string(protocol)
+		anns[annotationTappedAt] = time.Now().UTC().Format(time.RFC3339)
+		if proxyOpts.UI == uiLocal {
+			anns[annotationUI] = proxyOpts.UI
+		}
+		if proxyOpts.Strategy != "" && proxyOpts.Strategy != strategyTemplate {
+			anns[annotationStrategy] = proxyOpts.Strategy
+		}
+		if proxyOpts.Strategy == strategyCanary {
+			anns[annotationCanaryPort] = strconv.Itoa(int(targetSvcPort.Port))
+		}
+		if !proxyOpts.ExpiresAt.IsZero() {
+			anns[annotationExpiresAt] = proxyOpts.ExpiresAt.UTC().Format(time.RFC3339)
+		}
+		if proxyOpts.Strategy == strategyStandalone || proxyOpts.Strategy == strategyEphemeral {
+			origSelector := svc.Spec.Selector
+			if selector, ok := anns[annotationOriginalSelector]; ok {
+				if err := json.Unmarshal([]byte(selector), &origSelector); err != nil {
+					return fmt.Errorf("error reading the original Service selector: %w", err)
+				}
+			} else {
+				selector, err := json.Marshal(svc.Spec.Selector)
+				if err != nil {
+					return err
+				}
+				anns[annotationOriginalSelector] = string(selector)
+			}
+			if proxyOpts.Strategy == strategyStandalone {
+				svc.Spec.Selector = standaloneLabels(svc.Name)
+			} else {
+				svc.Spec.Selector = ephemeralSelector(origSelector)
+			}
+		}
 		// Add Flux drift detection annotation to prevent automatic rollback
 		anns[fluxDriftDetectionAnnotation] = fluxDriftDetectionDisabled
 		svc.SetAnnotations(anns)
@@ -596,18 +915,21 @@ func tapSvc(svcClient corev1.ServiceInterface, svcName string, targetPort int32)
 		// then do the swap and build a new ports list
 		var servicePorts []v1.ServicePort
 		for _, sp := range svc.Spec.Ports {
-			if sp.Port == targetSvcPort.Port {
-				if sp.Name == "" {
-					sp.Name = mittensPortName
+			if sp.Port == targetSvcPort.Port && servicePortProtocol(sp) == servicePortProtocol(targetSvcPort) {
+				if proxyOpts.Strategy == strategyCanary {
+					// the name resolves to the proxy in the canary Pods and to the app in all others
+					sp.TargetPort = intstr.FromString(proxyOpts.canaryPort)
+				} else {
+					if sp.Name == "" {
+						sp.Name = mittensPortName
+					}
+					sp.TargetPort = intstr.FromInt(mittensProxyListenPort)
 				}
-				sp.TargetPort = intstr.FromInt(mittensProxyListenPort)
 			}
 			servicePorts = append(servicePorts, sp)
 		}
 		svc.Spec.Ports = servicePorts
-
-		_, updateErr := svcClient.Update(context.TODO(), svc, metav1.UpdateOptions{})
-		return updateErr
+		return nil
 	})
 	if retryErr != nil {
 		return fmt.Errorf("failed to tap Service: %w", retryErr)
@@ -616,20 +938,22 @@ func tapSvc(svcClient corev1.ServiceInterface, svcName string, targetPort int32)
 }
 
 // untapSvc modifies a target port point to the original service, not our proxy sidecar.
-func untapSvc(svcClient corev1.ServiceInterface, svcName string) error {
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		svc, getErr := svcClient.Get(context.TODO(), svcName, metav1.GetOptions{})
-		if getErr != nil {
-			return getErr
+// Without a snapshot, the original port and selector are read from the tap annotations.
+func untapSvc(svcClient corev1.ServiceInterface, svcName string, snap *serviceSnapshot) error {
+	retryErr := patchService(svcClient, svcName, func(svc *v1.Service) error {
+		if snap != nil {
+			snap.restore(svc)
+			return nil
 		}
 		// NOTE: it is critical to Parse here (vs FromString)
 		origSvcTargetPort := intstr.Parse(svc.GetAnnotations()[annotationOriginalTargetPort])
+		canaryPort := svc.GetAnnotations()[annotationCanaryPort]
 		var servicePorts []v1.ServicePort
 		for _, sp := range svc.Spec.Ports {
 			if sp.Name == mittensServicePortName {
 				continue
 			}
-			if sp.TargetPort.IntValue() == mittensProxyListenPort {
+			if sp.TargetPort.IntValue() == mittensProxyListenPort || strconv.Itoa(int(sp.Port)) == canaryPort {
 				if sp.Name == mittensPortName {
 					sp.Name = ""
 				}
@@ -639,16 +963,23 @@ func untapSvc(svcClient corev1.ServiceInterface, svcName string) error {
 		}
 		svc.Spec.Ports = servicePorts
 		anns := svc.GetAnnotations()
+		if selector, ok := anns[annotationOriginalSelector]; ok {
+			var origSelector map[string]string
+			if err := json.Unmarshal([]byte(selector), &origSelector); err != nil {
+				return fmt.Errorf("error restoring the Service selector: %w", err)
+			}
+			svc.Spec.Selector = origSelector
+		}
 		newAnns := make(map[string]string)
 		for k, v := range anns {
-			// Remove mittens and Flux annotations added during tap
-			if k != annotationOriginalTargetPort && k != fluxDriftDetectionAnnotation {
-				newAnns[k] = v
-			}
+			newAnns[k] = v
+		}
+		// Remove mittens and Flux annotations added during tap
+		for _, k := range tapAnnotations {
+			delete(newAnns, k)
 		}
 		svc.SetAnnotations(newAnns)
-		_, updateErr := svcClient.Update(context.TODO(), svc, metav1.UpdateOptions{})
-		return updateErr
+		return nil
 	})
 	if retryErr != nil {
 		return fmt.Errorf("failed to untap Service: %w", retryErr)
@@ -656,19 +987,26 @@ func untapSvc(svcClient corev1.ServiceInterface, svcName string) error {
 	return nil
 }
 
-// hasNamespace checks if a given Namespace exists.
+// hasNamespace checks if a given Namespace exists. Users confined to their
+// own namespace may not read the Namespace object, a Forbidden Get falls back
+// to listing Services in it.
 func hasNamespace(client kubernetes.Interface, namespace string) (bool, error) {
 	if namespace == "" {
 		return false, os.ErrInvalid
 	}
-	ns, err := client.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{})
-	if err != nil {
+	_, err := client.CoreV1().Namespaces().Get(context.TODO(), namespace, metav1.GetOptions{})
+	switch {
+	case err == nil:
+		return true, nil
+	case apierrors.IsNotFound(err):
+		return false, nil
+	case !apierrors.IsForbidden(err):
 		return false, err
 	}
-	for _, n := range ns.Items {
-		if n.Name == namespace {
-			return true, nil
-		}
+	// listing a missing namespace is not an error, the Service lookup that
+	// follows reports it as not found
+	if _, err := client.CoreV1().Services(namespace).List(context.TODO(), metav1.ListOptions{Limit: 1}); err != nil {
+		return false, err
 	}
-	return false, nil
+	return true, nil
 }
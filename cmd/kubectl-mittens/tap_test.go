@@ -26,10 +26,13 @@ import (
 	"github.com/stretchr/testify/require"
 	k8sappsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 const (
@@ -49,7 +52,7 @@ func Test_NewTapCommand(t *testing.T) {
 		{"stray_configmap", fakeClientUntappedWithConfigMap, 80, "default", nil},
 		{"named_ports", fakeClientUntappedNamedPorts, 80, "default", nil},
 		{"no_port_name", fakeClientUntappedNoPortName, 80, "default", nil},
-		{"named_ports_no_match", fakeClientUntappedNamedPortsMissing, 80, "default", ErrDeploymentMissingPorts},
+		{"named_ports_no_match", fakeClientUntappedNamedPortsMissing, 80, "default", ErrWorkloadMissingPorts},
 		{"incorrect_namespace", fakeClientUntappedSimple, 80, "notexist", ErrNamespaceNotExist},
 		{"incorrect_port", fakeClientUntappedSimple, 9999, "default", ErrServiceMissingPort},
 
@@ -77,7 +80,7 @@ func Test_NewTapCommand(t *testing.T) {
 			} else {
 				// sanity checks
 				require.Nil(err)
-				fakeDeployment, err := fakeClient.AppsV1().Deployments(testViper.GetString("namespace")).Get(context.TODO(), "sample-deployment", metav1.GetOptions{})
+				fakeDeployment, err := fakeClient.AppsV1().Deployments(targetNamespace(testViper)).Get(context.TODO(), "sample-deployment", metav1.GetOptions{})
 				require.Nil(err)
 				require.Len(fakeDeployment.Spec.Template.Spec.Containers, 2, "sidecar was not successfully added to deployment spec")
 				// container checks
@@ -91,7 +94,7 @@ func Test_NewTapCommand(t *testing.T) {
 					require.GreaterOrEqual(len(c.Ports), 1, "tap port was not added to the deployment")
 				}
 				// configmap checks
-				fakeCM, err := fakeClient.CoreV1().ConfigMaps(testViper.GetString("namespace")).Get(context.TODO(), mittensConfigMapPrefix+fakeDeployment.Name, metav1.GetOptions{})
+				fakeCM, err := fakeClient.CoreV1().ConfigMaps(targetNamespace(testViper)).Get(context.TODO(), mittensConfigMapPrefix+fakeDeployment.Name, metav1.GetOptions{})
 				require.Nil(err)
 				require.NotNil(fakeCM)
 				require.True(strings.Contains(fakeCM.Name, mittensConfigMapPrefix))
@@ -120,6 +123,7 @@ func Test_NewUntapCommand(t *testing.T) {
 		{"service_without_selectors", fakeClientUntappedNoSelectors, "default", ErrSelectorsMissing},
 		{"multi_deployment_match", fakeClientUntappedMultiDeploymentMatch, "default", ErrServiceSelectorMultiMatch},
 		{"deployment_match_outside_namespace", fakeClientUntappedMatchOutsideNamespace, "default", ErrServiceSelectorNoMatch},
+		{"deployment_listed_outside_namespace", fakeClientTappedListingOtherNamespace, "default", ErrWorkloadOutsideNamespace},
 	}
 	for _, tc := range tests {
 		t.Run(tc.Name, func(t *testing.T) {
@@ -129,7 +133,7 @@ func Test_NewUntapCommand(t *testing.T) {
 			b := bytes.NewBufferString("")
 			cmd := &cobra.Command{}
 			cmd.SetOutput(b)
-			err := NewUntapCommand(fakeClient, testViper)(cmd, []string{"sample-service"})
+			err := NewUntapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
 			if tc.Err != nil {
 				require.NotNil(err)
 				require.True(errors.Is(err, tc.Err))
@@ -369,6 +373,18 @@ func fakeClientUntappedMatchOutsideNamespace() *fake.Clientset {
 	)
 }
 
+// fakeClientTappedListingOtherNamespace returns the Deployment from another
+// Namespace when the Deployments of the tapped Namespace are listed.
+func fakeClientTappedListingOtherNamespace() *fake.Clientset {
+	client := fakeClientTappedSimple()
+	client.PrependReactor("list", "deployments", func(k8stesting.Action) (bool, runtime.Object, error) {
+		deployment := simpleDeployment
+		deployment.Namespace = "other"
+		return true, &k8sappsv1.DeploymentList{Items: []k8sappsv1.Deployment{deployment}}, nil
+	})
+	return client
+}
+
 func fakeClientTappedWithoutAnnotations() *fake.Clientset {
 	namespace := simpleNamespace
 	deployment := simpleDeploymentTapped
@@ -517,3 +533,38 @@ func Test_AutoPortDetection(t *testing.T) {
 		})
 	}
 }
+
+func Test_HasNamespace(t *testing.T) {
+	tests := []struct {
+		Name       string
+		ClientFunc func() *fake.Clientset
+		Namespace  string
+		Exists     bool
+		Forbidden  bool
+	}{
+		{"exists", fakeClientUntappedSimple, "default", true, false},
+		{"missing", fakeClientUntappedSimple, "notexist", false, false},
+		{"tenant", fakeClientTenant, "default", true, false},
+		{"tenant_other_namespace", fakeClientTenant, "other", false, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			exists, err := hasNamespace(tc.ClientFunc(), tc.Namespace)
+			require.Equal(t, tc.Forbidden, apierrors.IsForbidden(err), "unexpected error %v", err)
+			require.Equal(t, tc.Exists, exists)
+		})
+	}
+}
+
+// fakeClientTenant only allows namespaced requests in the default namespace,
+// like a tenant of a shared cluster.
+func fakeClientTenant() *fake.Clientset {
+	client := fakeClientTappedTwoNamespaces()
+	client.PrependReactor("*", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() == "default" {
+			return false, nil, nil
+		}
+		return true, nil, apierrors.NewForbidden(action.GetResource().GroupResource(), "", errors.New("tenant"))
+	})
+	return client
+}
@@ -0,0 +1,171 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// mitmwebPort is the port mitmweb serves its UI on inside the sidecar.
+	mitmwebPort = 8081
+	// mitmwebCommand replaces the default command arguments for the web UI.
+	mitmwebCommand = "mitmweb"
+)
+
+// ErrUINotSupported occurs when a UI is requested that the tap cannot provide.
+var ErrUINotSupported = errors.New("ui not supported, use one of [ tui, web, local ]")
+
+// newWebToken generates the token protecting the mitmweb UI.
+func newWebToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// webConfig returns the mitmproxy options serving the web UI with a token.
+func webConfig(proxyOpts ProxyOptions) []byte {
+	return []byte("\nweb_port: " + strconv.Itoa(mitmwebPort) +
+		"\nweb_password: " + proxyOpts.WebToken +
+		"\nweb_open_browser: false" +
+		"\n")
+}
+
+// webUIToken returns the token of the web UI for a tapped workload, ok is
+// false if the tap runs the terminal UI.
+func webUIToken(client kubernetes.Interface, namespace, workloadName string) (token string, ok bool) {
+	cm, err := client.CoreV1().ConfigMaps(namespace).Get(context.TODO(), mittensConfigMapPrefix+workloadName, metav1.GetOptions{})
+	if err != nil {
+		return "", false
+	}
+	var cfg struct {
+		WebPassword string `json:"web_password"`
+	}
+	if err := yaml.Unmarshal(cm.BinaryData[mitmproxyConfigFile], &cfg); err != nil {
+		return "", false
+	}
+	return cfg.WebPassword, cfg.WebPassword != ""
+}
+
+// serveWebUI forwards a local port to mitmweb in the proxy Pod and prints
+// the URL of the UI. It blocks until interrupted or the forward fails.
+func serveWebUI(cmd *cobra.Command, client kubernetes.Interface, config *rest.Config, pod v1.Pod, token string, localPort int, openBrowser bool) error {
+	ctx := cmd.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	out := cmd.OutOrStdout()
+	stopCh := make(chan struct{})
+	readyCh := make(chan struct{})
+	ports := []string{fmt.Sprintf("%d:%d", localPort, mitmwebPort)}
+	fw, err := newPortForwarder(client, config, pod, ports, stopCh, readyCh, cmd.ErrOrStderr())
+	if err != nil {
+		return err
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- fw.ForwardPorts()
+	}()
+	select {
+	case <-readyCh:
+	case err := <-errCh:
+		return fmt.Errorf("error forwarding the web UI: %w", err)
+	}
+	forwarded, err := fw.GetPorts()
+	if err != nil {
+		close(stopCh)
+		return err
+	}
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/?token=%s", forwarded[0].Local, token)
+	_, _ = fmt.Fprintf(out, "\nmitmweb is available at:\n  %s\n\nPress Ctrl+C to stop.\n", url)
+	if openBrowser {
+		if err := openURL(url); err != nil {
+			_, _ = fmt.Fprintf(out, "Could not open a browser: %v\n", err)
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		err = nil
+	case err = <-errCh:
+	}
+	close(stopCh)
+	return err
+}
+
+// newPortForwarder forwards ports, given as "local:remote" with a free local
+// port picked for 0, to the proxy Pod. It prefers WebSockets and falls back to SPDY.
+func newPortForwarder(client kubernetes.Interface, config *rest.Config, pod v1.Pod, ports []string, stopCh <-chan struct{}, readyCh chan struct{}, errOut io.Writer) (*portforward.PortForwarder, error) {
+	url := client.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(pod.Namespace).
+		Name(pod.Name).
+		SubResource("portforward").
+		URL()
+	transport, upgrader, err := spdy.RoundTripperFor(config)
+	if err != nil {
+		return nil, err
+	}
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, url)
+	wsDialer, err := portforward.NewSPDYOverWebsocketDialer(url, config)
+	if err != nil {
+		return nil, err
+	}
+	dialer = portforward.NewFallbackDialer(wsDialer, dialer, func(err error) bool {
+		return httpstream.IsUpgradeFailure(err) || httpstream.IsHTTPSProxyError(err)
+	})
+	return portforward.NewOnAddresses(dialer, []string{"127.0.0.1"}, ports, stopCh, readyCh, io.Discard, errOut)
+}
+
+// openURL opens url in the default browser.
+func openURL(url string) error {
+	var c *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		c = exec.Command("open", url)
+	case "windows":
+		c = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		c = exec.Command("xdg-open", url)
+	}
+	return c.Start()
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+func Test_TapWebUI(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Protocol string
+		UI       string
+		Err      error
+	}{
+		{"http", "http", "web", nil},
+		{"grpc", "grpc", "web", nil},
+		{"tcp", "tcp", "web", ErrUINotSupported},
+		{"udp", "udp", "web", ErrUINotSupported},
+		{"unknown_ui", "http", "gui", ErrUINotSupported},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			fakeClient := fakeClientUntappedSimple()
+			testViper := viper.New()
+			testViper.Set("proxyPort", 80)
+			testViper.Set("namespace", "default")
+			testViper.Set("protocol", tc.Protocol)
+			testViper.Set("ui", tc.UI)
+			testViper.Set("proxyImage", defaultImageHTTP)
+			testViper.Set("commandArgs", defaultCommandArgs)
+			cmd := &cobra.Command{}
+			cmd.SetOutput(ioutil.Discard)
+			err := NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+			if tc.Err != nil {
+				require.True(errors.Is(err, tc.Err), "expected (%v), got (%v)", tc.Err, err)
+				return
+			}
+			require.Nil(err)
+
+			dpl, err := fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "sample-deployment", metav1.GetOptions{})
+			require.Nil(err)
+			var found bool
+			for _, c := range dpl.Spec.Template.Spec.Containers {
+				if c.Name != mittensContainerName {
+					continue
+				}
+				found = true
+				require.Equal([]string{mitmwebCommand}, c.Args)
+				var webPort bool
+				for _, p := range c.Ports {
+					if p.Name == mittensWebPortName && p.ContainerPort == mitmwebPort {
+						webPort = true
+					}
+				}
+				require.True(webPort, "web port was not added to the sidecar")
+			}
+			require.True(found, "sidecar was not added")
+
+			token, ok := webUIToken(fakeClient, "default", "sample-deployment")
+			require.True(ok)
+			require.Len(token, 32)
+		})
+	}
+}
+
+func Test_WebUIToken(t *testing.T) {
+	require := require.New(t)
+	// taps with the terminal UI have no token
+	_, ok := webUIToken(fakeClientTappedSimple(), "default", "sample-deployment")
+	require.False(ok)
+	_, ok = webUIToken(fakeClientUntappedSimple(), "default", "sample-deployment")
+	require.False(ok)
+
+	a, err := newWebToken()
+	require.Nil(err)
+	b, err := newWebToken()
+	require.Nil(err)
+	require.NotEqual(a, b)
+}
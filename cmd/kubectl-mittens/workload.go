@@ -0,0 +1,462 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	k8sappsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	appsv1 "k8s.io/client-go/kubernetes/typed/apps/v1"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	kindDeployment  = "Deployment"
+	kindStatefulSet = "StatefulSet"
+	kindDaemonSet   = "DaemonSet"
+	kindReplicaSet  = "ReplicaSet"
+
+	// rolloutPollInterval is how often a rollout checks on a replaced Pod.
+	rolloutPollInterval = time.Second
+)
+
+// ErrRolloutStalled occurs when a Pod of a workload that is rolled by mittens
+// cannot be evicted or its replacement does not become ready in time.
+var ErrRolloutStalled = errors.New("the rollout of the workload stalled")
+
+// Workload is a resource that owns a pod template, and is therefore a
+// candidate for receiving a proxy sidecar.
+type Workload interface {
+	// Kind returns the Kubernetes kind of the workload, e.g. "StatefulSet".
+	Kind() string
+	// Name returns the name of the workload.
+	Name() string
+	// Namespace returns the namespace of the workload.
+	Namespace() string
+	// PodTemplate returns the pod template of the workload. Changes made to
+	// the returned template are local, see patchPodTemplate for persisting them.
+	PodTemplate() *v1.PodTemplateSpec
+	// Selector returns the label selector used by the workload to own Pods.
+	Selector() *metav1.LabelSelector
+	// Replicas returns how many Pods the workload wants to run.
+	Replicas() int32
+	// Refresh re-fetches the workload, discarding local changes.
+	Refresh() error
+	// Patch applies a patch to the workload as the mittens field manager.
+	Patch(pt types.PatchType, data []byte) error
+	// RollsOnUpdate reports whether the workload controller replaces
+	// existing Pods by itself after the pod template changes. Workloads
+	// that do not (OnDelete strategies, bare ReplicaSets) must have their
+	// Pods deleted to pick up the change.
+	RollsOnUpdate() bool
+}
+
+// workloadFromSelectors returns the single workload in a namespace whose
+// labels match the given Service selectors. The label an ephemeral tap adds
+// to the selectors of a Service is ignored, see ephemeralSelector.
+func workloadFromSelectors(client kubernetes.Interface, namespace string, selectors map[string]string) (Workload, error) {
+	if _, ok := selectors[labelEphemeral]; ok {
+		withoutLabel := make(map[string]string, len(selectors))
+		for k, v := range selectors {
+			if k != labelEphemeral {
+				withoutLabel[k] = v
+			}
+		}
+		selectors = withoutLabel
+	}
+	var sel string
+	switch len(selectors) {
+	case 0:
+		return nil, ErrSelectorsMissing
+	case 1:
+		for k, v := range selectors {
+			sel = k + "=" + v
+		}
+	default:
+		for k, v := range selectors {
+			sel = strings.Join([]string{sel, k + "=" + v}, ",")
+		}
+		sel = strings.TrimLeft(sel, ",")
+	}
+	workloads, err := listWorkloads(client, namespace, metav1.ListOptions{
+		LabelSelector: sel,
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch len(workloads) {
+	case 0:
+		return nil, ErrServiceSelectorNoMatch
+	case 1:
+		return workloads[0], nil
+	default:
+		return nil, ErrServiceSelectorMultiMatch
+	}
+}
+
+// listWorkloads lists the workloads of every supported kind in a namespace,
+// or in all namespaces if namespace is empty.
+func listWorkloads(client kubernetes.Interface, namespace string, opts metav1.ListOptions) ([]Workload, error) {
+	var workloads []Workload
+	dpls, err := client.AppsV1().Deployments(namespace).List(context.TODO(), opts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range dpls.Items {
+		c := client.AppsV1().Deployments(dpls.Items[i].Namespace)
+		workloads = append(workloads, &deploymentWorkload{client: c, obj: &dpls.Items[i]})
+	}
+	stss, err := client.AppsV1().StatefulSets(namespace).List(context.TODO(), opts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range stss.Items {
+		c := client.AppsV1().StatefulSets(stss.Items[i].Namespace)
+		workloads = append(workloads, &statefulSetWorkload{client: c, obj: &stss.Items[i]})
+	}
+	dss, err := client.AppsV1().DaemonSets(namespace).List(context.TODO(), opts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range dss.Items {
+		c := client.AppsV1().DaemonSets(dss.Items[i].Namespace)
+		workloads = append(workloads, &daemonSetWorkload{client: c, obj: &dss.Items[i]})
+	}
+	rss, err := client.AppsV1().ReplicaSets(namespace).List(context.TODO(), opts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rss.Items {
+		// ReplicaSets managed by a Deployment are tapped through their owner.
+		if metav1.GetControllerOf(&rss.Items[i]) != nil {
+			continue
+		}
+		c := client.AppsV1().ReplicaSets(rss.Items[i].Namespace)
+		workloads = append(workloads, &replicaSetWorkload{client: c, obj: &rss.Items[i]})
+	}
+	return workloads, nil
+}
+
+// tappedWorkloads returns the workloads whose pod template carries the
+// tapped annotation or a proxy sidecar, in a namespace or in all namespaces
+// if namespace is empty.
+func tappedWorkloads(client kubernetes.Interface, namespace string) ([]Workload, error) {
+	workloads, err := listWorkloads(client, namespace, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var tapped []Workload
+	for _, w := range workloads {
+		tmpl := w.PodTemplate()
+		_, standalone := tmpl.GetLabels()[labelStandalone]
+		_, canary := tmpl.GetLabels()[labelCanary]
+		if standalone || canary {
+			// standalone and canary proxies are deleted as a whole, see findLeftovers
+			continue
+		}
+		if _, ok := tmpl.GetAnnotations()[annotationIsTapped]; ok {
+			tapped = append(tapped, w)
+			continue
+		}
+		for _, c := range tmpl.Spec.Containers {
+			if c.Name == mittensContainerName {
+				tapped = append(tapped, w)
+				break
+			}
+		}
+	}
+	return tapped, nil
+}
+
+// rolloutWorkload replaces the Pods of a workload that does not replace them
+// on its own, so that they are recreated from the updated pod template. Pods
+// are evicted one at a time, StatefulSet Pods from the highest ordinal down
+// like the StatefulSet controller does, and each replacement gets timeout to
+// become ready before the next Pod goes. Evictions respect
+// PodDisruptionBudgets and are retried while a budget blocks them.
+func rolloutWorkload(podsClient corev1.PodInterface, w Workload, timeout time.Duration) error {
+	if w.RollsOnUpdate() {
+		return nil
+	}
+	if w.Selector() == nil {
+		return ErrSelectorsMissing
+	}
+	sel, err := metav1.LabelSelectorAsSelector(w.Selector())
+	if err != nil {
+		return fmt.Errorf("error parsing %s selector: %w", w.Kind(), err)
+	}
+	// never restart every Pod in the namespace
+	if sel.Empty() {
+		return ErrSelectorsMissing
+	}
+	pods, err := livePods(podsClient, sel.String())
+	if err != nil {
+		return err
+	}
+	if w.Kind() == kindStatefulSet {
+		sort.SliceStable(pods, func(i, j int) bool { return podOrdinal(pods[i]) > podOrdinal(pods[j]) })
+	} else {
+		sort.SliceStable(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+	}
+	for _, pod := range pods {
+		ctx, cancel := context.WithCancel(context.TODO())
+		if timeout > 0 {
+			ctx, cancel = context.WithTimeout(context.TODO(), timeout)
+		}
+		err := replacePod(ctx, podsClient, sel.String(), pod)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("error restarting Pod %q: %w", pod.Name, err)
+		}
+	}
+	return nil
+}
+
+// replacePod evicts a Pod and waits until it is gone and as many Pods as
+// before are ready.
+func replacePod(ctx context.Context, podsClient corev1.PodInterface, selector string, pod v1.Pod) error {
+	pods, err := livePods(podsClient, selector)
+	if err != nil {
+		return err
+	}
+	want := readyPods(pods)
+	eviction := &policyv1.Eviction{ObjectMeta: metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace}}
+	err = wait.PollUntilContextCancel(ctx, rolloutPollInterval, true, func(ctx context.Context) (bool, error) {
+		err := podsClient.EvictV1(ctx, eviction)
+		switch {
+		case err == nil, apierrors.IsNotFound(err):
+			return true, nil
+		case apierrors.IsTooManyRequests(err):
+			// a PodDisruptionBudget does not allow the eviction yet
+			return false, nil
+		}
+		return false, err
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w: the eviction was not allowed by a PodDisruptionBudget", ErrRolloutStalled)
+		}
+		return err
+	}
+	err = wait.PollUntilContextCancel(ctx, rolloutPollInterval, true, func(ctx context.Context) (bool, error) {
+		pods, err := livePods(podsClient, selector)
+		if err != nil {
+			return false, err
+		}
+		for _, p := range pods {
+			if p.UID == pod.UID {
+				return false, nil
+			}
+		}
+		return readyPods(pods) >= want, nil
+	})
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("%w: the replacement of Pod %q is not ready", ErrRolloutStalled, pod.Name)
+	}
+	return err
+}
+
+// livePods lists the Pods matching a label selector that are not terminating.
+func livePods(podsClient corev1.PodInterface, selector string) ([]v1.Pod, error) {
+	list, err := podsClient.List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	var pods []v1.Pod
+	for _, pod := range list.Items {
+		if pod.DeletionTimestamp == nil {
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
+
+// readyPods counts the ready Pods.
+func readyPods(pods []v1.Pod) int {
+	ready := 0
+	for _, pod := range pods {
+		if podReady(pod) {
+			ready++
+		}
+	}
+	return ready
+}
+
+// podOrdinal returns the ordinal of a StatefulSet Pod, -1 if it has none.
+func podOrdinal(pod v1.Pod) int {
+	i := strings.LastIndex(pod.Name, "-")
+	if i < 0 {
+		return -1
+	}
+	ordinal, err := strconv.Atoi(pod.Name[i+1:])
+	if err != nil {
+		return -1
+	}
+	return ordinal
+}
+
+// replicasOrDefault returns the replicas of a workload spec, which the API
+// server defaults to 1 if unset.
+func replicasOrDefault(replicas *int32) int32 {
+	if replicas == nil {
+		return 1
+	}
+	return *replicas
+}
+
+type deploymentWorkload struct {
+	client appsv1.DeploymentInterface
+	obj    *k8sappsv1.Deployment
+}
+
+func (d *deploymentWorkload) Kind() string                     { return kindDeployment }
+func (d *deploymentWorkload) Name() string                     { return d.obj.Name }
+func (d *deploymentWorkload) Namespace() string                { return d.obj.Namespace }
+func (d *deploymentWorkload) PodTemplate() *v1.PodTemplateSpec { return &d.obj.Spec.Template }
+func (d *deploymentWorkload) Selector() *metav1.LabelSelector  { return d.obj.Spec.Selector }
+func (d *deploymentWorkload) Replicas() int32                  { return replicasOrDefault(d.obj.Spec.Replicas) }
+func (d *deploymentWorkload) RollsOnUpdate() bool              { return true }
+
+func (d *deploymentWorkload) Refresh() error {
+	obj, err := d.client.Get(context.TODO(), d.obj.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	d.obj = obj
+	return nil
+}
+
+func (d *deploymentWorkload) Patch(pt types.PatchType, data []byte) error {
+	obj, err := d.client.Patch(context.TODO(), d.obj.Name, pt, data, patchOptions)
+	if err != nil {
+		return err
+	}
+	d.obj = obj
+	return nil
+}
+
+type statefulSetWorkload struct {
+	client appsv1.StatefulSetInterface
+	obj    *k8sappsv1.StatefulSet
+}
+
+func (s *statefulSetWorkload) Kind() string                     { return kindStatefulSet }
+func (s *statefulSetWorkload) Name() string                     { return s.obj.Name }
+func (s *statefulSetWorkload) Namespace() string                { return s.obj.Namespace }
+func (s *statefulSetWorkload) PodTemplate() *v1.PodTemplateSpec { return &s.obj.Spec.Template }
+func (s *statefulSetWorkload) Selector() *metav1.LabelSelector  { return s.obj.Spec.Selector }
+func (s *statefulSetWorkload) Replicas() int32                  { return replicasOrDefault(s.obj.Spec.Replicas) }
+
+func (s *statefulSetWorkload) RollsOnUpdate() bool {
+	return s.obj.Spec.UpdateStrategy.Type != k8sappsv1.OnDeleteStatefulSetStrategyType
+}
+
+func (s *statefulSetWorkload) Refresh() error {
+	obj, err := s.client.Get(context.TODO(), s.obj.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	s.obj = obj
+	return nil
+}
+
+func (s *statefulSetWorkload) Patch(pt types.PatchType, data []byte) error {
+	obj, err := s.client.Patch(context.TODO(), s.obj.Name, pt, data, patchOptions)
+	if err != nil {
+		return err
+	}
+	s.obj = obj
+	return nil
+}
+
+type daemonSetWorkload struct {
+	client appsv1.DaemonSetInterface
+	obj    *k8sappsv1.DaemonSet
+}
+
+func (d *daemonSetWorkload) Kind() string                     { return kindDaemonSet }
+func (d *daemonSetWorkload) Name() string                     { return d.obj.Name }
+func (d *daemonSetWorkload) Namespace() string                { return d.obj.Namespace }
+func (d *daemonSetWorkload) PodTemplate() *v1.PodTemplateSpec { return &d.obj.Spec.Template }
+func (d *daemonSetWorkload) Selector() *metav1.LabelSelector  { return d.obj.Spec.Selector }
+func (d *daemonSetWorkload) Replicas() int32                  { return d.obj.Status.DesiredNumberScheduled }
+
+func (d *daemonSetWorkload) RollsOnUpdate() bool {
+	return d.obj.Spec.UpdateStrategy.Type != k8sappsv1.OnDeleteDaemonSetStrategyType
+}
+
+func (d *daemonSetWorkload) Refresh() error {
+	obj, err := d.client.Get(context.TODO(), d.obj.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	d.obj = obj
+	return nil
+}
+
+func (d *daemonSetWorkload) Patch(pt types.PatchType, data []byte) error {
+	obj, err := d.client.Patch(context.TODO(), d.obj.Name, pt, data, patchOptions)
+	if err != nil {
+		return err
+	}
+	d.obj = obj
+	return nil
+}
+
+// replicaSetWorkload is a ReplicaSet that is not managed by a Deployment.
+type replicaSetWorkload struct {
+	client appsv1.ReplicaSetInterface
+	obj    *k8sappsv1.ReplicaSet
+}
+
+func (r *replicaSetWorkload) Kind() string                     { return kindReplicaSet }
+func (r *replicaSetWorkload) Name() string                     { return r.obj.Name }
+func (r *replicaSetWorkload) Namespace() string                { return r.obj.Namespace }
+func (r *replicaSetWorkload) PodTemplate() *v1.PodTemplateSpec { return &r.obj.Spec.Template }
+func (r *replicaSetWorkload) Selector() *metav1.LabelSelector  { return r.obj.Spec.Selector }
+func (r *replicaSetWorkload) Replicas() int32                  { return replicasOrDefault(r.obj.Spec.Replicas) }
+
+// RollsOnUpdate is always false, a ReplicaSet never replaces running Pods.
+func (r *replicaSetWorkload) RollsOnUpdate() bool { return false }
+
+func (r *replicaSetWorkload) Refresh() error {
+	obj, err := r.client.Get(context.TODO(), r.obj.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	r.obj = obj
+	return nil
+}
+
+func (r *replicaSetWorkload) Patch(pt types.PatchType, data []byte) error {
+	obj, err := r.client.Patch(context.TODO(), r.obj.Name, pt, data, patchOptions)
+	if err != nil {
+		return err
+	}
+	r.obj = obj
+	return nil
+}
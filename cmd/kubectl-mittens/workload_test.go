@@ -0,0 +1,338 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	k8sappsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func Test_WorkloadFromSelectors(t *testing.T) {
+	tests := []struct {
+		Name       string
+		ClientFunc func() *fake.Clientset
+		Kind       string
+		Err        error
+	}{
+		{"deployment", fakeClientUntappedSimple, kindDeployment, nil},
+		{"statefulset", fakeClientUntappedStatefulSet, kindStatefulSet, nil},
+		{"daemonset", fakeClientUntappedDaemonSet, kindDaemonSet, nil},
+		{"replicaset", fakeClientUntappedReplicaSet, kindReplicaSet, nil},
+		{"owned_replicaset", fakeClientUntappedOwnedReplicaSet, kindDeployment, nil},
+		{"mixed_kinds", fakeClientUntappedMixedKinds, "", ErrServiceSelectorMultiMatch},
+		{"missing_workload", fakeClientUntappedWithoutDeployment, "", ErrServiceSelectorNoMatch},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			w, err := workloadFromSelectors(tc.ClientFunc(), "default", simpleService.Spec.Selector)
+			if tc.Err != nil {
+				require.True(errors.Is(err, tc.Err))
+				return
+			}
+			require.Nil(err)
+			require.Equal(tc.Kind, w.Kind())
+			require.Equal("default", w.Namespace())
+		})
+	}
+}
+
+func Test_TapStatefulSet(t *testing.T) {
+	tests := []struct {
+		Name         string
+		Strategy     k8sappsv1.StatefulSetUpdateStrategyType
+		PodsReplaced bool
+	}{
+		{"rolling_update", k8sappsv1.RollingUpdateStatefulSetStrategyType, false},
+		{"on_delete", k8sappsv1.OnDeleteStatefulSetStrategyType, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			fakeClient := fakeClientUntappedStatefulSet()
+			evicted := evictPodsLikeController(fakeClient, 0)
+			sts, err := fakeClient.AppsV1().StatefulSets("default").Get(context.TODO(), "sample-statefulset", metav1.GetOptions{})
+			require.Nil(err)
+			sts.Spec.UpdateStrategy.Type = tc.Strategy
+			_, err = fakeClient.AppsV1().StatefulSets("default").Update(context.TODO(), sts, metav1.UpdateOptions{})
+			require.Nil(err)
+
+			testViper := viper.New()
+			testViper.Set("proxyPort", 80)
+			testViper.Set("namespace", "default")
+			cmd := &cobra.Command{}
+			cmd.SetOutput(ioutil.Discard)
+			err = NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+			require.Nil(err)
+
+			sts, err = fakeClient.AppsV1().StatefulSets("default").Get(context.TODO(), "sample-statefulset", metav1.GetOptions{})
+			require.Nil(err)
+			require.Len(sts.Spec.Template.Spec.Containers, 2, "sidecar was not successfully added to statefulset spec")
+			require.Equal("sample-statefulset", sts.Spec.Template.Annotations[annotationIsTapped])
+
+			pod, err := fakeClient.CoreV1().Pods("default").Get(context.TODO(), "sample-statefulset-0", metav1.GetOptions{})
+			require.Nil(err)
+			if tc.PodsReplaced {
+				require.Equal([]string{"sample-statefulset-0"}, *evicted, "OnDelete StatefulSet Pods were not restarted")
+				require.NotEqual(simpleStatefulSetPod.UID, pod.UID)
+			} else {
+				require.Empty(*evicted)
+				require.Equal(simpleStatefulSetPod.UID, pod.UID)
+			}
+			_, err = fakeClient.CoreV1().Pods("default").Get(context.TODO(), "unrelated-pod", metav1.GetOptions{})
+			require.Nil(err, "Pods outside the StatefulSet selector must not be restarted")
+
+			err = NewUntapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+			require.Nil(err)
+			sts, err = fakeClient.AppsV1().StatefulSets("default").Get(context.TODO(), "sample-statefulset", metav1.GetOptions{})
+			require.Nil(err)
+			require.Len(sts.Spec.Template.Spec.Containers, 1, "sidecar was not removed from statefulset spec")
+		})
+	}
+}
+
+func Test_RolloutWorkload(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Blocked int
+		Timeout time.Duration
+		Evicted []string
+		Err     error
+	}{
+		{"highest_ordinal_first", 0, time.Minute, []string{"sample-statefulset-2", "sample-statefulset-1", "sample-statefulset-0"}, nil},
+		{"disruption_budget_retry", 1, time.Minute, []string{"sample-statefulset-2", "sample-statefulset-1", "sample-statefulset-0"}, nil},
+		{"disruption_budget_stalled", -1, 100 * time.Millisecond, nil, ErrRolloutStalled},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			fakeClient := fakeClientUntappedStatefulSet()
+			for _, name := range []string{"sample-statefulset-1", "sample-statefulset-2"} {
+				pod := simpleStatefulSetPod
+				pod.Name, pod.UID = name, types.UID(name+"-uid")
+				_, err := fakeClient.CoreV1().Pods("default").Create(context.TODO(), &pod, metav1.CreateOptions{})
+				require.Nil(err)
+			}
+			evicted := evictPodsLikeController(fakeClient, tc.Blocked)
+			sts, err := fakeClient.AppsV1().StatefulSets("default").Get(context.TODO(), "sample-statefulset", metav1.GetOptions{})
+			require.Nil(err)
+			sts.Spec.UpdateStrategy.Type = k8sappsv1.OnDeleteStatefulSetStrategyType
+			workload := &statefulSetWorkload{client: fakeClient.AppsV1().StatefulSets("default"), obj: sts}
+
+			err = rolloutWorkload(fakeClient.CoreV1().Pods("default"), workload, tc.Timeout)
+			if tc.Err != nil {
+				require.True(errors.Is(err, tc.Err), "expected %v, got %v", tc.Err, err)
+				return
+			}
+			require.Nil(err)
+			require.Equal(tc.Evicted, *evicted)
+			_, err = fakeClient.CoreV1().Pods("default").Get(context.TODO(), "unrelated-pod", metav1.GetOptions{})
+			require.Nil(err, "Pods outside the StatefulSet selector must not be restarted")
+		})
+	}
+}
+
+// evictPodsLikeController answers evictions of Pods like the API server and
+// a controller would, replacing the evicted Pod with a ready one of the same
+// name. The first blocked evictions, all if negative, are refused like a
+// PodDisruptionBudget does. It returns the names of the evicted Pods.
+func evictPodsLikeController(client *fake.Clientset, blocked int) *[]string {
+	var evicted []string
+	gvr := v1.SchemeGroupVersion.WithResource("pods")
+	client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		eviction := action.(k8stesting.CreateAction).GetObject().(*policyv1.Eviction)
+		if blocked != 0 {
+			blocked--
+			return true, nil, apierrors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 0)
+		}
+		// the client is locked while reactors run, use the tracker directly
+		obj, err := client.Tracker().Get(gvr, action.GetNamespace(), eviction.Name)
+		if err != nil {
+			return true, nil, err
+		}
+		pod := obj.(*v1.Pod).DeepCopy()
+		if err := client.Tracker().Delete(gvr, action.GetNamespace(), eviction.Name); err != nil {
+			return true, nil, err
+		}
+		evicted = append(evicted, eviction.Name)
+		pod.UID = types.UID(fmt.Sprintf("%s-%d", pod.Name, len(evicted)))
+		pod.Status.Conditions = []v1.PodCondition{{Type: v1.ContainersReady, Status: v1.ConditionTrue}}
+		return true, nil, client.Tracker().Add(pod)
+	})
+	return &evicted
+}
+
+var (
+	simpleSelector = &metav1.LabelSelector{
+		MatchLabels: map[string]string{
+			"app": "myapp",
+		},
+	}
+
+	simpleStatefulSet = k8sappsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "sample-statefulset",
+			Namespace: "default",
+			Labels: map[string]string{
+				"app": "myapp",
+			},
+		},
+		Spec: k8sappsv1.StatefulSetSpec{
+			Selector: simpleSelector,
+			Template: simpleDeployment.Spec.Template,
+		},
+	}
+
+	simpleDaemonSet = k8sappsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "sample-daemonset",
+			Namespace: "default",
+			Labels: map[string]string{
+				"app": "myapp",
+			},
+		},
+		Spec: k8sappsv1.DaemonSetSpec{
+			Selector: simpleSelector,
+			Template: simpleDeployment.Spec.Template,
+		},
+	}
+
+	simpleReplicaSet = k8sappsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "sample-replicaset",
+			Namespace: "default",
+			Labels: map[string]string{
+				"app": "myapp",
+			},
+		},
+		Spec: k8sappsv1.ReplicaSetSpec{
+			Selector: simpleSelector,
+			Template: simpleDeployment.Spec.Template,
+		},
+	}
+
+	simpleStatefulSetPod = v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "sample-statefulset-0",
+			Namespace: "default",
+			UID:       "sample-statefulset-0-uid",
+			Labels: map[string]string{
+				"app": "myapp",
+			},
+		},
+	}
+
+	unrelatedPod = v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "unrelated-pod",
+			Namespace: "default",
+			Labels: map[string]string{
+				"app": "other",
+			},
+		},
+	}
+)
+
+func fakeClientUntappedStatefulSet() *fake.Clientset {
+	namespace := simpleNamespace
+	statefulSet := simpleStatefulSet
+	service := simpleService
+	pod := simpleStatefulSetPod
+	other := unrelatedPod
+	return fake.NewSimpleClientset(
+		&namespace,
+		&statefulSet,
+		&service,
+		&pod,
+		&other,
+	)
+}
+
+func fakeClientUntappedDaemonSet() *fake.Clientset {
+	namespace := simpleNamespace
+	daemonSet := simpleDaemonSet
+	service := simpleService
+	return fake.NewSimpleClientset(
+		&namespace,
+		&daemonSet,
+		&service,
+	)
+}
+
+func fakeClientUntappedReplicaSet() *fake.Clientset {
+	namespace := simpleNamespace
+	replicaSet := simpleReplicaSet
+	service := simpleService
+	return fake.NewSimpleClientset(
+		&namespace,
+		&replicaSet,
+		&service,
+	)
+}
+
+func fakeClientUntappedOwnedReplicaSet() *fake.Clientset {
+	namespace := simpleNamespace
+	deployment := simpleDeployment
+	replicaSet := simpleReplicaSet
+	controller := true
+	replicaSet.OwnerReferences = []metav1.OwnerReference{
+		{
+			APIVersion: "apps/v1",
+			Kind:       kindDeployment,
+			Name:       deployment.Name,
+			Controller: &controller,
+		},
+	}
+	service := simpleService
+	return fake.NewSimpleClientset(
+		&namespace,
+		&deployment,
+		&replicaSet,
+		&service,
+	)
+}
+
+func fakeClientUntappedMixedKinds() *fake.Clientset {
+	namespace := simpleNamespace
+	deployment := simpleDeployment
+	statefulSet := simpleStatefulSet
+	service := simpleService
+	return fake.NewSimpleClientset(
+		&namespace,
+		&deployment,
+		&statefulSet,
+		&service,
+	)
+}
@@ -0,0 +1,172 @@
+"""mitmproxy addon that decodes gRPC messages for mittens.
+
+Message types are resolved from the request path (/package.Service/Method)
+using descriptors loaded from the directory in `mittens_grpc_descriptors`:
+
+  * .proto sources, compiled with grpc_tools at startup
+  * FileDescriptorSets (.pb, .desc, .protoset, .binpb)
+
+When `mittens_grpc_reflection` is set, descriptors are fetched lazily from the
+upstream server (`mittens_grpc_upstream`) through gRPC server reflection.
+"""
+
+import glob
+import gzip
+import importlib.resources
+import logging
+import os
+import struct
+import tempfile
+
+from google.protobuf import descriptor_pb2
+from google.protobuf import descriptor_pool
+from google.protobuf import json_format
+from google.protobuf import message_factory
+from mitmproxy import contentviews
+from mitmproxy import http
+
+DESCRIPTOR_SET_EXTENSIONS = (".pb", ".desc", ".protoset", ".binpb")
+
+# The descriptor pool shared by the addon and the contentview.
+_pool = None
+
+
+def _compile_protos(directory, protos):
+    """Compile .proto sources into a FileDescriptorSet."""
+    from grpc_tools import protoc
+
+    wkt = str(importlib.resources.files("grpc_tools") / "_proto")
+    with tempfile.TemporaryDirectory() as tmp:
+        out = os.path.join(tmp, "protos.pb")
+        args = [
+            "grpc_tools.protoc",
+            f"-I{directory}",
+            f"-I{wkt}",
+            "--include_imports",
+            f"--descriptor_set_out={out}",
+            *[os.path.relpath(p, directory) for p in protos],
+        ]
+        if protoc.main(args) != 0:
+            raise ValueError(f"protoc failed to compile {protos}")
+        with open(out, "rb") as f:
+            return descriptor_pb2.FileDescriptorSet.FromString(f.read())
+
+
+def _load_descriptor_files(directory):
+    """Build a descriptor pool from the files in directory."""
+    pool = descriptor_pool.DescriptorPool()
+    sets = []
+    for path in sorted(glob.glob(os.path.join(directory, "*"))):
+        if path.endswith(DESCRIPTOR_SET_EXTENSIONS):
+            with open(path, "rb") as f:
+                sets.append(descriptor_pb2.FileDescriptorSet.FromString(f.read()))
+    protos = sorted(glob.glob(os.path.join(directory, "*.proto")))
+    if protos:
+        sets.append(_compile_protos(directory, protos))
+
+    added = set()
+    for fds in sets:
+        for fd in fds.file:
+            if fd.name in added:
+                continue
+            pool.Add(fd)
+            added.add(fd.name)
+    if not added:
+        return None
+    logging.info("mittens: loaded %d proto files from %s", len(added), directory)
+    return pool
+
+
+def _reflection_pool(target):
+    """Build a descriptor pool backed by server reflection."""
+    import grpc
+    from grpc_reflection.v1alpha.proto_reflection_descriptor_database import (
+        ProtoReflectionDescriptorDatabase,
+    )
+
+    channel = grpc.insecure_channel(target)
+    logging.info("mittens: using server reflection on %s", target)
+    return descriptor_pool.DescriptorPool(ProtoReflectionDescriptorDatabase(channel))
+
+
+def _find_method(path):
+    """Resolve a gRPC request path to a MethodDescriptor."""
+    if _pool is None:
+        return None
+    parts = path.split("?", 1)[0].strip("/").split("/")
+    if len(parts) != 2:
+        return None
+    try:
+        return _pool.FindMethodByName(f"{parts[0]}.{parts[1]}")
+    except Exception:  # noqa: BLE001 - unknown methods and reflection errors
+        return None
+
+
+def _frames(data, compressed_with):
+    """Split a gRPC body into length-prefixed messages."""
+    offset = 0
+    while offset + 5 <= len(data):
+        compressed = data[offset]
+        (length,) = struct.unpack(">I", data[offset + 1 : offset + 5])
+        payload = data[offset + 5 : offset + 5 + length]
+        if compressed and compressed_with == "gzip":
+            payload = gzip.decompress(payload)
+        yield payload
+        offset += 5 + length
+
+
+class MittensGrpc(contentviews.Contentview):
+    """Decode gRPC messages with the loaded descriptors."""
+
+    def prettify(self, data: bytes, metadata: contentviews.Metadata) -> str:
+        flow = metadata.flow
+        method = _find_method(flow.request.path)
+        if method is None:
+            raise ValueError("no descriptor for " + flow.request.path)
+        message = metadata.http_message
+        if isinstance(message, http.Request):
+            descriptor = method.input_type
+        else:
+            descriptor = method.output_type
+        cls = message_factory.GetMessageClass(descriptor)
+        encoding = message.headers.get("grpc-encoding", "identity")
+
+        out = []
+        for payload in _frames(data, encoding):
+            msg = cls.FromString(payload)
+            out.append(json_format.MessageToJson(msg, preserving_proto_field_name=True))
+        return f"// {descriptor.full_name}\n" + "\n".join(out)
+
+    def render_priority(self, data: bytes, metadata: contentviews.Metadata) -> float:
+        if not metadata.content_type or not metadata.content_type.startswith("application/grpc"):
+            return 0
+        if metadata.flow is None or _find_method(metadata.flow.request.path) is None:
+            return 0
+        # prefer this view over the schemaless built-in gRPC view
+        return 2
+
+
+class MittensGrpcAddon:
+    def load(self, loader):
+        loader.add_option("mittens_grpc_descriptors", str, "", "Directory containing .proto files and FileDescriptorSets.")
+        loader.add_option("mittens_grpc_upstream", str, "", "Address of the upstream gRPC server.")
+        loader.add_option("mittens_grpc_reflection", bool, False, "Resolve descriptors through server reflection.")
+
+    def configure(self, updated):
+        global _pool
+        from mitmproxy import ctx
+
+        if not updated & {"mittens_grpc_descriptors", "mittens_grpc_upstream", "mittens_grpc_reflection"}:
+            return
+        _pool = None
+        if ctx.options.mittens_grpc_descriptors:
+            try:
+                _pool = _load_descriptor_files(ctx.options.mittens_grpc_descriptors)
+            except Exception as e:  # noqa: BLE001 - keep proxying even if descriptors are broken
+                logging.error("mittens: error loading descriptors: %s", e)
+        if _pool is None and ctx.options.mittens_grpc_reflection and ctx.options.mittens_grpc_upstream:
+            _pool = _reflection_pool(ctx.options.mittens_grpc_upstream)
+
+
+contentviews.add(MittensGrpc)
+addons = [MittensGrpcAddon()]
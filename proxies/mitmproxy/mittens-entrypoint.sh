@@ -3,14 +3,23 @@
 # Note: pipefail is not POSIX, so we skip it here for compatibility
 # The script will still work correctly without it
 
+# Ephemeral containers cannot mount the ConfigMap, mittens passes the config in the environment instead
+if [ -n "${MITTENS_CONFIG}" ]; then
+  printf '%s\n' "${MITTENS_CONFIG}" > /home/mitmproxy/.mitmproxy/config.yaml
+  echo "Config file written from MITTENS_CONFIG to /home/mitmproxy/.mitmproxy/config.yaml" >&2
 # Copy the config file if it exists and is readable
-if [ -f /home/mitmproxy/config/config.yaml ] && [ -r /home/mitmproxy/config/config.yaml ]; then
+elif [ -f /home/mitmproxy/config/config.yaml ] && [ -r /home/mitmproxy/config/config.yaml ]; then
   cp /home/mitmproxy/config/config.yaml /home/mitmproxy/.mitmproxy/config.yaml
   echo "Config file copied to /home/mitmproxy/.mitmproxy/config.yaml" >&2
 else
   echo "Warning: Config file not found or not readable at /home/mitmproxy/config/config.yaml" >&2
 fi
 
+# Ephemeral containers cannot be removed from a Pod, mittens stops them on
+# untap by sending TERM to the pid recorded here.
+echo $$ > /tmp/mittens.pid
+trap 'tmux kill-server 2>/dev/null; exit 0' TERM
+
 prog="${1}"
 case "$prog" in
   mitmproxy)
@@ -23,6 +32,9 @@ case "$prog" in
     # Create a tmux session and capture any startup errors
     tmux new-session -d -s mitmproxy -c /home/mitmproxy -x 200 -y 50 \
       "mitmproxy --set confdir=${MITMPROXY_PATH} ${@:2}; bash"
+    # F12 detaches the client without ending the session, mittens keeps the tap in place
+    tmux bind-key -n F12 detach-client
+    tmux set-option -t mitmproxy status-right " F12: detach " >/dev/null
     
     echo "Mitmproxy tmux session created. Waiting for it to start..." >&2
     sleep 3
@@ -41,7 +53,9 @@ case "$prog" in
     # This allows users to attach via: kubectl exec -it <pod> -- tmux attach-session -t mitmproxy
     # or just: kubectl exec -it <pod> -- bash
     echo "Container keeping alive with sleep infinity" >&2
-    sleep infinity
+    # wait on a background sleep so the TERM trap runs right away
+    sleep infinity &
+    wait $!
     ;;
   mitmdump|mitmweb)
     MITMPROXY_PATH='/home/mitmproxy/.mitmproxy'
@@ -0,0 +1,79 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// decodeDNS renders a DNS message in a dig-like format.
+func decodeDNS(data []byte) (string, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(data); err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	kind := "query"
+	if msg.Response {
+		kind = "response"
+	}
+	fmt.Fprintf(&b, ";; dns %s id=%d opcode=%d rcode=%s", kind, msg.ID, msg.OpCode, msg.RCode)
+	for _, q := range msg.Questions {
+		fmt.Fprintf(&b, "\n;%s\t%s\t%s", q.Name, q.Class, q.Type)
+	}
+	sections := []struct {
+		name    string
+		records []dnsmessage.Resource
+	}{
+		{"answer", msg.Answers},
+		{"authority", msg.Authorities},
+		{"additional", msg.Additionals},
+	}
+	for _, s := range sections {
+		for _, rr := range s.records {
+			fmt.Fprintf(&b, "\n%s\t%d\t%s\t%s\t%s", rr.Header.Name, rr.Header.TTL, rr.Header.Class, rr.Header.Type, resourceBody(rr.Body))
+		}
+	}
+	return b.String(), nil
+}
+
+// resourceBody formats the data of a resource record.
+func resourceBody(body dnsmessage.ResourceBody) string {
+	switch r := body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(r.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		return net.IP(r.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		return r.CNAME.String()
+	case *dnsmessage.NSResource:
+		return r.NS.String()
+	case *dnsmessage.PTRResource:
+		return r.PTR.String()
+	case *dnsmessage.MXResource:
+		return fmt.Sprintf("%d %s", r.Pref, r.MX)
+	case *dnsmessage.SRVResource:
+		return fmt.Sprintf("%d %d %d %s", r.Priority, r.Weight, r.Port, r.Target)
+	case *dnsmessage.TXTResource:
+		return fmt.Sprintf("%q", r.TXT)
+	case *dnsmessage.SOAResource:
+		return fmt.Sprintf("%s %s %d", r.NS, r.MBox, r.Serial)
+	default:
+		return body.GoString()
+	}
+}
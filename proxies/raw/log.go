@@ -0,0 +1,55 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Logger serializes relay output so that hexdumps of concurrent connections
+// do not interleave.
+type Logger struct {
+	mu      sync.Mutex
+	out     io.Writer
+	maxDump int
+}
+
+// Event writes a single timestamped line.
+func (l *Logger) Event(format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = fmt.Fprintf(l.out, "%s %s\n", time.Now().Format("15:04:05.000"), fmt.Sprintf(format, args...))
+}
+
+// Dump writes a timestamped line followed by a hexdump of data.
+func (l *Logger) Dump(data []byte, format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = fmt.Fprintf(l.out, "%s %s\n", time.Now().Format("15:04:05.000"), fmt.Sprintf(format, args...))
+	if l.maxDump <= 0 {
+		return
+	}
+	truncated := len(data) > l.maxDump
+	if truncated {
+		data = data[:l.maxDump]
+	}
+	_, _ = io.WriteString(l.out, hex.Dump(data))
+	if truncated {
+		_, _ = fmt.Fprintf(l.out, "... truncated to %d bytes\n", l.maxDump)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	defaultWait = 2 * time.Second
+	defaultTick = 10 * time.Millisecond
+)
+
+func Test_LoggerDump(t *testing.T) {
+	tests := []struct {
+		Name     string
+		MaxDump  int
+		Contains string
+		Missing  string
+	}{
+		{"full", 16, "61 62 63", "truncated"},
+		{"truncated", 2, "truncated to 2 bytes", "61 62 63"},
+		{"disabled", 0, "3 bytes", "61 62"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			b := &bytes.Buffer{}
+			l := &Logger{out: b, maxDump: tc.MaxDump}
+			l.Dump([]byte("abc"), "%d bytes", 3)
+			require.Contains(b.String(), tc.Contains)
+			require.NotContains(b.String(), tc.Missing)
+		})
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// mittens-relay is the sidecar used by mittens for raw taps. It accepts
+// connections (or datagrams) on the tap listen port, forwards them to the
+// upstream container and logs every connection along with a hexdump of the
+// traffic.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+func main() {
+	listen := flag.String("listen", envOr("MITTENS_LISTEN", ":7777"), "address to accept tapped traffic on")
+	upstream := flag.String("upstream", envOr("MITTENS_UPSTREAM", ""), "address of the tapped container, e.g. 127.0.0.1:6379")
+	protocol := flag.String("protocol", envOr("MITTENS_PROTOCOL", "tcp"), "protocol to relay, one of [ tcp, udp, tunnel ]")
+	tunnelListen := flag.String("tunnel-listen", envOr("MITTENS_TUNNEL_LISTEN", ":7778"), "address to accept tunnels from the mittens client on, for the tunnel protocol")
+	decode := flag.String("decode", envOr("MITTENS_DECODE", ""), "decoder for udp payloads, one of [ dns ]")
+	maxDump := flag.Int("max-dump", 4096, "maximum bytes to hexdump per read, 0 disables the hexdump")
+	flag.Parse()
+
+	if *upstream == "" && *protocol != "tunnel" {
+		log.Fatal("an upstream address is required")
+	}
+
+	l := &Logger{out: os.Stdout, maxDump: *maxDump}
+	var err error
+	switch *protocol {
+	case "tcp":
+		err = relayTCP(*listen, *upstream, l)
+	case "udp":
+		var decoder Decoder
+		switch *decode {
+		case "":
+		case "dns":
+			decoder = decodeDNS
+		default:
+			log.Fatalf("unsupported decoder %q", *decode)
+		}
+		err = relayUDP(*listen, *upstream, decoder, l)
+	case "tunnel":
+		// traffic is inspected by mitmproxy on the client, only connections are logged
+		l.maxDump = 0
+		err = relayTunnel(*listen, *tunnelListen, *upstream, l)
+	default:
+		err = fmt.Errorf("unsupported protocol %q", *protocol)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// envOr returns the value of an environment variable, or def if it is unset.
+func envOr(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return def
+}
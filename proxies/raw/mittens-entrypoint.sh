@@ -0,0 +1,50 @@
+#!/bin/bash
+
+# The relay is configured through the environment by mittens:
+#   MITTENS_UPSTREAM  address of the tapped container, e.g. 127.0.0.1:6379,
+#                     used in tunnel mode while no client is attached
+#   MITTENS_PROTOCOL  protocol to relay, tcp, udp or tunnel
+#   MITTENS_TUNNEL_LISTEN  address accepting client tunnels in tunnel mode, e.g. :7778
+#   MITTENS_DECODE    optional payload decoder for udp, e.g. dns
+
+# Ephemeral containers cannot be removed from a Pod, mittens stops them on
+# untap by sending TERM to the pid recorded here.
+echo $$ > /tmp/mittens.pid
+trap 'tmux kill-server 2>/dev/null; exit 0' TERM
+
+prog="${1}"
+case "$prog" in
+  ""|mittens-relay)
+    # Start the relay in a tmux session so the connection log can be viewed
+    # interactively. Users can 'kubectl exec -it <pod> -- tmux attach-session -t mittens'
+    echo "Starting mittens-relay in tmux session (${MITTENS_PROTOCOL:-tcp} -> ${MITTENS_UPSTREAM})" >&2
+    tmux new-session -d -s mittens -x 200 -y 50 "mittens-relay ${@:2}; bash"
+    tmux set-option -t mittens history-limit 100000 >/dev/null
+    # F12 detaches the client without ending the session, mittens keeps the tap in place
+    tmux bind-key -n F12 detach-client
+    tmux set-option -t mittens status-right " F12: detach " >/dev/null
+
+    sleep 1
+    if tmux has-session -t mittens 2>/dev/null; then
+      echo "mittens-relay session is running" >&2
+    else
+      echo "ERROR: mittens-relay session exited immediately" >&2
+    fi
+
+    # Keep the container running, waiting on a background sleep so the TERM trap runs right away
+    sleep infinity &
+    wait $!
+    ;;
+  bash|/bin/bash|sh|/bin/sh)
+    if tmux has-session -t mittens 2>/dev/null; then
+      echo "Attaching to mittens-relay session..." >&2
+      exec tmux attach-session -t mittens
+    else
+      exec "${@}"
+    fi
+    ;;
+  *)
+    echo "Running command: ${@}" >&2
+    exec "${@}"
+    ;;
+esac
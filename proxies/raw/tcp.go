@@ -0,0 +1,118 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// relayTCP accepts connections on listen and relays each of them to upstream.
+func relayTCP(listen, upstream string, l *Logger) error {
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	l.Event("relaying tcp %s -> %s", ln.Addr(), upstream)
+	return serveTCP(ln, upstream, l)
+}
+
+// serveTCP relays connections accepted from ln until ln is closed.
+func serveTCP(ln net.Listener, upstream string, l *Logger) error {
+	var id atomic.Uint64
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go handleTCP(conn, upstream, id.Add(1), l)
+	}
+}
+
+// handleTCP relays a single connection. Connections that never carry any
+// data, such as kubelet TCP probes, are not logged.
+func handleTCP(client net.Conn, upstream string, id uint64, l *Logger) {
+	defer client.Close()
+	server, err := net.Dial("tcp", upstream)
+	if err != nil {
+		l.Event("[conn %d] %s: error dialing upstream: %v", id, client.RemoteAddr(), err)
+		return
+	}
+	defer server.Close()
+
+	c := &tcpConn{id: id, client: client.RemoteAddr().String(), upstream: upstream, log: l}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		c.pipe(server, client, "client -> upstream", &c.sent)
+	}()
+	go func() {
+		defer wg.Done()
+		c.pipe(client, server, "upstream -> client", &c.received)
+	}()
+	wg.Wait()
+	if c.opened.Load() {
+		l.Event("[conn %d] %s closed, %d bytes sent, %d bytes received", id, c.client, c.sent.Load(), c.received.Load())
+	}
+}
+
+// tcpConn tracks the state of a relayed connection.
+type tcpConn struct {
+	id       uint64
+	client   string
+	upstream string
+	log      *Logger
+
+	once     sync.Once
+	opened   atomic.Bool
+	sent     atomic.Int64
+	received atomic.Int64
+}
+
+// pipe copies src to dst, logging and dumping every read.
+func (c *tcpConn) pipe(dst, src net.Conn, direction string, total *atomic.Int64) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			c.once.Do(func() {
+				c.opened.Store(true)
+				c.log.Event("[conn %d] %s -> %s opened", c.id, c.client, c.upstream)
+			})
+			total.Add(int64(n))
+			c.log.Dump(buf[:n], "[conn %d] %s %d bytes", c.id, direction, n)
+			if _, wErr := dst.Write(buf[:n]); wErr != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	// propagate the half-close so request/response protocols finish cleanly
+	if tc, ok := dst.(*net.TCPConn); ok {
+		_ = tc.CloseWrite()
+	} else {
+		_ = dst.Close()
+	}
+	if tc, ok := src.(*net.TCPConn); ok {
+		_ = tc.CloseRead()
+	}
+}
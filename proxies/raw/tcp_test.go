@@ -0,0 +1,123 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// syncBuffer is a bytes.Buffer safe for use by the relay goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.String()
+}
+
+func Test_RelayTCP(t *testing.T) {
+	require := require.New(t)
+
+	// upstream echoes a fixed reply after reading the request
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	defer upstream.Close()
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.ReadAll(conn)
+		_, _ = conn.Write([]byte("+PONG\r\n"))
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	out := &syncBuffer{}
+	l := &Logger{out: out, maxDump: 4096}
+	done := make(chan error, 1)
+	go func() {
+		done <- serveTCP(ln, upstream.Addr().String(), l)
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(err)
+	_, err = conn.Write([]byte("PING\r\n"))
+	require.Nil(err)
+	require.Nil(conn.(*net.TCPConn).CloseWrite())
+	reply, err := io.ReadAll(conn)
+	require.Nil(err)
+	require.Equal("+PONG\r\n", string(reply))
+	conn.Close()
+
+	require.Eventually(func() bool {
+		return strings.Contains(out.String(), "closed, 6 bytes sent, 7 bytes received")
+	}, defaultWait, defaultTick)
+	require.Nil(ln.Close())
+	require.Nil(<-done)
+
+	log := out.String()
+	require.Contains(log, "client -> upstream 6 bytes")
+	require.Contains(log, "upstream -> client 7 bytes")
+	require.Contains(log, "50 49 4e 47 0d 0a", "request was not hexdumped")
+}
+
+func Test_RelayTCPSilentProbe(t *testing.T) {
+	require := require.New(t)
+
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	out := &syncBuffer{}
+	go func() {
+		_ = serveTCP(ln, upstream.Addr().String(), &Logger{out: out})
+	}()
+	defer ln.Close()
+
+	// a kubelet TCP probe connects and disconnects without sending data
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(err)
+	_, _ = io.ReadAll(conn)
+	conn.Close()
+	require.NotContains(out.String(), "opened")
+}
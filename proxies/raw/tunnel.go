@@ -0,0 +1,166 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// tunnelPairTimeout is how long an inbound connection waits for an idle
+	// tunnel from the mittens client before it is relayed to the upstream.
+	tunnelPairTimeout = 10 * time.Second
+	// tunnelReady is written to a tunnel once it is paired with a connection.
+	tunnelReady byte = 1
+	// tunnelBacklog bounds the idle tunnels held open for the mittens client.
+	tunnelBacklog = 64
+)
+
+// relayTunnel accepts connections on listen and hands each of them to an
+// idle tunnel the mittens client opened on tunnelListen. The client runs
+// mitmproxy locally and dials the tapped container itself. While no client
+// is attached, connections are relayed to upstream like in tcp mode.
+func relayTunnel(listen, tunnelListen, upstream string, l *Logger) error {
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	tln, err := net.Listen("tcp", tunnelListen)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	l.Event("tunneling tcp %s -> mittens client on %s, falling back to %s", ln.Addr(), tln.Addr(), upstream)
+	return serveTunnel(ln, tln, upstream, tunnelPairTimeout, l)
+}
+
+// serveTunnel pairs connections accepted from ln with tunnels accepted from
+// tln until ln is closed. Connections not paired within pairTimeout are
+// relayed to upstream, or dropped if it is empty.
+func serveTunnel(ln, tln net.Listener, upstream string, pairTimeout time.Duration, l *Logger) error {
+	idle := make(chan net.Conn, tunnelBacklog)
+	go func() {
+		for {
+			t, err := tln.Accept()
+			if err != nil {
+				return
+			}
+			idle <- t
+		}
+	}()
+	var id atomic.Uint64
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go handleTunnel(conn, idle, upstream, pairTimeout, id.Add(1), l)
+	}
+}
+
+// handleTunnel relays a single connection through a tunnel, or to upstream
+// if no tunnel is available. The tunnel is only taken once the client sent
+// data, so TCP probes do not use up tunnels.
+func handleTunnel(client net.Conn, idle <-chan net.Conn, upstream string, pairTimeout time.Duration, id uint64, l *Logger) {
+	defer client.Close()
+	buf := make([]byte, 32*1024)
+	n, _ := client.Read(buf)
+	if n == 0 {
+		return
+	}
+
+	c := &tcpConn{id: id, client: client.RemoteAddr().String(), upstream: "mittens client", log: l}
+	tunnel := pairTunnel(idle, append([]byte{tunnelReady}, buf[:n]...), pairTimeout)
+	if tunnel == nil {
+		if upstream == "" {
+			l.Event("[conn %d] %s: no tunnel from the mittens client, dropping connection", id, c.client)
+			return
+		}
+		// the mittens client is not attached, traffic flows uninspected
+		l.Event("[conn %d] %s: no tunnel from the mittens client, relaying to %s", id, c.client, upstream)
+		server, err := net.Dial("tcp", upstream)
+		if err != nil {
+			l.Event("[conn %d] %s: error dialing upstream: %v", id, c.client, err)
+			return
+		}
+		if _, err := server.Write(buf[:n]); err != nil {
+			server.Close()
+			return
+		}
+		tunnel = server
+		c.upstream = upstream
+	}
+	defer tunnel.Close()
+	c.once.Do(func() {
+		c.opened.Store(true)
+		l.Event("[conn %d] %s -> %s opened", id, c.client, c.upstream)
+	})
+	c.sent.Add(int64(n))
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		c.pipe(tunnel, client, "client -> "+c.upstream, &c.sent)
+	}()
+	go func() {
+		defer wg.Done()
+		c.pipe(client, tunnel, c.upstream+" -> client", &c.received)
+	}()
+	wg.Wait()
+	l.Event("[conn %d] %s closed, %d bytes sent, %d bytes received", id, c.client, c.sent.Load(), c.received.Load())
+}
+
+// pairTunnel takes an idle tunnel and writes first to it. Tunnels whose
+// client went away are closed and the next one is tried. It returns nil if
+// no tunnel becomes available within timeout.
+func pairTunnel(idle <-chan net.Conn, first []byte, timeout time.Duration) net.Conn {
+	expired := time.After(timeout)
+	for {
+		select {
+		case t := <-idle:
+			if !tunnelOpen(t) {
+				t.Close()
+				continue
+			}
+			if _, err := t.Write(first); err != nil {
+				t.Close()
+				continue
+			}
+			return t
+		case <-expired:
+			return nil
+		}
+	}
+}
+
+// tunnelOpen reports whether the client side of an idle tunnel is still
+// open. The client never writes to an idle tunnel, so a read only returns
+// before the deadline once the tunnel was closed.
+func tunnelOpen(t net.Conn) bool {
+	_ = t.SetReadDeadline(time.Now().Add(time.Millisecond))
+	defer func() {
+		_ = t.SetReadDeadline(time.Time{})
+	}()
+	_, err := t.Read(make([]byte, 1))
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RelayTunnel(t *testing.T) {
+	require := require.New(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	tln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	defer tln.Close()
+	out := &syncBuffer{}
+	done := make(chan error, 1)
+	go func() {
+		done <- serveTunnel(ln, tln, "", tunnelPairTimeout, &Logger{out: out})
+	}()
+
+	// a tunnel whose client went away is skipped
+	stale, err := net.Dial("tcp", tln.Addr().String())
+	require.Nil(err)
+	stale.Close()
+
+	// the mittens client holds a tunnel open and answers once it is paired
+	tunnel, err := net.Dial("tcp", tln.Addr().String())
+	require.Nil(err)
+	defer tunnel.Close()
+	paired := make(chan string, 1)
+	go func() {
+		ready := make([]byte, 1)
+		if _, err := io.ReadFull(tunnel, ready); err != nil || ready[0] != tunnelReady {
+			paired <- ""
+			return
+		}
+		req, _ := io.ReadAll(tunnel)
+		_, _ = tunnel.Write([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+		_ = tunnel.(*net.TCPConn).CloseWrite()
+		paired <- string(req)
+	}()
+
+	// a kubelet TCP probe does not take the tunnel
+	probe, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(err)
+	probe.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(err)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.Nil(err)
+	require.Nil(conn.(*net.TCPConn).CloseWrite())
+	reply, err := io.ReadAll(conn)
+	require.Nil(err)
+	require.Equal("HTTP/1.1 204 No Content\r\n\r\n", string(reply))
+	require.Equal("GET / HTTP/1.1\r\n\r\n", <-paired)
+	conn.Close()
+
+	require.Eventually(func() bool {
+		return strings.Contains(out.String(), "closed, 18 bytes sent, 27 bytes received")
+	}, defaultWait, defaultTick)
+	require.Nil(ln.Close())
+	require.Nil(<-done)
+}
+
+func Test_RelayTunnelNoClient(t *testing.T) {
+	require := require.New(t)
+
+	// upstream records the request and replies once it was read
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	defer upstream.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, _ := io.ReadAll(conn)
+		received <- string(req)
+		_, _ = conn.Write([]byte("+PONG\r\n"))
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	tln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	defer tln.Close()
+	out := &syncBuffer{}
+	done := make(chan error, 1)
+	go func() {
+		done <- serveTunnel(ln, tln, upstream.Addr().String(), 100*time.Millisecond, &Logger{out: out})
+	}()
+
+	// no mittens client opened a tunnel
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(err)
+	_, err = conn.Write([]byte("PING\r\n"))
+	require.Nil(err)
+	require.Nil(conn.(*net.TCPConn).CloseWrite())
+	reply, err := io.ReadAll(conn)
+	require.Nil(err)
+	require.Equal("+PONG\r\n", string(reply))
+	require.Equal("PING\r\n", <-received)
+	conn.Close()
+
+	require.Eventually(func() bool {
+		return strings.Contains(out.String(), "closed, 6 bytes sent, 7 bytes received")
+	}, defaultWait, defaultTick)
+	require.Contains(out.String(), "no tunnel from the mittens client, relaying to "+upstream.Addr().String())
+	require.Nil(ln.Close())
+	require.Nil(<-done)
+}
@@ -0,0 +1,130 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// udpSessionTimeout is how long a client's upstream socket is kept open
+// without traffic. Replies arriving after it expires are dropped.
+const udpSessionTimeout = 2 * time.Minute
+
+// Decoder renders a datagram payload in a human readable form.
+type Decoder func([]byte) (string, error)
+
+// relayUDP accepts datagrams on listen and relays them to upstream.
+func relayUDP(listen, upstream string, decode Decoder, l *Logger) error {
+	pc, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		return err
+	}
+	l.Event("relaying udp %s -> %s", pc.LocalAddr(), upstream)
+	return serveUDP(pc, upstream, decode, l)
+}
+
+// serveUDP relays datagrams received on pc until pc is closed. Each client
+// address gets its own upstream socket so replies can be routed back to it.
+func serveUDP(pc net.PacketConn, upstream string, decode Decoder, l *Logger) error {
+	r := &udpRelay{
+		pc:       pc,
+		upstream: upstream,
+		decode:   decode,
+		log:      l,
+		sessions: map[string]net.Conn{},
+	}
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		r.datagram(buf[:n], addr, "client -> upstream")
+		conn, err := r.session(addr)
+		if err != nil {
+			l.Event("[udp] %s: error dialing upstream: %v", addr, err)
+			continue
+		}
+		if _, err := conn.Write(buf[:n]); err != nil {
+			l.Event("[udp] %s: error writing upstream: %v", addr, err)
+		}
+	}
+}
+
+type udpRelay struct {
+	pc       net.PacketConn
+	upstream string
+	decode   Decoder
+	log      *Logger
+
+	mu       sync.Mutex
+	sessions map[string]net.Conn
+}
+
+// session returns the upstream socket for a client, dialing it if needed.
+func (r *udpRelay) session(client net.Addr) (net.Conn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if conn, ok := r.sessions[client.String()]; ok {
+		return conn, nil
+	}
+	conn, err := net.Dial("udp", r.upstream)
+	if err != nil {
+		return nil, err
+	}
+	r.sessions[client.String()] = conn
+	go r.replies(conn, client)
+	return conn, nil
+}
+
+// replies relays datagrams from upstream back to the client until the
+// session is idle for udpSessionTimeout.
+func (r *udpRelay) replies(conn net.Conn, client net.Addr) {
+	defer func() {
+		r.mu.Lock()
+		delete(r.sessions, client.String())
+		r.mu.Unlock()
+		conn.Close()
+	}()
+	buf := make([]byte, 64*1024)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(udpSessionTimeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		r.datagram(buf[:n], client, "upstream -> client")
+		if _, err := r.pc.WriteTo(buf[:n], client); err != nil {
+			r.log.Event("[udp] %s: error writing reply: %v", client, err)
+			return
+		}
+	}
+}
+
+// datagram logs a datagram, decoding it when a decoder is configured.
+func (r *udpRelay) datagram(data []byte, client net.Addr, direction string) {
+	if r.decode != nil {
+		if s, err := r.decode(data); err == nil {
+			r.log.Event("[udp] %s %s %d bytes\n%s", client, direction, len(data), s)
+			return
+		}
+	}
+	r.log.Dump(data, "[udp] %s %s %d bytes", client, direction, len(data))
+}
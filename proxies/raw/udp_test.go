@@ -0,0 +1,103 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func Test_RelayUDP(t *testing.T) {
+	require := require.New(t)
+
+	// upstream answers every query for example.com. with 192.0.2.1
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(err)
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var q dnsmessage.Message
+			if err := q.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			q.Response = true
+			q.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+			}}
+			reply, _ := q.Pack()
+			_, _ = upstream.WriteTo(reply, addr)
+		}
+	}()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(err)
+	out := &syncBuffer{}
+	done := make(chan error, 1)
+	go func() {
+		done <- serveUDP(pc, upstream.LocalAddr().String(), decodeDNS, &Logger{out: out, maxDump: 4096})
+	}()
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	require.Nil(err)
+	defer conn.Close()
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 42, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packed, err := query.Pack()
+	require.Nil(err)
+	_, err = conn.Write(packed)
+	require.Nil(err)
+
+	require.Nil(conn.SetReadDeadline(time.Now().Add(defaultWait)))
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	require.Nil(err)
+	var reply dnsmessage.Message
+	require.Nil(reply.Unpack(buf[:n]))
+	require.Equal(uint16(42), reply.ID)
+	require.Len(reply.Answers, 1)
+
+	require.Eventually(func() bool {
+		return strings.Contains(out.String(), "upstream -> client")
+	}, defaultWait, defaultTick)
+	require.Nil(pc.Close())
+	require.Nil(<-done)
+
+	log := out.String()
+	require.Contains(log, conn.LocalAddr().String()+" client -> upstream")
+	require.Contains(log, ";; dns query id=42")
+	require.Contains(log, ";; dns response id=42")
+	require.Contains(log, "192.0.2.1")
+}
+
+func Test_DecodeDNSInvalid(t *testing.T) {
+	_, err := decodeDNS([]byte{0x01})
+	require.NotNil(t, err)
+}